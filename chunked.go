@@ -11,7 +11,8 @@ import (
 	"io"
 )
 
-const maxLineLength = 4096 // assumed <= bufio.defaultBufSize
+const maxLineLength = 4096                // assumed <= bufio.defaultBufSize
+const maxTrailersLength = HEADER_MAX_SIZE // CHANGED: trailers are copied like headers
 
 var ErrLineTooLong = errors.New("header line too long")
 
@@ -56,6 +57,27 @@ func (cr *chunkedReader) beginChunk() []byte {
 	return full
 }
 
+// CHANGED: return last chunk line followed by trailers, up to the empty line ending the body, nil on error
+func (cr *chunkedReader) readTrailers(last []byte) []byte {
+	// line is owned by the bufio.Reader, and must be copied before reading trailers
+	c := bytes.Clone(last)
+	for {
+		line, _, err := readChunkLine(cr.r)
+		if err != nil {
+			cr.err = err
+			return nil
+		}
+		c = append(c, line...)
+		if len(c)-len(last) > maxTrailersLength {
+			cr.err = errors.New("trailers too long")
+			return nil
+		}
+		if len(line) == 2 {
+			return c
+		}
+	}
+}
+
 func (cr *chunkedReader) chunkHeaderAvailable() bool {
 	n := cr.r.Buffered()
 	if n > 0 {
@@ -68,21 +90,6 @@ func (cr *chunkedReader) chunkHeaderAvailable() bool {
 // CHANGED: receives line from beginChunk, return it it not nil (not error)
 func (cr *chunkedReader) Read(b []uint8) (n int, err error) {
 	for cr.err == nil || (cr.err == io.EOF && cr.c != nil) {
-		//if cr.checkEnd {
-		//	if n > 0 && cr.r.Buffered() < 2 {
-		//		// We have some data. Return early (per the io.Reader
-		//		// contract) instead of potentially blocking while
-		//		// reading more.
-		//		break
-		//	}
-		//	if _, cr.err = io.ReadFull(cr.r, cr.buf[:2]); cr.err == nil {
-		//		if string(cr.buf[:]) != "\r\n" {
-		//			cr.err = errors.New("malformed chunked encoding")
-		//			break
-		//		}
-		//	}
-		//	cr.checkEnd = false
-		//}
 		if cr.n == 0 {
 			if n > 0 && !cr.chunkHeaderAvailable() {
 				// We've read enough. Don't potentially block
@@ -92,7 +99,7 @@ func (cr *chunkedReader) Read(b []uint8) (n int, err error) {
 			// CHANGED: save chunk to consume and increase bytes to consume by size of chunk + CR
 			cr.c = cr.beginChunk()
 			if cr.err == io.EOF {
-				cr.c = append(cr.c, 13, 10)
+				cr.c = cr.readTrailers(cr.c)
 			}
 			cr.n += uint64(len(cr.c)) + 2
 			continue
@@ -104,6 +111,28 @@ func (cr *chunkedReader) Read(b []uint8) (n int, err error) {
 		if uint64(len(rbuf)) > cr.n {
 			rbuf = rbuf[:cr.n]
 		}
+		// CHANGED: chunk data must be followed by CRLF, checked before copying it
+		if cr.c == nil {
+			if cr.n > 2 && uint64(len(rbuf)) > cr.n-2 {
+				rbuf = rbuf[:cr.n-2]
+			} else if cr.n <= 2 {
+				if n > 0 && cr.r.Buffered() < int(cr.n) {
+					break
+				}
+				var end []byte
+				end, cr.err = cr.r.Peek(int(cr.n))
+				if cr.err == io.EOF {
+					cr.err = io.ErrUnexpectedEOF
+				}
+				if cr.err != nil {
+					break
+				}
+				if !bytes.HasSuffix([]byte("\r\n"), end) {
+					cr.err = errors.New("malformed chunked encoding")
+					break
+				}
+			}
+		}
 		var n0 int
 		// CHANGED: start consuming chunk before consuming source
 		if cr.c != nil {
@@ -118,6 +147,10 @@ func (cr *chunkedReader) Read(b []uint8) (n int, err error) {
 			}
 		} else {
 			n0, cr.err = cr.r.Read(rbuf)
+			// CHANGED: body is truncated if source ends before the last chunk
+			if cr.err == io.EOF {
+				cr.err = io.ErrUnexpectedEOF
+			}
 		}
 		n += n0
 		b = b[n0:]
@@ -151,6 +184,13 @@ func readChunkLine(b *bufio.Reader) ([]byte, []byte, error) {
 	if len(p) >= maxLineLength {
 		return nil, nil, ErrLineTooLong // no wrap
 	}
+	// CHANGED: like net/http, verify that the line ends in a CRLF, and that no CRs appear before the end,
+	// as a bare LF is not permitted in chunked encoding lines and could be read differently by the next hop
+	if idx := bytes.IndexByte(p, '\r'); idx == -1 {
+		return nil, nil, errors.New("chunked line ends with bare LF")
+	} else if idx != len(p)-2 {
+		return nil, nil, errors.New("invalid CR in chunked line")
+	}
 	l := p
 	p = trimTrailingWhitespace(p)
 	p, err = removeChunkExtension(p)
@@ -254,6 +294,9 @@ type FlushAfterChunkWriter struct {
 }
 
 func parseHexUint(v []byte) (n uint64, err error) {
+	if len(v) == 0 {
+		return 0, errors.New("empty hex number for chunk length")
+	}
 	for i, b := range v {
 		switch {
 		case '0' <= b && b <= '9':
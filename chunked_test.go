@@ -0,0 +1,59 @@
+package kpx
+
+import (
+	"bytes"
+	"io"
+	"net/http/httputil"
+	"strings"
+	"testing"
+)
+
+func TestChunkedReader(t *testing.T) {
+	for _, test := range []struct {
+		body     string
+		expected string // chunks copied, or "" if invalid
+	}{
+		{"5\r\nhello\r\n0\r\n\r\n", "5\r\nhello\r\n0\r\n\r\n"},
+		{"5;ext=1\r\nhello\r\n6\r\n world\r\n0\r\n\r\n", "5;ext=1\r\nhello\r\n6\r\n world\r\n0\r\n\r\n"},
+		{"5\r\nhelloXX0\r\n\r\n", ""},
+		{"5\r\nhello world\r\n0\r\n\r\n", ""},
+		{"\r\nhello\r\n", ""},
+		{"5\r\nhel", ""},
+		{"0\r\nX-Trailer: 1\r\n\r\nGET", "0\r\nX-Trailer: 1\r\n\r\n"},
+		{"0\r\nX-Trailer: 1\r\n", ""},
+		{"5\nhello\r\n0\r\n\r\n", ""},
+	} {
+		body, err := io.ReadAll(NewChunkedReader(strings.NewReader(test.body)))
+		if test.expected == "" && err == nil {
+			t.Errorf("%q: expected error", test.body)
+		}
+		if test.expected != "" && (err != nil || string(body) != test.expected) {
+			t.Errorf("%q: unexpected body %q %v", test.body, body, err)
+		}
+	}
+}
+
+func FuzzChunkedReader(f *testing.F) {
+	f.Add([]byte("5\r\nhello\r\n0\r\n\r\n"))
+	f.Add([]byte("3;a=\"b\"\r\nabc\r\n10\r\n0123456789abcdef\r\n0\r\n\r\n"))
+	f.Add([]byte("5\nhello\n0\n\n"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		body, err := io.ReadAll(NewChunkedReader(bytes.NewReader(data)))
+		if err != nil {
+			// chunks are copied as is
+			if !bytes.HasPrefix(data, body) {
+				t.Fatalf("unexpected body %q for %q", body, data)
+			}
+			return
+		}
+		// last chunk and trailers are followed by an empty line
+		if !bytes.HasPrefix(data, body) || !bytes.HasSuffix(body, []byte("\r\n\r\n")) {
+			t.Fatalf("unexpected body %q for %q", body, data)
+		}
+		// chunks are read the same way by the next hop
+		_, err = io.ReadAll(httputil.NewChunkedReader(bytes.NewReader(body)))
+		if err != nil {
+			t.Fatalf("chunks %q rejected by http: %v", body, err)
+		}
+	})
+}
@@ -0,0 +1,510 @@
+package kpx
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/howeyc/gopass"
+	"github.com/palantir/stacktrace"
+)
+
+// subcommands, identified by their first words before any option: kpx <command> [options] [args]
+var commands = map[string]func(args []string){
+	"key rotate": keyRotate,
+	"login":      loginCommand,
+	"check":      checkCommand,
+	"resolve":    resolveCommand,
+	"pac":        pacCommand,
+	"schema":     schemaCommand,
+}
+
+// find subcommand from command line, removing its words so remaining options can be parsed as usual
+func findCommand() func(args []string) {
+	for words := 2; words > 0; words-- {
+		if len(os.Args) <= words {
+			continue
+		}
+		if command, ok := commands[strings.Join(os.Args[1:1+words], " ")]; ok {
+			os.Args = append(os.Args[:1], os.Args[1+words:]...)
+			return command
+		}
+	}
+	return nil
+}
+
+func defaultConfig() string {
+	if options.Config != "" {
+		return options.Config
+	}
+	if _, err := os.Stat(AppName + ".yaml"); err == nil {
+		return AppName + ".yaml"
+	} else if _, err := os.Stat(AppName + ".json"); err == nil {
+		return AppName + ".json"
+	}
+	return AppName + ".yaml"
+}
+
+var encryptedRegex = regexp.MustCompile(regexp.QuoteMeta(ENCRYPTED) + `(` + regexp.QuoteMeta(ENCRYPTED_V2) + `)?[A-Za-z0-9+/=]+`)
+
+// re-encrypt all passwords of the config file and its included and password files with a new key, keeping a backup of old key and files
+func keyRotate(args []string) {
+	if len(args) != 0 {
+		println("invalid arguments")
+		usage()
+	}
+	config := defaultConfig()
+	if isRemoteConfig(config) {
+		logFatal("[-] Error: unable to rotate key of remote config %s", config)
+	}
+	oldKey, err := os.ReadFile(options.KeyFile)
+	if err != nil {
+		logFatal("[-] Error: unable to read key: %s", err)
+	}
+	stat, err := os.Stat(config)
+	if err != nil {
+		logFatal("[-] Error: unable to read config: %s", err)
+	}
+	content, err := os.ReadFile(config)
+	if err != nil {
+		logFatal("[-] Error: unable to read config: %s", err)
+	}
+	// password files and environment variables of credentials may also contain encrypted passwords
+	conf := Config{}
+	err = conf.readFromFile(config)
+	if err != nil {
+		logFatal("[-] Error: unable to read config: %s", err)
+	}
+	// included files may also contain encrypted passwords, and are rotated like password files
+	var files []string
+	absConfig, _ := filepath.Abs(config)
+	for _, file := range conf.files {
+		if file != absConfig {
+			files = append(files, file)
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(conf.conf.Credentials)) {
+		cred := conf.conf.Credentials[name]
+		if cred.PasswordFile != "" && !slices.Contains(files, cred.PasswordFile) {
+			files = append(files, cred.PasswordFile)
+		}
+		if value, ok := os.LookupEnv(cred.PasswordEnv); ok && cred.PasswordEnv != "" && strings.HasPrefix(value, ENCRYPTED) {
+			fmt.Printf("Credential '%s' password from environment variable `%s` is not re-encrypted, use `%s -e` with the new key\n", name, cred.PasswordEnv, AppName)
+		}
+		if cred.PasswordCommand != "" {
+			fmt.Printf("Credential '%s' password from command is not re-encrypted, use `%s -e` with the new key if it is encrypted\n", name, AppName)
+		}
+	}
+	// re-encrypt everything before writing anything
+	newKey := createKey()
+	rotated, count, err := rotateContent(oldKey, newKey, string(content))
+	if err != nil {
+		logFatal("[-] Error: %s: %s", config, err)
+	}
+	rotatedFiles := map[string]string{}
+	contentFiles := map[string][]byte{}
+	modeFiles := map[string]os.FileMode{}
+	for _, file := range files {
+		fileStat, err := os.Stat(file)
+		if err != nil {
+			logFatal("[-] Error: unable to read file: %s", err)
+		}
+		fileContent, err := os.ReadFile(file)
+		if err != nil {
+			logFatal("[-] Error: unable to read file: %s", err)
+		}
+		rotatedFile, n, err := rotateContent(oldKey, newKey, string(fileContent))
+		if err != nil {
+			logFatal("[-] Error: %s: %s", file, err)
+		}
+		if n > 0 {
+			rotatedFiles[file] = rotatedFile
+			contentFiles[file] = fileContent
+			modeFiles[file] = fileStat.Mode().Perm()
+			count += n
+		}
+	}
+	// backup old key, config, included and password files, then write new ones
+	err = os.WriteFile(options.KeyFile+".bak", oldKey, 0600)
+	if err != nil {
+		logFatal("[-] Error: unable to backup key: %s", err)
+	}
+	err = os.WriteFile(config+".bak", content, stat.Mode().Perm())
+	if err != nil {
+		logFatal("[-] Error: unable to backup config: %s", err)
+	}
+	for file := range rotatedFiles {
+		err = os.WriteFile(file+".bak", contentFiles[file], modeFiles[file])
+		if err != nil {
+			logFatal("[-] Error: unable to backup file: %s", err)
+		}
+	}
+	err = os.WriteFile(config, []byte(rotated), stat.Mode().Perm())
+	if err != nil {
+		logFatal("[-] Error: unable to write config: %s", err)
+	}
+	for _, file := range files {
+		if rotatedFile, ok := rotatedFiles[file]; ok {
+			err = os.WriteFile(file, []byte(rotatedFile), modeFiles[file])
+			if err != nil {
+				logFatal("[-] Error: unable to write file, restore it from '%s.bak' and config from '%s.bak': %s", file, config, err)
+			}
+			fmt.Printf("Re-encrypted file `%s`, backup is `%s.bak`\n", file, file)
+		}
+	}
+	err = os.WriteFile(options.KeyFile, newKey, 0600)
+	if err != nil {
+		logFatal("[-] Error: unable to write key, restore it from '%s.bak' and config from '%s.bak': %s", options.KeyFile, config, err)
+	}
+	fmt.Printf("Rotated key `%s`, re-encrypted %d password(s) in `%s`\n", options.KeyFile, count, config)
+	fmt.Printf("Backups are `%s.bak` and `%s.bak`\n", options.KeyFile, config)
+	os.Exit(0)
+}
+
+// re-encrypt all encrypted passwords of the content with the new key, returning the number of passwords
+func rotateContent(oldKey []byte, newKey []byte, content string) (string, int, error) {
+	count := 0
+	var rotateErr error
+	rotated := encryptedRegex.ReplaceAllStringFunc(content, func(token string) string {
+		if rotateErr != nil {
+			return token
+		}
+		password, err := decryptWithKey(oldKey, token[len(ENCRYPTED):])
+		if err != nil {
+			rotateErr = stacktrace.Propagate(err, "unable to decrypt '%s'", token)
+			return token
+		}
+		encrypted, err := encryptWithKey(newKey, password)
+		if err != nil {
+			rotateErr = err
+			return token
+		}
+		count++
+		return ENCRYPTED + encrypted
+	})
+	return rotated, count, rotateErr
+}
+
+// send a new password for a credential to the running instance, which validates it before using it
+func loginCommand(args []string) {
+	if len(args) != 1 {
+		println("invalid arguments")
+		usage()
+	}
+	name := args[0]
+	// find running instance address from configuration file
+	config := Config{}
+	err := config.readFromFile(defaultConfig())
+	if err != nil {
+		logFatal("[-] Error: unable to read config: %s", err)
+	}
+	address := config.adminAddress()
+	if address == "" {
+		logFatal("[-] Error: no http or admin listener in config")
+	}
+	// ask password
+	fmt.Printf("Credential [%s] - Enter password", name)
+	if options.User != "" {
+		fmt.Printf(" for user '%s'", options.User)
+	}
+	fmt.Print(": ")
+	pwdBytes, err := gopass.GetPasswdMasked() // looks like password always exists even if error
+	if err != nil {
+		os.Exit(1)
+	}
+	values := url.Values{}
+	values.Set("password", string(pwdBytes))
+	if options.User != "" {
+		values.Set("login", options.User)
+	}
+	// never use a proxy to talk to the local instance
+	httpClient := &http.Client{Timeout: 30 * time.Second, Transport: &http.Transport{Proxy: nil}}
+	request, err := http.NewRequest("POST", fmt.Sprintf("http://%s/credentials/%s", address, url.PathEscape(name)), strings.NewReader(values.Encode()))
+	if err != nil {
+		logFatal("[-] Error: %s", err)
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set(CREDENTIALS_HEADER, "1")
+	response, err := httpClient.Do(request)
+	if err != nil {
+		logFatal("[-] Error: unable to contact %s at %s: %s", AppName, address, err)
+	}
+	defer func() { _ = response.Body.Close() }()
+	body, _ := io.ReadAll(response.Body)
+	fmt.Print(string(body))
+	if response.StatusCode != http.StatusOK {
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// check config file without listening nor asking passwords, reporting all errors with their line number
+func checkCommand(args []string) {
+	if len(args) != 0 {
+		println("invalid arguments")
+		usage()
+	}
+	// keep stdout for command output
+	logWriter(os.Stderr)
+	name := defaultConfig()
+	config := newConfig()
+	err := config.readFromFile(name)
+	if err != nil {
+		logFatal("[-] Error: %s: %#s", name, err)
+	}
+	// unknown fields are only errors in strict mode
+	for _, issue := range config.unknownFields {
+		if config.conf.Strict {
+			fmt.Printf("%s\n", issue)
+		} else {
+			fmt.Printf("%s (warning)\n", issue)
+		}
+	}
+	issues := config.checkAll()
+	// entries may come from included files, remote config is already downloaded
+	contents := map[string]string{}
+	for _, issue := range issues {
+		file, path := config.conf.source(issue.path)
+		if file == "" {
+			file = name
+		}
+		if _, ok := contents[file]; !ok {
+			_, content, err := config.readLayerContent(file)
+			if err != nil {
+				logFatal("[-] Error: unable to read config: %s", err)
+			}
+			contents[file] = string(content)
+		}
+		fmt.Printf("%s:%d: %#s\n", file, yamlLine(contents[file], path), issue.err)
+	}
+	if len(issues) == 0 && !(config.conf.Strict && len(config.unknownFields) > 0) {
+		err = config.build()
+		if err == nil {
+			err = config.genPac()
+		}
+		if err != nil {
+			logFatal("[-] Error: %s: %#s", name, err)
+		}
+		fmt.Printf("%s: config is valid\n", name)
+		os.Exit(0)
+	}
+	os.Exit(1)
+}
+
+// print the rule, pac result, proxies and authentication that would be used for an url, without connecting
+func resolveCommand(args []string) {
+	if len(args) != 1 {
+		println("invalid arguments")
+		usage()
+	}
+	logWriter(os.Stderr)
+	config, err := readConfig(defaultConfig())
+	if err != nil {
+		logFatal("[-] Error: %#s", err)
+	}
+	report, err := config.resolveReport(args[0])
+	if err != nil {
+		logFatal("[-] Error: %#s", err)
+	}
+	fmt.Print(report)
+	os.Exit(0)
+}
+
+// print the generated proxy.pac
+func pacCommand(args []string) {
+	if len(args) != 0 {
+		println("invalid arguments")
+		usage()
+	}
+	logWriter(os.Stderr)
+	config, err := readConfig(defaultConfig())
+	if err != nil {
+		logFatal("[-] Error: %#s", err)
+	}
+	fmt.Print(config.pac)
+	os.Exit(0)
+}
+
+// describe how an url is resolved by http rules: matched rule, pac result, and proxies in failover order
+func (c *Config) resolveReport(rawUrl string) (string, error) {
+	if !strings.Contains(rawUrl, "://") {
+		rawUrl = "https://" + rawUrl
+	}
+	u, err := url.Parse(rawUrl)
+	if err != nil || u.Hostname() == "" {
+		return "", stacktrace.NewError("invalid url '%s'", rawUrl)
+	}
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	hostPort := net.JoinHostPort(u.Hostname(), port)
+	// same url as used when processing requests: CONNECT only knows the host and port
+	matchUrl := rawUrl
+	if u.Scheme == "https" {
+		matchUrl = "https://" + strings.TrimSuffix(hostPort, ":443")
+	}
+	var sb strings.Builder
+	rule, proxies := c.matchHttp(matchUrl, hostPort)
+	if rule == nil {
+		sb.WriteString("rule:    none, request is rejected\n")
+		return sb.String(), nil
+	}
+	index := slices.Index(c.conf.Rules, rule)
+	fmt.Fprintf(&sb, "rule:    #%d host '%s' proxy '%s'\n", index, stringOrEmpty(rule.Host), stringOrEmpty(rule.Proxy))
+	if proxy := c.conf.Proxies[rule.firstProxy()]; proxy != nil && *proxy.Type == ProxyPac && proxy.pacRuntime != nil {
+		result, err := proxy.pacRuntime.Run(matchUrl, u.Hostname())
+		if err != nil {
+			result = fmt.Sprintf("error: %#s", err)
+		}
+		fmt.Fprintf(&sb, "pac:     %s => %s\n", *proxy.name, result)
+	}
+	for i, proxy := range proxies {
+		fmt.Fprintf(&sb, "proxy %d: %s\n", i+1, describeProxy(proxy))
+	}
+	return sb.String(), nil
+}
+
+// describe a proxy with its hosts, via chain and authentication scheme
+func describeProxy(proxy *ConfProxy) string {
+	desc := stringOrEmpty(proxy.name) + " (" + string(*proxy.Type) + ")"
+	if proxy.Host != nil && *proxy.Host != "" {
+		scheme := "http"
+		if proxy.Ssl {
+			scheme = "https"
+		}
+		desc += " " + scheme + "://"
+		// failover hosts are tried in order
+		for i, host := range strings.Split(*proxy.Host, ",") {
+			if i > 0 {
+				desc += ","
+			}
+			desc += net.JoinHostPort(strings.TrimSpace(host), strconv.Itoa(proxy.Port))
+		}
+	}
+	for via := proxy.via; via != nil; via = via.via {
+		desc += " via " + stringOrEmpty(via.name)
+	}
+	return desc + ", auth: " + describeAuth(proxy)
+}
+
+// describe the authentication scheme used with a proxy
+func describeAuth(proxy *ConfProxy) string {
+	cred := proxy.cred
+	credName := ""
+	if cred != nil {
+		credName = " with credential '" + stringOrEmpty(cred.name) + "'"
+	}
+	switch *proxy.Type {
+	case ProxyKerberos:
+		switch {
+		case cred != nil && cred.isPerUser:
+			return "kerberos per-user, from client Proxy-Authorization"
+		case cred != nil && cred.isNative:
+			return "kerberos native, from system tickets"
+		}
+		desc := "kerberos"
+		if proxy.Spn != nil {
+			desc += " spn '" + *proxy.Spn + "'"
+		}
+		if proxy.Realm != nil {
+			desc += " realm '" + *proxy.Realm + "'"
+		}
+		return desc + credName
+	case ProxyBasic:
+		if cred != nil && cred.isPerUser {
+			return "basic per-user, from client Proxy-Authorization"
+		}
+		return "basic" + credName
+	case ProxySocks:
+		if cred != nil && cred.isPerUser {
+			return "socks username/password per-user"
+		}
+		if cred != nil {
+			return "socks username/password" + credName
+		}
+	}
+	return "none"
+}
+
+func stringOrEmpty(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+// find the line of a yaml path in a block style yaml (or json) content, returning the line of the deepest key found, or 0.
+// keys are matched by indentation, and list items by counting their '- ' markers.
+func yamlLine(content string, path []string) int {
+	lines := strings.Split(content, "\n")
+	found, start, indent := 0, 0, -1
+	for _, key := range path {
+		index, err := strconv.Atoi(key)
+		isIndex := err == nil
+		next := -1
+		childIndent := -1
+		count := -1
+		for i := start; i < len(lines); i++ {
+			trimmed := strings.TrimLeft(lines[i], " \t")
+			if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+				continue
+			}
+			lineIndent := len(lines[i]) - len(trimmed)
+			// list items may be at the same indentation as their parent key
+			if lineIndent < indent || (lineIndent == indent && !(isIndex && strings.HasPrefix(trimmed, "-"))) {
+				break
+			}
+			if childIndent == -1 {
+				childIndent = lineIndent
+			}
+			if lineIndent != childIndent {
+				continue
+			}
+			if isIndex {
+				if strings.HasPrefix(trimmed, "-") {
+					count++
+					if count == index {
+						next = i
+						break
+					}
+				}
+				continue
+			}
+			name, _, ok := strings.Cut(trimmed, ":")
+			if ok && strings.Trim(strings.TrimSpace(name), `"'`) == key {
+				next = i
+				break
+			}
+		}
+		if next == -1 {
+			break
+		}
+		found = next + 1
+		start = next + 1
+		indent = childIndent
+		if isIndex {
+			// keys of a list item are indented after the '- ' marker
+			trimmed := strings.TrimLeft(lines[next], " \t")
+			start = next
+			indent = childIndent + 1
+			if rest := strings.TrimLeft(trimmed[1:], " "); rest != "" {
+				lines[next] = strings.Repeat(" ", len(lines[next])-len(rest)) + rest
+			}
+		}
+	}
+	return found
+}
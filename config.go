@@ -1,13 +1,15 @@
 package kpx
 
 import (
-	"encoding/json"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
+	"maps"
+	"net"
 	"net/http"
-	"os"
 	"regexp"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
@@ -18,7 +20,6 @@ import (
 	"github.com/howeyc/gopass"
 	"github.com/palantir/stacktrace"
 	"golang.org/x/text/encoding/charmap"
-	yaml2 "gopkg.in/yaml.v2"
 )
 
 type Config struct {
@@ -32,6 +33,9 @@ type Config struct {
 	hostsCacheMutex   sync.RWMutex
 	pacsCache         map[string]string
 	needFastReload    bool
+	files             []string      // config files, including included files
+	unknownFields     []ConfigIssue // unknown fields found in config files, errors in strict mode
+	includes          []string      // include globs, watched for new files
 }
 
 type HostCache struct {
@@ -39,25 +43,70 @@ type HostCache struct {
 	proxy []*ConfProxy
 }
 
-const EXPERIMENTAL_CONNETION_POOLS = "connection-pools"
 const EXPERIMENTAL_HOSTS_CACHE = "hosts-cache"
 
 const CREDENTIAL_KERBEROS = "kerberos"
 
-func NewConfig(name string) (*Config, error) {
-	var config = Config{
+// new config with default values
+func newConfig() *Config {
+	return &Config{
 		conf: Conf{
-			Proxies:        make(map[string]*ConfProxy),
-			Rules:          make([]*ConfRule, 0),
-			SocksRules:     make([]*ConfRule, 0),
-			ConnectTimeout: DEFAULT_CONNECT_TIMEOUT,
-			IdleTimeout:    DEFAULT_IDLE_TIMOUT,
-			CloseTimeout:   DEFAULT_CLOSE_TIMEOUT,
+			Proxies:            make(map[string]*ConfProxy),
+			Rules:              make([]*ConfRule, 0),
+			SocksRules:         make([]*ConfRule, 0),
+			ConnectTimeout:     DEFAULT_CONNECT_TIMEOUT,
+			IdleTimeout:        DEFAULT_IDLE_TIMOUT,
+			CloseTimeout:       DEFAULT_CLOSE_TIMEOUT,
+			DrainTimeout:       DEFAULT_DRAIN_TIMEOUT,
+			RemoteInterval:     DEFAULT_REMOTE_INTERVAL,
+			UdpTimeout:         DEFAULT_UDP_TIMEOUT,
+			CredentialFailures: DEFAULT_CREDENTIAL_FAILURES,
+			CredentialSuspend:  DEFAULT_CREDENTIAL_SUSPEND,
+			Pool: ConfPool{
+				MaxIdle:     DEFAULT_POOL_MAX_IDLE,
+				MaxTotal:    DEFAULT_POOL_MAX_TOTAL,
+				IdleTimeout: DEFAULT_POOL_IDLE_TIMEOUT,
+			},
+			KerberosCache: ConfKerberosCache{
+				MaxClients:       DEFAULT_KRB_MAX_CLIENTS,
+				IdleTimeout:      DEFAULT_KRB_IDLE_TIMEOUT,
+				FailureBackoff:   DEFAULT_KRB_FAILURE_BACKOFF,
+				MaxBackoff:       DEFAULT_KRB_MAX_BACKOFF,
+				LockoutThreshold: DEFAULT_KRB_LOCKOUT_THRESHOLD,
+				LockoutTime:      DEFAULT_KRB_LOCKOUT_TIME,
+			},
 		},
 		lastProxies: map[string]time.Time{},
 		hostsCache:  map[string]*HostCache{},
 		pacsCache:   map[string]string{},
 	}
+}
+
+func NewConfig(name string) (*Config, error) {
+	config, err := readConfig(name)
+	if err != nil {
+		return nil, err // no wrap
+	}
+	err = config.genCerts()
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "unable to load certificates")
+	}
+	return config, nil
+}
+
+// read, check and build config, without loading certificates
+func readConfig(name string) (*Config, error) {
+	config, err := buildConfig(name)
+	// only a valid config replaces the cached copy
+	if isRemoteConfig(name) && remoteConfig.done(err == nil) {
+		logInfo("[-] Downloaded configuration is invalid, using cached copy: %#s", err)
+		config, err = buildConfig(name)
+	}
+	return config, err
+}
+
+func buildConfig(name string) (*Config, error) {
+	config := newConfig()
 	var err error
 	if name == "" {
 		err = config.readFromConfig()
@@ -67,11 +116,16 @@ func NewConfig(name string) (*Config, error) {
 	config.conf.Trace = config.conf.Trace || options.Trace
 	config.conf.Debug = config.conf.Debug || options.Debug || config.conf.Trace
 	config.conf.Verbose = config.conf.Verbose || options.Verbose || config.conf.Debug
-	config.conf.experimentalConnectionPools = isExperimental(config.conf.Experimental, EXPERIMENTAL_CONNETION_POOLS)
 	config.conf.experimentalHostsCache = isExperimental(config.conf.Experimental, EXPERIMENTAL_HOSTS_CACHE)
 	if err != nil {
 		return nil, stacktrace.Propagate(err, "unable to read config")
 	}
+	for _, issue := range config.unknownFields {
+		if config.conf.Strict {
+			return nil, stacktrace.NewError("invalid config: %s", issue)
+		}
+		logInfo("[-] Warning: %s", issue)
+	}
 	err = config.check()
 	if err != nil {
 		return nil, stacktrace.Propagate(err, "invalid config")
@@ -84,11 +138,7 @@ func NewConfig(name string) (*Config, error) {
 	if err != nil {
 		return nil, stacktrace.Propagate(err, "unable to build config pac")
 	}
-	err = config.genCerts()
-	if err != nil {
-		return nil, stacktrace.Propagate(err, "unable to load certificates")
-	}
-	return &config, nil
+	return config, nil
 }
 
 func isExperimental(conf string, name string) bool {
@@ -148,19 +198,12 @@ func (c *Config) readFromConfig() error {
 }
 
 func (c *Config) readFromFile(filename string) error {
-	var yaml []byte
-	var err error
-	yaml, err = os.ReadFile(filename)
+	c.files = nil
+	c.includes = nil
+	c.unknownFields = nil
+	err := c.readLayer(filename, map[string]bool{})
 	if err != nil {
-		return stacktrace.Propagate(err, "unable to read file")
-	}
-	if strings.HasPrefix(strings.TrimSpace(string(yaml)), "{") {
-		err = json.Unmarshal(yaml, &c.conf)
-	} else {
-		err = yaml2.Unmarshal(yaml, &c.conf)
-	}
-	if err != nil {
-		return stacktrace.Propagate(err, "unable to read file as yaml/json")
+		return err // no wrap
 	}
 	if options.Listen != "" {
 		h, p := splitHostPort(options.Listen, "127.0.0.1", "0", true)
@@ -179,145 +222,405 @@ func (c *Config) readFromFile(filename string) error {
 	return nil
 }
 
-func (c *Config) check() (err error) {
+// ConfigIssue is an error found while checking the configuration, with the yaml path of the invalid entry,
+// or the file and line of an unknown field
+type ConfigIssue struct {
+	path []string
+	file string
+	line int
+	err  error
+}
+
+func (i ConfigIssue) String() string {
+	if i.file == "" {
+		return fmt.Sprintf("%#s", i.err)
+	}
+	return fmt.Sprintf("%s:%d: %#s", i.file, i.line, i.err)
+}
+
+func (c *Config) check() error {
+	issues := c.checkAll()
+	if len(issues) > 0 {
+		return issues[0].err
+	}
+	return nil
+}
+
+// check the whole configuration, returning all errors found.
+// via chains, rules and listeners are only checked once proxies are valid, as they depend on them.
+func (c *Config) checkAll() []ConfigIssue {
+	var issues []ConfigIssue
+	add := func(err error, path ...string) {
+		if err != nil {
+			issues = append(issues, ConfigIssue{path: path, err: err})
+		}
+	}
 	// check proxies
-	for name, proxy := range c.conf.Proxies {
-		if name == "" || name == ProxyDirect.Name() || name == ProxyNone.Name() || strings.HasPrefix(name, "$") {
-			return stacktrace.NewError("proxy '%s': name cannot be empty, 'direct', 'none' or start with a '$'", name)
+	for _, name := range slices.Sorted(maps.Keys(c.conf.Proxies)) {
+		add(c.checkProxy(name, c.conf.Proxies[name]), "proxies", name)
+	}
+	// check credentials
+	for _, name := range slices.Sorted(maps.Keys(c.conf.Credentials)) {
+		add(c.checkCredential(name, c.conf.Credentials[name]), "credentials", name)
+	}
+	if len(issues) > 0 {
+		return issues
+	}
+	// check via proxies, chains must not contain cycles
+	for _, name := range slices.Sorted(maps.Keys(c.conf.Proxies)) {
+		add(c.checkVia(name, c.conf.Proxies[name]), "proxies", name, "via")
+	}
+	if len(issues) > 0 {
+		return issues
+	}
+	// check http rules
+	for i, rule := range c.conf.Rules {
+		add(c.checkRule("rule", i, rule), "rules", strconv.Itoa(i))
+	}
+	// check rule sets, used by listeners
+	for _, name := range slices.Sorted(maps.Keys(c.conf.RuleSets)) {
+		if name == RULES_HTTP || name == RULES_SOCKS {
+			add(stacktrace.NewError("rule set '%s': name cannot be '%s' or '%s'", name, RULES_HTTP, RULES_SOCKS), "ruleSets", name)
+			continue
 		}
-		if proxy.Type == nil {
-			return stacktrace.NewError("proxy '%s': must contain 'type' (kerberos,socks,basic,anonymous,pac)", name)
+		for i, rule := range c.conf.RuleSets[name] {
+			add(c.checkRule(fmt.Sprintf("rule set '%s' rule", name), i, rule), "ruleSets", name, strconv.Itoa(i))
 		}
-		proxy.typeValue = proxy.Type.Value()
-		if proxy.typeValue == -1 {
-			return stacktrace.NewError("proxy '%s': must contain 'type' (kerberos,socks,basic,anonymous,pac)", name)
+	}
+	if c.conf.Pool.MaxIdle < 0 || c.conf.Pool.MaxTotal < 0 || c.conf.Pool.IdleTimeout <= 0 {
+		add(stacktrace.NewError("pool: maxIdle and maxTotal must be >= 0, idleTimeout must be > 0"), "pool")
+	}
+	if c.conf.RemoteInterval <= 0 {
+		add(stacktrace.NewError("remoteInterval: must be > 0"), "remoteInterval")
+	}
+	if c.conf.DrainTimeout < 0 {
+		add(stacktrace.NewError("drainTimeout: must be >= 0"), "drainTimeout")
+	}
+	if c.conf.UdpTimeout <= 0 {
+		add(stacktrace.NewError("udpTimeout: must be > 0"), "udpTimeout")
+	}
+	// check socks authentication
+	switch c.conf.SocksAuth {
+	case "", SOCKS_AUTH_NONE, SOCKS_AUTH_PER_USER:
+	default:
+		if c.conf.Credentials[c.conf.SocksAuth] == nil {
+			add(stacktrace.NewError("socksAuth: must be '%s', '%s' or a credential that exists in 'credentials'", SOCKS_AUTH_NONE, SOCKS_AUTH_PER_USER), "socksAuth")
 		}
-		if *proxy.Type != ProxyPac {
-			if proxy.Url != nil {
-				return stacktrace.NewError("proxy '%s': non-pac proxy must not contain 'url'", name)
-			}
-			if proxy.Host == nil {
-				return stacktrace.NewError("proxy '%s': non-pac proxy must contain 'host'", name)
-			}
-			if proxy.Port == 0 && *proxy.Host != "*" {
-				return stacktrace.NewError("proxy '%s': non-pac proxy port number must be > 0", name)
-			}
-			if proxy.Credentials != nil {
-				return stacktrace.NewError("proxy '%s': non-pac proxy must not contain 'credentials'", name)
-			}
-		} else {
-			if proxy.Url == nil {
-				return stacktrace.NewError("proxy '%s': pac proxy must contain 'url'", name)
-			}
-			if proxy.Host != nil {
-				return stacktrace.NewError("proxy '%s': pac proxy must not contain 'host'", name)
-			}
-			if proxy.Port != 0 {
-				return stacktrace.NewError("proxy '%s': pac proxy port number must be > 0", name)
-			}
+	}
+	// per-user username/password are only checked by upstream proxies with a per-user credential
+	if c.conf.SocksAuth == SOCKS_AUTH_PER_USER && c.conf.SocksPort != 0 && !c.onlyPerUserProxies(c.conf.SocksRules) {
+		add(stacktrace.NewError("socksAuth: '%s' requires all socks rules to use proxies with a per-user credential (empty value), or 'none'", SOCKS_AUTH_PER_USER), "socksAuth")
+	}
+	// check socks rules
+	for i, rule := range c.conf.SocksRules {
+		add(c.checkSocksRule(i, rule), "socksRules", strconv.Itoa(i))
+	}
+	// check listeners
+	addresses := map[string]bool{}
+	for i, listener := range c.conf.Listeners {
+		add(c.checkListener(i, listener, addresses), "listeners", strconv.Itoa(i))
+	}
+	return issues
+}
+
+func (c *Config) checkProxy(name string, proxy *ConfProxy) error {
+	if name == "" || name == ProxyDirect.Name() || name == ProxyNone.Name() || strings.HasPrefix(name, "$") {
+		return stacktrace.NewError("proxy '%s': name cannot be empty, 'direct', 'none' or start with a '$'", name)
+	}
+	if proxy.Type == nil {
+		return stacktrace.NewError("proxy '%s': must contain 'type' (kerberos,socks,basic,anonymous,pac)", name)
+	}
+	proxy.typeValue = proxy.Type.Value()
+	if proxy.typeValue == -1 {
+		return stacktrace.NewError("proxy '%s': must contain 'type' (kerberos,socks,basic,anonymous,pac)", name)
+	}
+	if *proxy.Type != ProxyPac {
+		if proxy.Url != nil {
+			return stacktrace.NewError("proxy '%s': non-pac proxy must not contain 'url'", name)
 		}
-		if *proxy.Type == ProxyAnonymous || *proxy.Type == ProxyPac {
-			if proxy.Credential != nil {
-				return stacktrace.NewError("proxy '%s': anonymous and pac proxies must not contain 'credential'", name)
-			}
+		if proxy.Host == nil {
+			return stacktrace.NewError("proxy '%s': non-pac proxy must contain 'host'", name)
 		}
-		if proxy.Credential != nil && *proxy.Credential != "" && *proxy.Credential != CREDENTIAL_KERBEROS && c.conf.Credentials[*proxy.Credential] == nil {
-			return stacktrace.NewError("proxy '%s': credential '%s' must exist in 'credentials'", name, *proxy.Credential)
+		if proxy.Port == 0 && *proxy.Host != "*" {
+			return stacktrace.NewError("proxy '%s': non-pac proxy port number must be > 0", name)
 		}
-		for _, cred := range c.splitCredentials(proxy.Credentials) {
-			if cred != CREDENTIAL_KERBEROS && c.conf.Credentials[cred] == nil {
-				return stacktrace.NewError("proxy '%s': credential '%s' must exist in 'credentials'", name, cred)
-			}
+		if proxy.Credentials != nil {
+			return stacktrace.NewError("proxy '%s': non-pac proxy must not contain 'credentials'", name)
+		}
+	} else {
+		if proxy.Url == nil {
+			return stacktrace.NewError("proxy '%s': pac proxy must contain 'url'", name)
+		}
+		if proxy.Host != nil {
+			return stacktrace.NewError("proxy '%s': pac proxy must not contain 'host'", name)
+		}
+		if proxy.Port != 0 {
+			return stacktrace.NewError("proxy '%s': pac proxy port number must be > 0", name)
 		}
 	}
-	// check credentials
-	for name, cred := range c.conf.Credentials {
-		if name == "" || name == CREDENTIAL_KERBEROS || strings.HasPrefix(name, "$") {
-			return stacktrace.NewError("credential '%s': name cannot be empty, 'kerberos' or start with '$'", name)
+	if proxy.Resolve != "" && proxy.Resolve != SOCKS_RESOLVE_LOCAL && proxy.Resolve != SOCKS_RESOLVE_REMOTE {
+		return stacktrace.NewError("proxy '%s': resolve must be '%s' or '%s'", name, SOCKS_RESOLVE_LOCAL, SOCKS_RESOLVE_REMOTE)
+	}
+	if proxy.SocksVersion != 0 && proxy.SocksVersion != SOCKS4_VERSION && proxy.SocksVersion != SOCKS5_VERSION {
+		return stacktrace.NewError("proxy '%s': socksVersion must be %d or %d", name, SOCKS4_VERSION, SOCKS5_VERSION)
+	}
+	if (proxy.Resolve != "" || proxy.SocksVersion != 0) && *proxy.Type != ProxySocks {
+		return stacktrace.NewError("proxy '%s': resolve and socksVersion are only allowed for socks proxies", name)
+	}
+	if *proxy.Type == ProxyAnonymous || *proxy.Type == ProxyPac {
+		if proxy.Credential != nil {
+			return stacktrace.NewError("proxy '%s': anonymous and pac proxies must not contain 'credential'", name)
 		}
-		if cred.Password != nil && cred.Login == nil {
-			return stacktrace.NewError("credential '%s': password cannot be set without login being set", name)
+	}
+	if proxy.Credential != nil && *proxy.Credential != "" && *proxy.Credential != CREDENTIAL_KERBEROS && c.conf.Credentials[*proxy.Credential] == nil {
+		return stacktrace.NewError("proxy '%s': credential '%s' must exist in 'credentials'", name, *proxy.Credential)
+	}
+	for _, cred := range c.splitCredentials(proxy.Credentials) {
+		if cred != CREDENTIAL_KERBEROS && c.conf.Credentials[cred] == nil {
+			return stacktrace.NewError("proxy '%s': credential '%s' must exist in 'credentials'", name, cred)
 		}
 	}
-	// check http rules
-	for i, rule := range c.conf.Rules {
-		if rule.Host == nil {
-			return stacktrace.NewError("rule %d: must contain 'host'", i)
+	return nil
+}
+
+func (c *Config) checkVia(name string, proxy *ConfProxy) error {
+	if proxy.Via == nil {
+		return nil
+	}
+	if *proxy.Type == ProxyPac {
+		return stacktrace.NewError("proxy '%s': pac proxy must not contain 'via'", name)
+	}
+	via := c.conf.Proxies[*proxy.Via]
+	if via == nil {
+		return stacktrace.NewError("proxy '%s': via '%s' must exist in 'proxies'", name, *proxy.Via)
+	}
+	if *via.Type == ProxyPac || *via.Host == "*" {
+		return stacktrace.NewError("proxy '%s': via '%s' must not be a pac proxy or have '*' host", name, *proxy.Via)
+	}
+	if via.Credential != nil && *via.Credential == "" {
+		return stacktrace.NewError("proxy '%s': via '%s' must not have a per-user credential (empty value)", name, *proxy.Via)
+	}
+	visited := map[string]bool{name: true}
+	for p := proxy; p != nil && p.Via != nil; p = c.conf.Proxies[*p.Via] {
+		if visited[*p.Via] {
+			return stacktrace.NewError("proxy '%s': via chain must not contain a cycle", name)
 		}
-		if rule.Proxy == nil && rule.Dns == nil {
-			return stacktrace.NewError("rule %d: must contain 'proxy' or 'dns'", i)
+		visited[*p.Via] = true
+	}
+	return nil
+}
+
+func (c *Config) checkCredential(name string, cred *ConfCred) error {
+	if name == "" || name == CREDENTIAL_KERBEROS || strings.HasPrefix(name, "$") {
+		return stacktrace.NewError("credential '%s': name cannot be empty, 'kerberos' or start with '$'", name)
+	}
+	sources := 0
+	for _, source := range []bool{cred.Password != nil, cred.PasswordEnv != "", cred.PasswordFile != "", cred.PasswordCommand != ""} {
+		if source {
+			sources++
 		}
-		if rule.Proxy != nil {
-			for _, p := range rule.allProxiesName() {
-				if p != ProxyDirect.Name() && p != ProxyNone.Name() && c.conf.Proxies[p] == nil {
-					return stacktrace.NewError("rule %d: '%s' must exist in 'proxies', or be 'direct' or 'none'", i, p)
-				}
+	}
+	if sources > 1 {
+		return stacktrace.NewError("credential '%s': only one of password, passwordEnv, passwordFile or passwordCommand can be set", name)
+	}
+	if sources > 0 && cred.Login == nil {
+		return stacktrace.NewError("credential '%s': password cannot be set without login being set", name)
+	}
+	return nil
+}
+
+func (c *Config) checkRule(label string, i int, rule *ConfRule) error {
+	if rule.Host == nil {
+		return stacktrace.NewError("%s %d: must contain 'host'", label, i)
+	}
+	if rule.Proxy == nil && rule.Dns == nil {
+		return stacktrace.NewError("%s %d: must contain 'proxy' or 'dns'", label, i)
+	}
+	if rule.Proxy != nil {
+		for _, p := range rule.allProxiesName() {
+			if p != ProxyDirect.Name() && p != ProxyNone.Name() && c.conf.Proxies[p] == nil {
+				return stacktrace.NewError("%s %d: '%s' must exist in 'proxies', or be 'direct' or 'none'", label, i, p)
 			}
 		}
-		if rule.Proxy != nil && rule.Dns != nil {
-			if *rule.Proxy == ProxyDirect.Name() {
-			} else if c.conf.Proxies[*rule.Proxy] != nil {
-				for _, p := range rule.allProxiesName() {
-					if *c.conf.Proxies[p].Type != ProxySocks {
-						return stacktrace.NewError("rule %d: rule with dns must have a 'direct' proxy or proxy of type 'socks'", i)
-					}
+	}
+	if rule.Proxy != nil && rule.Dns != nil {
+		if *rule.Proxy == ProxyDirect.Name() {
+		} else if c.conf.Proxies[*rule.Proxy] != nil {
+			for _, p := range rule.allProxiesName() {
+				if *c.conf.Proxies[p].Type != ProxySocks {
+					return stacktrace.NewError("%s %d: rule with dns must have a 'direct' proxy or proxy of type 'socks'", label, i)
 				}
 			}
 		}
-		if rule.Dns != nil {
-			hp := strings.Split(*rule.Dns, ":")
-			if len(hp) == 0 || len(hp) > 2 {
-				return stacktrace.NewError("rule %d: dns must be like '[IP][:PORT]', i.e 'IP' or 'IP:PORT' or ':PORT'", i)
-			}
+	}
+	if rule.Dns != nil {
+		hp := strings.Split(*rule.Dns, ":")
+		if len(hp) == 0 || len(hp) > 2 {
+			return stacktrace.NewError("%s %d: dns must be like '[IP][:PORT]', i.e 'IP' or 'IP:PORT' or ':PORT'", label, i)
 		}
 	}
+	return nil
+}
 
-	// check socks rules
-	for i, rule := range c.conf.SocksRules {
-		if rule.Host == nil {
-			return stacktrace.NewError("socks rule %d: must contain 'host'", i)
-		}
-		if rule.Proxy == nil && rule.Dns == nil {
-			return stacktrace.NewError("socks rule %d: must contain 'proxy' or 'dns'", i)
+func (c *Config) checkSocksRule(i int, rule *ConfRule) error {
+	if rule.Host == nil {
+		return stacktrace.NewError("socks rule %d: must contain 'host'", i)
+	}
+	if rule.Proxy == nil && rule.Dns == nil {
+		return stacktrace.NewError("socks rule %d: must contain 'proxy' or 'dns'", i)
+	}
+	if rule.Proxy != nil {
+		for _, p := range rule.allProxiesName() {
+			if p != ProxyDirect.Name() && p != ProxyNone.Name() && c.conf.Proxies[p] == nil {
+				return stacktrace.NewError("socks rule %d: '%s' must exist in 'proxies', or be 'direct' or 'none'", i, p)
+			}
 		}
-		if rule.Proxy != nil {
+	}
+	if rule.Proxy != nil {
+		if *rule.Proxy == ProxyDirect.Name() {
+		} else if c.conf.Proxies[*rule.Proxy] != nil {
 			for _, p := range rule.allProxiesName() {
-				if p != ProxyDirect.Name() && p != ProxyNone.Name() && c.conf.Proxies[p] == nil {
-					return stacktrace.NewError("socks rule %d: '%s' must exist in 'proxies', or be 'direct' or 'none'", i, p)
+				if c.conf.Proxies[p].Credential != nil && *c.conf.Proxies[p].Credential == "" && c.conf.SocksAuth != SOCKS_AUTH_PER_USER {
+					return stacktrace.NewError("socks rule %d: must not have a per-user credential (empty value), unless 'socksAuth' is '%s'", i, SOCKS_AUTH_PER_USER)
 				}
 			}
 		}
-		if rule.Proxy != nil {
-			if *rule.Proxy == ProxyDirect.Name() {
-			} else if c.conf.Proxies[*rule.Proxy] != nil {
-				for _, p := range rule.allProxiesName() {
-					if *c.conf.Proxies[p].Type != ProxySocks {
-						return stacktrace.NewError("socks rule %d: must have a 'direct' proxy or proxy of type 'socks'", i)
-					} else if c.conf.Proxies[p].Credential != nil && *c.conf.Proxies[p].Credential == "" {
-						return stacktrace.NewError("socks rule %d: must not have a per-user credential (empty value)", i)
-					}
+	}
+	if rule.Proxy != nil && rule.Dns != nil {
+		if *rule.Proxy == ProxyDirect.Name() {
+		} else if c.conf.Proxies[*rule.Proxy] != nil {
+			for _, p := range rule.allProxiesName() {
+				if *c.conf.Proxies[p].Type != ProxySocks {
+					return stacktrace.NewError("socks rule %d: rule with dns must have a 'direct' proxy or proxy of type 'socks'", i)
 				}
 			}
 		}
-		if rule.Proxy != nil && rule.Dns != nil {
-			if *rule.Proxy == ProxyDirect.Name() {
-			} else if c.conf.Proxies[*rule.Proxy] != nil {
-				for _, p := range rule.allProxiesName() {
-					if *c.conf.Proxies[p].Type != ProxySocks {
-						return stacktrace.NewError("socks rule %d: rule with dns must have a 'direct' proxy or proxy of type 'socks'", i)
-					}
-				}
-			}
+	}
+	if rule.Dns != nil {
+		hp := strings.Split(*rule.Dns, ":")
+		if len(hp) == 0 || len(hp) > 2 {
+			return stacktrace.NewError("socks rule %d: dns must be like '[IP][:PORT]', i.e 'IP' or 'IP:PORT' or ':PORT'", i)
+		}
+	}
+	return nil
+}
+
+func (c *Config) checkListener(i int, listener *ConfListener, addresses map[string]bool) error {
+	switch listener.Protocol {
+	case "", LISTENER_HTTP, LISTENER_SOCKS, LISTENER_TRANSPARENT, LISTENER_ADMIN:
+	default:
+		return stacktrace.NewError("listener %d: protocol must be '%s', '%s', '%s' or '%s'", i, LISTENER_HTTP, LISTENER_SOCKS, LISTENER_TRANSPARENT, LISTENER_ADMIN)
+	}
+	switch {
+	case listener.Unix != "" && (listener.Port != 0 || listener.Systemd != ""), listener.Systemd != "" && listener.Port != 0:
+		return stacktrace.NewError("listener %d: must contain only one of 'port', 'unix' or 'systemd'", i)
+	case listener.Unix == "" && listener.Systemd == "" && listener.Port <= 0:
+		return stacktrace.NewError("listener %d: port number must be > 0", i)
+	}
+	if listener.Unix == "" && (listener.Mode != "" || listener.Owner != "") {
+		return stacktrace.NewError("listener %d: 'mode' and 'owner' are only allowed for unix sockets", i)
+	}
+	if listener.Mode != "" {
+		if _, err := strconv.ParseUint(listener.Mode, 8, 32); err != nil {
+			return stacktrace.NewError("listener %d: mode must be an octal number like '0660'", i)
+		}
+	}
+	if (listener.Cert == "") != (listener.Key == "") {
+		return stacktrace.NewError("listener %d: 'cert' and 'key' must be both set", i)
+	}
+	if listener.Cert != "" && listener.Protocol != "" && listener.Protocol != LISTENER_HTTP && listener.Protocol != LISTENER_ADMIN {
+		return stacktrace.NewError("listener %d: 'cert' and 'key' are only allowed for http and admin listeners", i)
+	}
+	address := listener.address()
+	if addresses[address] {
+		return stacktrace.NewError("listener %d: address %s is already used by another listener", i, address)
+	}
+	addresses[address] = true
+	switch {
+	case listener.Rules == "" || listener.Rules == RULES_HTTP || listener.Rules == RULES_SOCKS:
+	case listener.Protocol == LISTENER_ADMIN:
+		return stacktrace.NewError("listener %d: admin listener must not contain 'rules'", i)
+	case c.conf.RuleSets[listener.Rules] == nil:
+		return stacktrace.NewError("listener %d: rules '%s' must be '%s', '%s' or exist in 'ruleSets'", i, listener.Rules, RULES_HTTP, RULES_SOCKS)
+	}
+	switch listener.Auth {
+	case "", SOCKS_AUTH_NONE:
+	case SOCKS_AUTH_PER_USER:
+		if listener.Protocol != LISTENER_SOCKS {
+			return stacktrace.NewError("listener %d: auth '%s' is only allowed for socks listeners", i, SOCKS_AUTH_PER_USER)
+		}
+	default:
+		if listener.Protocol == LISTENER_TRANSPARENT || listener.Protocol == LISTENER_ADMIN {
+			return stacktrace.NewError("listener %d: transparent and admin listeners must not contain 'auth'", i)
+		}
+		if c.conf.Credentials[listener.Auth] == nil {
+			return stacktrace.NewError("listener %d: auth must be '%s', '%s' or a credential that exists in 'credentials'", i, SOCKS_AUTH_NONE, SOCKS_AUTH_PER_USER)
+		}
+	}
+	// per-user username/password are only checked by upstream proxies with a per-user credential
+	perUser := listener.Auth == SOCKS_AUTH_PER_USER || listener.Auth == "" && c.conf.SocksAuth == SOCKS_AUTH_PER_USER
+	if listener.Protocol == LISTENER_SOCKS && perUser && !c.onlyPerUserProxies(c.listenerRules(listener)) {
+		return stacktrace.NewError("listener %d: auth '%s' requires all rules to use proxies with a per-user credential (empty value), or 'none'", i, SOCKS_AUTH_PER_USER)
+	}
+	// per-user proxies need the login/password of the client, from socks authentication or Proxy-Authorization header
+	if c.hasPerUserProxy(c.listenerRules(listener)) {
+		switch {
+		case listener.Protocol == LISTENER_SOCKS && listener.Auth == "" && c.conf.SocksAuth != SOCKS_AUTH_PER_USER:
+			return stacktrace.NewError("listener %d: rules must not have a per-user credential (empty value), unless 'socksAuth' is '%s'", i, SOCKS_AUTH_PER_USER)
+		case listener.Protocol == LISTENER_SOCKS && listener.Auth != "" && listener.Auth != SOCKS_AUTH_PER_USER:
+			return stacktrace.NewError("listener %d: rules must not have a per-user credential (empty value), unless 'auth' is '%s'", i, SOCKS_AUTH_PER_USER)
+		case listener.Protocol == LISTENER_TRANSPARENT:
+			return stacktrace.NewError("listener %d: rules of transparent listener must not have a per-user credential (empty value)", i)
+		case listener.Protocol != LISTENER_SOCKS && listener.Auth != "" && listener.Auth != SOCKS_AUTH_NONE:
+			return stacktrace.NewError("listener %d: rules must not have a per-user credential (empty value) when 'auth' is set", i)
 		}
-		if rule.Dns != nil {
-			hp := strings.Split(*rule.Dns, ":")
-			if len(hp) == 0 || len(hp) > 2 {
-				return stacktrace.NewError("socks rule %d: dns must be like '[IP][:PORT]', i.e 'IP' or 'IP:PORT' or ':PORT'", i)
+	}
+	return nil
+}
+
+// rules used by a listener, socks listeners use 'socksRules' by default and other listeners use 'rules'
+func (c *Config) listenerRules(listener *ConfListener) []*ConfRule {
+	switch {
+	case listener.Protocol == LISTENER_ADMIN:
+		return nil
+	case listener.Rules == RULES_SOCKS, listener.Rules == "" && listener.Protocol == LISTENER_SOCKS:
+		return c.conf.SocksRules
+	case listener.Rules == RULES_HTTP, listener.Rules == "":
+		return c.conf.Rules
+	}
+	return c.conf.RuleSets[listener.Rules]
+}
+
+// check if rules use a proxy with a per-user credential
+func (c *Config) hasPerUserProxy(rules []*ConfRule) bool {
+	for _, rule := range rules {
+		if rule.Proxy == nil {
+			continue
+		}
+		for _, p := range rule.allProxiesName() {
+			proxy := c.conf.Proxies[p]
+			if proxy != nil && proxy.Credential != nil && *proxy.Credential == "" {
+				return true
 			}
 		}
 	}
+	return false
+}
 
-	return nil
+// check if all rules use proxies with a per-user credential, or no proxy at all
+func (c *Config) onlyPerUserProxies(rules []*ConfRule) bool {
+	for _, rule := range rules {
+		if rule.Proxy == nil {
+			return false
+		}
+		for _, p := range rule.allProxiesName() {
+			proxy := c.conf.Proxies[p]
+			if p != ProxyNone.Name() && (proxy == nil || proxy.Credential == nil || *proxy.Credential != "") {
+				return false
+			}
+		}
+	}
+	return true
 }
 
 func (c *Config) build() error {
@@ -328,8 +631,51 @@ func (c *Config) build() error {
 	if c.conf.Bind == "" {
 		c.conf.Bind = "127.0.0.1"
 	}
-	// build server pac proxy string
-	c.conf.pacProxy = fmt.Sprint("PROXY ", c.conf.Bind, ":", c.conf.Port)
+	// build listeners, 'port' and 'socksPort' are listeners using global settings
+	c.conf.listeners = make([]*ConfListener, 0)
+	if c.conf.Port != 0 {
+		c.conf.listeners = append(c.conf.listeners, &ConfListener{Bind: c.conf.Bind, Port: c.conf.Port, Protocol: LISTENER_HTTP})
+	}
+	if c.conf.SocksPort != 0 {
+		c.conf.listeners = append(c.conf.listeners, &ConfListener{Bind: c.conf.Bind, Port: c.conf.SocksPort, Protocol: LISTENER_SOCKS, Auth: c.conf.SocksAuth})
+	}
+	c.conf.listeners = append(c.conf.listeners, c.conf.Listeners...)
+	for _, listener := range c.conf.listeners {
+		if listener.Bind == "" {
+			listener.Bind = c.conf.Bind
+		}
+		if listener.Protocol == "" {
+			listener.Protocol = LISTENER_HTTP
+		}
+		if listener.ACL == nil {
+			listener.ACL = c.conf.ACL
+		}
+		if listener.Protocol == LISTENER_SOCKS && listener.Auth == "" {
+			listener.Auth = c.conf.SocksAuth
+		}
+		listener.rules = c.listenerRules(listener)
+		if listener.Cert != "" {
+			certificate, err := tls.LoadX509KeyPair(listener.Cert, listener.Key)
+			if err != nil {
+				return stacktrace.Propagate(err, "unable to load certificate of listener %s", listener.address())
+			}
+			listener.tls = &tls.Config{Certificates: []tls.Certificate{certificate}, NextProtos: []string{"h2", "http/1.1"}}
+		}
+		if listener.Rules == "" && listener.Protocol == LISTENER_SOCKS {
+			listener.Rules = RULES_SOCKS
+		} else if listener.Rules == "" && listener.Protocol != LISTENER_ADMIN {
+			listener.Rules = RULES_HTTP
+		}
+	}
+	// build server pac proxy string, using the first http listener
+	pacHostPort := fmt.Sprint(c.conf.Bind, ":", c.conf.Port)
+	for _, listener := range c.conf.listeners {
+		if listener.Protocol == LISTENER_HTTP {
+			pacHostPort = listener.address()
+			break
+		}
+	}
+	c.conf.pacProxy = fmt.Sprint("PROXY ", pacHostPort)
 	// build rules
 	for _, rule := range c.conf.Rules {
 		regex, err := c.regex(*rule.Host)
@@ -345,6 +691,15 @@ func (c *Config) build() error {
 		}
 		rule.regex = regex
 	}
+	for name, rules := range c.conf.RuleSets {
+		for _, rule := range rules {
+			regex, err := c.regex(*rule.Host)
+			if err != nil {
+				return stacktrace.Propagate(err, "rule set '%s': unable to compile rule regex", name)
+			}
+			rule.regex = regex
+		}
+	}
 	// add none proxy
 	noneName := ProxyNone.Name()
 	noneType := ProxyNone
@@ -419,6 +774,11 @@ func (c *Config) build() error {
 			pacProxy := c.genProxy("PROXY", *proxy.Host, proxy.Port)
 			proxy.pacProxy = &pacProxy
 		}
+		if proxy.Via != nil {
+			proxy.via = c.conf.Proxies[*proxy.Via]
+			// proxy can't be reached directly by pac clients
+			proxy.pacProxy = nil
+		}
 		if proxy.Pac != nil {
 			regex, err := c.regex(*proxy.Pac)
 			if err != nil {
@@ -440,16 +800,16 @@ func (c *Config) build() error {
 	for name, cred := range c.conf.Credentials {
 		credName := name
 		cred.name = &credName
-		if cred.Password != nil && strings.HasPrefix(*cred.Password, ENCRYPTED) {
-			password, err := decrypt((*cred.Password)[len(ENCRYPTED):])
-			if err != nil {
-				return stacktrace.Propagate(err, "unable to decrypt '%s' password", name)
-			}
-			cred.Password = &password
+		password, err := cred.readPassword()
+		if err != nil {
+			return stacktrace.Propagate(err, "unable to read '%s' password", name)
 		}
+		cred.Password = password
+		cred.confLogin = cred.Login
+		cred.confPassword = cred.Password
 	}
 	// update rules and isUsed
-	for _, rule := range c.conf.Rules {
+	for _, rule := range c.allRuleSets() {
 		if rule.Dns != nil && rule.Proxy == nil {
 			rule.Proxy = &directName
 		} else {
@@ -462,19 +822,26 @@ func (c *Config) build() error {
 			}
 		}
 	}
-	for _, rule := range c.conf.SocksRules {
-		if rule.Dns != nil && rule.Proxy == nil {
-			rule.Proxy = &directName
-		} else {
-			for _, p := range rule.allProxiesName() {
-				proxy := c.conf.Proxies[p]
-				proxy.isUsed = true
-				if proxy.cred != nil && !proxy.cred.isPerUser {
-					proxy.cred.isUsed = true
+	// via proxies credentials must be initialized too
+	for _, proxy := range c.conf.Proxies {
+		if proxy.isUsed || proxy.Pac != nil {
+			for via := proxy.via; via != nil; via = via.via {
+				via.isUsed = true
+				if via.cred != nil {
+					via.cred.isUsed = true
 				}
 			}
 		}
 	}
+	// socks and listeners authentication credentials must be initialized too
+	if cred := c.conf.Credentials[c.conf.SocksAuth]; cred != nil {
+		cred.isUsed = true
+	}
+	for _, listener := range c.conf.listeners {
+		if cred := c.conf.Credentials[listener.Auth]; cred != nil {
+			cred.isUsed = true
+		}
+	}
 	// download proxy pac
 	for _, proxy := range c.conf.Proxies {
 		if proxy.isUsed && *proxy.Type == ProxyPac {
@@ -735,6 +1102,67 @@ func (c *Config) matchSocks(hostPort string) (*ConfRule, []*ConfProxy) {
 	return c.match(hostPort, hostPort, "socks:", &c.conf.SocksRules)
 }
 
+// match using the rules of a listener, or the default http/socks rules if none
+func (c *Config) matchListener(listener *ConfListener, url string, hostPort string, socks bool) (*ConfRule, []*ConfProxy) {
+	if listener == nil || listener.rules == nil {
+		if socks {
+			return c.matchSocks(hostPort)
+		}
+		return c.matchHttp(url, hostPort)
+	}
+	prefix := "http:"
+	if socks {
+		prefix = "socks:"
+	}
+	return c.match(url, hostPort, prefix+listener.Rules+":", &listener.rules)
+}
+
+// find a listener by its address
+func (c *Config) findListener(address string) *ConfListener {
+	for _, listener := range c.conf.listeners {
+		if listener.address() == address {
+			return listener
+		}
+	}
+	return nil
+}
+
+// address of the web server for login page and credentials, from the first admin or http listener
+func (c *Config) adminAddress() string {
+	var listeners []*ConfListener
+	if c.conf.Port != 0 {
+		listeners = append(listeners, &ConfListener{Bind: c.conf.Bind, Port: c.conf.Port})
+	}
+	for _, protocol := range []string{LISTENER_ADMIN, LISTENER_HTTP} {
+		for _, listener := range c.conf.Listeners {
+			if listener.Protocol == protocol || protocol == LISTENER_HTTP && listener.Protocol == "" {
+				listeners = append(listeners, listener)
+			}
+		}
+	}
+	if len(listeners) == 0 {
+		return ""
+	}
+	host := listeners[0].Bind
+	if host == "" {
+		host = c.conf.Bind
+	}
+	if host == "" || net.ParseIP(host) != nil && net.ParseIP(host).IsUnspecified() {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, strconv.Itoa(listeners[0].Port))
+}
+
+// all rules, from 'rules', 'socksRules' and 'ruleSets'
+func (c *Config) allRuleSets() []*ConfRule {
+	rules := append([]*ConfRule{}, c.conf.Rules...)
+	rules = append(rules, c.conf.SocksRules...)
+	for _, set := range c.conf.RuleSets {
+		rules = append(rules, set...)
+	}
+	return rules
+}
+
 func (c *Config) match(url string, hostPort string, prefix string, rules *[]*ConfRule) (*ConfRule, []*ConfProxy) {
 	if hc, ok := c.getCachedHost(prefix + hostPort); ok {
 		return hc.rule, hc.proxy
@@ -803,6 +1231,11 @@ func (c *Config) resolve(url, host string, rule *ConfRule) []*ConfProxy {
 		// if no more rules then this will be transformed into a DIRECT (see match)
 		return []*ConfProxy{&ConfProxyContinue}
 	case pacResult.isSocks, pacResult.isProxy:
+		// socks version is given by the pac result, unless configured in the proxy
+		socksVersion := 0
+		if pacResult.isSocks4 {
+			socksVersion = SOCKS4_VERSION
+		}
 		// lookup hostPort in existing proxies (host/port and pac), if found use it, otherwise create a new one
 		var pacProxies []*ConfProxy
 		for _, confProxy := range c.conf.pacProxies {
@@ -824,19 +1257,26 @@ func (c *Config) resolve(url, host string, rule *ConfRule) []*ConfProxy {
 			if found != nil {
 				if *found.Host == "*" {
 					name := *found.name + ">" + pacResult.hostPort
+					version := found.SocksVersion
+					if version == 0 {
+						version = socksVersion
+					}
 					// copy only necessary fields
 					found = &ConfProxy{
-						name:       &name,
-						Type:       found.Type,
-						typeValue:  found.typeValue,
-						Host:       &pacResult.hostOnly,
-						Port:       pacResult.portOnly,
-						Verbose:    found.Verbose,
-						Ssl:        found.Ssl,
-						Spn:        found.Spn,
-						Realm:      found.Realm,
-						Credential: found.Credential,
-						cred:       found.cred,
+						name:         &name,
+						Type:         found.Type,
+						typeValue:    found.typeValue,
+						Host:         &pacResult.hostOnly,
+						Port:         pacResult.portOnly,
+						Verbose:      found.Verbose,
+						Ssl:          found.Ssl,
+						Resolve:      found.Resolve,
+						SocksVersion: version,
+						via:          found.via,
+						Spn:          found.Spn,
+						Realm:        found.Realm,
+						Credential:   found.Credential,
+						cred:         found.cred,
 					}
 				}
 				pacProxies = append(pacProxies, found)
@@ -854,12 +1294,13 @@ func (c *Config) resolve(url, host string, rule *ConfRule) []*ConfProxy {
 		host, p := splitHostPort(pacResult.hostPort, "127.0.0.1", "8080", false)
 		port, _ := strconv.Atoi(p)
 		return []*ConfProxy{{
-			name:      &proxyName,
-			Type:      &proxyType,
-			typeValue: proxyType.Value(),
-			Host:      &host,
-			Port:      port,
-			Verbose:   rule.Verbose,
+			name:         &proxyName,
+			Type:         &proxyType,
+			typeValue:    proxyType.Value(),
+			Host:         &host,
+			Port:         port,
+			Verbose:      rule.Verbose,
+			SocksVersion: socksVersion,
 		}}
 	}
 	if pacResult.isDirect {
@@ -901,6 +1342,7 @@ func (c *Config) resolvePac(url, host string, proxy *ConfProxy) *PacResult {
 		isDirect: pType == "DIRECT",
 		isProxy:  pType == "PROXY" || pType == "HTTP" || pType == "HTTPS",
 		isSocks:  pType == "SOCKS" || pType == "SOCKS4" || pType == "SOCKS5",
+		isSocks4: pType == "SOCKS4",
 		hostPort: pHostPort,
 		hostOnly: pHostOnly,
 		portOnly: pPortOnly,
@@ -1028,62 +1470,128 @@ func (pt ProxyType) Value() int {
 }
 
 type Conf struct {
-	Bind                        string
-	Port                        int
-	SocksPort                   int `yaml:"socksPort"`
-	Verbose                     bool
-	Debug                       bool
-	Trace                       bool
-	Proxies                     map[string]*ConfProxy
-	Credentials                 map[string]*ConfCred
-	Domains                     map[string]*string
-	Rules                       []*ConfRule
-	SocksRules                  []*ConfRule `yaml:"socksRules"`
-	pacProxy                    string
-	Krb5                        string
-	ConnectTimeout              int `yaml:"connectTimeout"`
-	IdleTimeout                 int `yaml:"idleTimeout"`
-	CloseTimeout                int `yaml:"closeTimeout"`
-	Check                       *bool
-	Update                      bool
-	Restart                     bool
-	UseEnvProxy                 bool
-	Experimental                string       // space/comma separated list of features
-	experimentalConnectionPools bool         // add a connection pool for http
-	experimentalHostsCache      bool         // add a hosts cache for proxy lookup - fine grained url lookup is then disabled
-	ACL                         []string     `yaml:"acl"` // comma-separated list of allowed IPs or CIDRs. If empty everybody is allowed
-	pacProxies                  []*ConfProxy // list of proxy ordered by pacOrder, used for pac proxy
-	ConsoleUI                   bool         `yaml:"ui"` // enable console ui
+	Bind                   string
+	Port                   int
+	SocksPort              int `yaml:"socksPort"`
+	Verbose                bool
+	Debug                  bool
+	Trace                  bool
+	Include                []string // files or globs loaded before this file, relative to this file
+	Proxies                map[string]*ConfProxy
+	Credentials            map[string]*ConfCred
+	Domains                map[string]*string
+	Rules                  []*ConfRule
+	PrependRules           []*ConfRule `yaml:"prependRules"` // rules added before the rules of included files
+	AppendRules            []*ConfRule `yaml:"appendRules"`  // rules added after the rules of included files
+	SocksRules             []*ConfRule `yaml:"socksRules"`
+	SocksAuth              string      `yaml:"socksAuth"`  // none, per-user or a credential name
+	UdpTimeout             int         `yaml:"udpTimeout"` // idle timeout in seconds of socks udp associations
+	Listeners              []*ConfListener
+	listeners              []*ConfListener        // listeners from 'port', 'socksPort' and 'listeners'
+	RuleSets               map[string][]*ConfRule `yaml:"ruleSets"` // named lists of rules, used by listeners
+	pacProxy               string
+	Krb5                   string
+	ConnectTimeout         int `yaml:"connectTimeout"`
+	IdleTimeout            int `yaml:"idleTimeout"`
+	CloseTimeout           int `yaml:"closeTimeout"`
+	DrainTimeout           int `yaml:"drainTimeout"`   // seconds to wait for active connections on exit
+	RemoteInterval         int `yaml:"remoteInterval"` // seconds between polls of a remote config
+	Check                  *bool
+	Update                 bool
+	Restart                bool
+	UseEnvProxy            bool              `yaml:"useEnvProxy"`
+	Strict                 bool              // unknown fields are errors instead of warnings
+	StrictHttp             bool              `yaml:"strictHttp"` // reject ambiguous or malformed http messages with 400
+	Experimental           string            // space/comma separated list of features
+	experimentalHostsCache bool              // add a hosts cache for proxy lookup - fine grained url lookup is then disabled
+	ACL                    []string          `yaml:"acl"` // comma-separated list of allowed IPs or CIDRs. If empty everybody is allowed
+	pacProxies             []*ConfProxy      // list of proxy ordered by pacOrder, used for pac proxy
+	ConsoleUI              bool              `yaml:"ui"` // enable console ui
+	KerberosCache          ConfKerberosCache `yaml:"kerberosCache"`
+	Pool                   ConfPool          // upstream connection pool
+	CredentialFailures     int               `yaml:"credentialFailures"` // number of failures before suspending a credential
+	CredentialSuspend      int               `yaml:"credentialSuspend"`  // seconds a credential stays suspended
+	sources                map[string]string // file of each top-level key and map entry, like 'proxies.name', as read from includes
+	ruleSources            []ConfSource      // file and yaml path of each rule, as rules are merged from 'rules', 'prependRules' and 'appendRules'
+}
+
+// ConfSource is the file and yaml path in this file of a merged config entry
+type ConfSource struct {
+	file string
+	path []string
+}
+
+type ConfListener struct {
+	Name     string
+	Bind     string
+	Port     int
+	Unix     string   // path of a unix socket, instead of bind/port
+	Mode     string   // unix socket file mode, in octal
+	Owner    string   // unix socket owner, as user or user:group
+	Systemd  string   // name of a socket passed by systemd socket activation, or its index if it has no name
+	Protocol string   // http (default), socks, transparent or admin
+	ACL      []string `yaml:"acl"` // allowed IPs or CIDRs, global 'acl' if empty
+	Rules    string   // 'rules', 'socksRules' or a name in 'ruleSets', 'rules' by default or 'socksRules' for socks listeners
+	Auth     string   // inbound authentication: none, per-user (socks only) or a credential name
+	Cert     string   // certificate file in PEM format, to accept tls connections with http/2 negotiated by ALPN (http and admin only)
+	Key      string   // private key file of the certificate, in PEM format
+	rules    []*ConfRule
+	tls      *tls.Config
+}
+
+type ConfPool struct {
+	MaxIdle     int `yaml:"maxIdle"`     // max idle connections per upstream, 0 to disable pooling
+	MaxTotal    int `yaml:"maxTotal"`    // max connections per upstream, idle or in use, 0 for no limit
+	IdleTimeout int `yaml:"idleTimeout"` // seconds before closing an idle connection
+}
+
+type ConfKerberosCache struct {
+	MaxClients       int `yaml:"maxClients"`       // max number of cached kerberos clients, least recently used are evicted first
+	IdleTimeout      int `yaml:"idleTimeout"`      // seconds before evicting an unused kerberos client
+	FailureBackoff   int `yaml:"failureBackoff"`   // seconds before retrying a failed login with the same password, doubled on each failure
+	MaxBackoff       int `yaml:"maxBackoff"`       // max seconds before retrying a failed login with the same password
+	LockoutThreshold int `yaml:"lockoutThreshold"` // number of failed logins before locking a user, whatever the password
+	LockoutTime      int `yaml:"lockoutTime"`      // seconds a user stays locked
 }
 
 type ConfCred struct {
-	name      *string
-	Login     *string
-	Password  *string
-	isNull    bool
-	isPerUser bool
-	isUsed    bool // set if is not nil, not per user and is used by a a rule => proxy
-	isNative  bool // set if using native kerberos implementation
+	name            *string
+	Login           *string
+	Password        *string
+	PasswordEnv     string     `yaml:"passwordEnv"`     // read password from this environment variable
+	PasswordFile    string     `yaml:"passwordFile"`    // read password from this file
+	PasswordCommand string     `yaml:"passwordCommand"` // read password from the output of this command, run again on reload or when the proxy rejects it
+	confLogin       *string    // login as read from configuration file, to detect changes on reload
+	confPassword    *string    // password as read from configuration file, to detect changes on reload
+	mutex           sync.Mutex // protect login/password when updated at runtime
+	isNull          bool
+	isPerUser       bool
+	isUsed          bool // set if is not nil, not per user and is used by a a rule => proxy
+	isNative        bool // set if using native kerberos implementation
 }
 
 type ConfProxy struct {
-	name        *string
-	Type        *ProxyType
-	typeValue   int
-	Host        *string
-	Port        int
-	Verbose     *bool
-	Ssl         bool
-	Spn         *string
-	Realm       *string
-	Credential  *string
-	Credentials *string
-	cred        *ConfCred // cannot be nil for kerberos, basic, and eventually for socks
-	Pac         *string
-	PacOrder    int `yaml:"pacOrder"` // order of pac execution, higher means executed last, default value is 0
-	pacRegex    *ConfRegex
-	Url         *string
-	pacJs       *string
+	name         *string
+	Type         *ProxyType
+	typeValue    int
+	Host         *string
+	Port         int
+	Verbose      *bool
+	Ssl          bool
+	Resolve      string  // socks proxies only: remote (default) to let the proxy resolve hosts, or local
+	SocksVersion int     `yaml:"socksVersion"` // socks proxies only: 5 (default) or 4
+	Via          *string // name of the proxy used to reach this proxy
+	via          *ConfProxy
+	Spn          *string
+	Realm        *string
+	Credential   *string
+	Credentials  *string
+	cred         *ConfCred // cannot be nil for kerberos, basic, and eventually for socks
+	Pac          *string
+	PacOrder     int `yaml:"pacOrder"` // order of pac execution, higher means executed last, default value is 0
+	pacRegex     *ConfRegex
+	Url          *string
+	pacJs        *string
 	// proxy       string
 	pacProxy   *string
 	isUsed     bool
@@ -1100,6 +1608,24 @@ type ConfRule struct {
 	//confProxy *ConfProxy // cannot be nil
 }
 
+func (l *ConfListener) address() string {
+	switch {
+	case l.Unix != "":
+		return "unix:" + l.Unix
+	case l.Systemd != "":
+		return "systemd:" + l.Systemd
+	}
+	return net.JoinHostPort(l.Bind, strconv.Itoa(l.Port))
+}
+
+// socks protocol version of an upstream socks proxy
+func (p *ConfProxy) socksVersion() byte {
+	if p.SocksVersion == SOCKS4_VERSION {
+		return SOCKS4_VERSION
+	}
+	return SOCKS5_VERSION
+}
+
 func (r *ConfRule) firstProxy() string {
 	return strings.Split(*r.Proxy, ",")[0]
 }
@@ -1119,6 +1645,7 @@ type PacResult struct {
 	isDirect bool
 	isProxy  bool
 	isSocks  bool
+	isSocks4 bool
 	hostPort string
 	hostOnly string
 	portOnly int
@@ -1,6 +1,14 @@
 package kpx
 
-import "testing"
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
 
 func TestLoad(t *testing.T) {
 	var config *Config
@@ -19,3 +27,300 @@ func TestLoad(t *testing.T) {
 	println(config.conf.CloseTimeout)
 	println(config.pac)
 }
+
+func TestConfigCheckAll(t *testing.T) {
+	content := "proxies:\n" +
+		"  good:\n" +
+		"    type: anonymous\n" +
+		"    host: h\n" +
+		"    port: 1\n" +
+		"rules:\n" +
+		"- host: \"*.lan\"\n" +
+		"  proxy: direct\n" +
+		"# comment\n" +
+		"- host: \"*\"\n" +
+		"  proxy: unknown\n" +
+		"udpTimeout: -1\n" +
+		"listeners:\n" +
+		"  - port: 1\n" +
+		"    protocol: ftp\n"
+	file := filepath.Join(t.TempDir(), "kpx.yaml")
+	_ = os.WriteFile(file, []byte(content), 0600)
+	config := newConfig()
+	err := config.readFromFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// all errors are reported, with their line
+	var issues []string
+	for _, issue := range config.checkAll() {
+		issues = append(issues, strings.Join(issue.path, ".")+":"+strconv.Itoa(yamlLine(content, issue.path)))
+	}
+	expected := "rules.1:10,udpTimeout:12,listeners.0:14"
+	if strings.Join(issues, ",") != expected {
+		t.Fatalf("unexpected issues: %v", issues)
+	}
+	for _, test := range []struct {
+		path []string
+		line int
+	}{
+		{[]string{"proxies", "good"}, 2},
+		{[]string{"proxies", "good", "port"}, 5},
+		{[]string{"rules", "0"}, 7},
+		{[]string{"listeners", "0", "protocol"}, 15},
+		{[]string{"listeners", "1"}, 13},
+		{[]string{"unknown"}, 0},
+	} {
+		if line := yamlLine(content, test.path); line != test.line {
+			t.Fatalf("unexpected line %d for %v, expected %d", line, test.path, test.line)
+		}
+	}
+}
+
+func TestConfigCheckIncludes(t *testing.T) {
+	dir := t.TempDir()
+	base := "proxies:\n" +
+		"  good:\n" +
+		"    type: anonymous\n" +
+		"    host: h\n" +
+		"    port: 1\n" +
+		"  bad:\n" +
+		"    type: anonymous\n" +
+		"rules:\n" +
+		"- host: \"*.lan\"\n" +
+		"  proxy: unknown\n"
+	main := "include:\n" +
+		"- base.yaml\n" +
+		"prependRules:\n" +
+		"- host: \"*.corp\"\n" +
+		"  proxy: good\n" +
+		"- host: \"*.test\"\n" +
+		"  proxy: unknown\n" +
+		"appendRules:\n" +
+		"- host: \"*\"\n" +
+		"  proxy: unknown\n"
+	_ = os.WriteFile(filepath.Join(dir, "base.yaml"), []byte(base), 0600)
+	_ = os.WriteFile(filepath.Join(dir, "main.yaml"), []byte(main), 0600)
+	contents := map[string]string{filepath.Join(dir, "base.yaml"): base, filepath.Join(dir, "main.yaml"): main}
+	config := newConfig()
+	err := config.readFromFile(filepath.Join(dir, "main.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// issues are reported in the file defining the entry
+	check := func(expected string) {
+		var issues []string
+		for _, issue := range config.checkAll() {
+			file, path := config.conf.source(issue.path)
+			issues = append(issues, filepath.Base(file)+":"+strconv.Itoa(yamlLine(contents[file], path)))
+		}
+		if strings.Join(issues, ",") != expected {
+			t.Fatalf("unexpected issues: %v, expected %s", issues, expected)
+		}
+	}
+	check("base.yaml:6")
+	delete(config.conf.Proxies, "bad")
+	check("main.yaml:6,base.yaml:9,main.yaml:9")
+}
+
+func TestResolveReport(t *testing.T) {
+	content := "proxies:\n" +
+		"  jump:\n" +
+		"    type: anonymous\n" +
+		"    host: jump\n" +
+		"    port: 3128\n" +
+		"  corp:\n" +
+		"    type: basic\n" +
+		"    host: p1,p2\n" +
+		"    port: 8080\n" +
+		"    via: jump\n" +
+		"    credential: team\n" +
+		"credentials:\n" +
+		"  team:\n" +
+		"    login: alice\n" +
+		"    password: secret\n" +
+		"rules:\n" +
+		"  - host: \"*.lan\"\n" +
+		"    proxy: direct\n" +
+		"  - host: \"*\"\n" +
+		"    proxy: corp\n"
+	file := filepath.Join(t.TempDir(), "kpx.yaml")
+	_ = os.WriteFile(file, []byte(content), 0600)
+	config, err := readConfig(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := config.resolveReport("www.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "rule:    #1 host '*' proxy 'corp'\n" +
+		"proxy 1: corp (basic) http://p1:8080,p2:8080 via jump, auth: basic with credential 'team'\n"
+	if report != expected {
+		t.Fatalf("unexpected report:\n%s", report)
+	}
+	report, _ = config.resolveReport("http://server.lan/path")
+	if !strings.HasPrefix(report, "rule:    #0 host '*.lan' proxy 'direct'\nproxy 1: direct (direct), auth: none\n") {
+		t.Fatalf("unexpected report:\n%s", report)
+	}
+}
+
+func TestConfigInclude(t *testing.T) {
+	dir := t.TempDir()
+	_ = os.MkdirAll(filepath.Join(dir, "conf.d"), 0700)
+	_ = os.WriteFile(filepath.Join(dir, "base.yaml"), []byte("connectTimeout: 5\n"+
+		"proxies:\n  corp:\n    type: anonymous\n    host: corp\n    port: 8080\n"+
+		"domains:\n  EUR: EUR.EXAMPLE.COM\n"+
+		"rules:\n  - host: \"*\"\n    proxy: corp\n"), 0600)
+	_ = os.WriteFile(filepath.Join(dir, "conf.d", "lab.json"), []byte(`{"proxies": {"lab": {"type": "anonymous", "host": "lab", "port": 3128}}}`), 0600)
+	t.Setenv("KPX_TEST_HOST", "")
+	t.Setenv("KPX_TEST_PORT", "9999")
+	file := filepath.Join(dir, "kpx.yaml")
+	_ = os.WriteFile(file, []byte("include:\n  - base.yaml\n  - conf.d/*.json\n"+
+		"proxies:\n  corp:\n    type: anonymous\n    host: ${KPX_TEST_HOST:-override}\n    port: ${KPX_TEST_PORT}\n"+
+		"domains:\n  AMR: AMR.EXAMPLE.COM\n"+
+		"prependRules:\n  - host: \"*.lab\"\n    proxy: lab\n"+
+		"appendRules:\n  - host: \"$${literal}\"\n    proxy: direct\n"), 0600)
+	config := newConfig()
+	err := config.readFromFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := config.conf
+	// maps are merged by key, current file overriding included files
+	if len(conf.Proxies) != 2 || *conf.Proxies["corp"].Host != "override" || conf.Proxies["corp"].Port != 9999 || len(conf.Domains) != 2 {
+		t.Fatalf("unexpected proxies or domains: %v %v", conf.Proxies, conf.Domains)
+	}
+	if conf.ConnectTimeout != 5 || conf.CloseTimeout != DEFAULT_CLOSE_TIMEOUT {
+		t.Fatalf("unexpected timeouts: %d %d", conf.ConnectTimeout, conf.CloseTimeout)
+	}
+	var rules []string
+	for _, rule := range conf.Rules {
+		rules = append(rules, *rule.Host+"="+*rule.Proxy)
+	}
+	if strings.Join(rules, ",") != "*.lab=lab,*=corp,${literal}=direct" {
+		t.Fatalf("unexpected rules: %v", rules)
+	}
+	if len(config.files) != 3 || !config.isConfigFile(filepath.Join(dir, "conf.d", "new.json")) || config.isConfigFile(filepath.Join(dir, "other.yaml")) {
+		t.Fatalf("unexpected files: %v", config.files)
+	}
+	if paths := config.watchPaths(); len(paths) != 2 {
+		t.Fatalf("unexpected watch paths: %v", paths)
+	}
+	// missing files and recursive includes are errors
+	_ = os.WriteFile(file, []byte("include: [missing.yaml]\n"), 0600)
+	if err = newConfig().readFromFile(file); err == nil {
+		t.Fatal("expected error for missing include")
+	}
+	_ = os.WriteFile(file, []byte("include: [kpx.yaml]\n"), 0600)
+	if err = newConfig().readFromFile(file); err == nil || !strings.Contains(err.Error(), "recursively") {
+		t.Fatalf("expected error for recursive include, got %v", err)
+	}
+}
+
+func TestExpandEnv(t *testing.T) {
+	for _, test := range []struct {
+		value    string
+		content  string
+		expected string // login after expansion, or "" if rejected
+	}{
+		{"alice", "login: ${KPX_TEST_VALUE}\n", "alice"},
+		{"a#b: c", "login: ${KPX_TEST_VALUE} # comment\n", "a#b: c"},
+		{"a #b", "login: ${KPX_TEST_VALUE}\n", "a #b"},
+		{"*alias", "login: ${KPX_TEST_VALUE}\n", "*alias"},
+		{"a\npassword: injected", "login: ${KPX_TEST_VALUE}\n", "a\npassword: injected"},
+		{"a\"b\\", "login: \"${KPX_TEST_VALUE}\"\n", "a\"b\\"},
+		{"it's", "login: '${KPX_TEST_VALUE}'\n", "it's"},
+		{"b", "login: a-${KPX_TEST_VALUE}\n", "a-b"},
+		{"b #c", "login: a-${KPX_TEST_VALUE}\n", ""},
+		{"b", "login: a # ${KPX_TEST_VALUE}\n", "a"},
+	} {
+		t.Setenv("KPX_TEST_VALUE", test.value)
+		content, err := expandEnv("credentials:\n  team:\n    " + test.content)
+		if test.expected == "" {
+			if err == nil {
+				t.Fatalf("%q: expected error, got %q", test.value, content)
+			}
+			continue
+		}
+		var conf Conf
+		_, _, err = unmarshalConf(content, &conf)
+		if err != nil || conf.Credentials["team"] == nil || *conf.Credentials["team"].Login != test.expected || conf.Credentials["team"].Password != nil {
+			t.Fatalf("%q: unexpected content %q: %v", test.value, content, err)
+		}
+	}
+}
+
+func TestUnknownFields(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "kpx.yaml")
+	content := "connecttimeout: 5\nproxies:\n  p:\n    type: anonymous\n    host: h\n    port: 1\n    pacorder: 2\nuseEnvProxy: true\n"
+	_ = os.WriteFile(file, []byte(content), 0600)
+	config, err := readConfig(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var issues []string
+	for _, issue := range config.unknownFields {
+		issues = append(issues, issue.String())
+	}
+	expected := file + ":1: field connecttimeout not found in type kpx.Conf," + file + ":7: field pacorder not found in type kpx.ConfProxy"
+	if strings.Join(issues, ",") != expected || !config.conf.UseEnvProxy {
+		t.Fatalf("unexpected issues: %v", issues)
+	}
+	// unknown fields are errors in strict mode
+	_ = os.WriteFile(file, []byte("strict: true\n"+content), 0600)
+	_, err = readConfig(file)
+	if err == nil || !strings.Contains(err.Error(), ":2: field connecttimeout not found") {
+		t.Fatalf("expected unknown field error, got %v", err)
+	}
+	_ = os.WriteFile(file, []byte(`{"strict": true, "connectTimeout": 5, "pacOrder": 1}`), 0600)
+	_, err = readConfig(file)
+	if err == nil || !strings.Contains(err.Error(), `unknown field "pacOrder"`) {
+		t.Fatalf("expected unknown field error, got %v", err)
+	}
+}
+
+func TestConfSchema(t *testing.T) {
+	schema := confSchema()
+	properties := schema["properties"].(map[string]any)
+	for _, name := range []string{"connectTimeout", "useEnvProxy", "include", "prependRules", "kerberosCache", "acl"} {
+		if properties[name] == nil {
+			t.Fatalf("missing property %s", name)
+		}
+	}
+	if properties["proxies"].(map[string]any)["additionalProperties"].(map[string]any)["$ref"] != "#/$defs/ConfProxy" {
+		t.Fatalf("unexpected proxies: %v", properties["proxies"])
+	}
+	proxy := schema["$defs"].(map[string]any)["ConfProxy"].(map[string]any)
+	if proxy["additionalProperties"] != false || proxy["properties"].(map[string]any)["pacOrder"].(map[string]any)["type"] != "integer" {
+		t.Fatalf("unexpected proxy schema: %v", proxy)
+	}
+	if _, err := json.Marshal(schema); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestResolvePacSocksVersion(t *testing.T) {
+	config := newTestSocksProxyConfig(t, "proxies:\n  any:\n    type: socks\n    host: \"*\"\n    pac: proxy-*\n  v5:\n    type: socks\n    host: \"*\"\n    socksVersion: 5\n    pac: socks5-*\n").getConfig()
+	for _, test := range []struct {
+		result  string
+		name    string
+		version byte
+	}{
+		{"SOCKS4 proxy-a:1080", "any>proxy-a:1080", SOCKS4_VERSION},
+		{"SOCKS5 proxy-a:1080", "any>proxy-a:1080", SOCKS5_VERSION},
+		// socks version of the proxy is kept
+		{"SOCKS4 socks5-a:1080", "v5>socks5-a:1080", SOCKS5_VERSION},
+	} {
+		pac, err := NewPac(fmt.Sprintf(`function FindProxyForURL(url, host) { return "%s"; }`, test.result))
+		if err != nil {
+			t.Fatal(err)
+		}
+		name, proxyType := "pac", ProxyPac
+		config.conf.Proxies[name] = &ConfProxy{name: &name, Type: &proxyType, pacRuntime: pac}
+		proxies := config.resolve("http://www.example.com/", "www.example.com", &ConfRule{Proxy: &name})
+		if len(proxies) != 1 || *proxies[0].name != test.name || proxies[0].socksVersion() != test.version {
+			t.Fatalf("%s: unexpected proxies %v", test.result, proxies)
+		}
+	}
+}
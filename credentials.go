@@ -0,0 +1,406 @@
+package kpx
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"html"
+	"io"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/palantir/stacktrace"
+	"github.com/txthinking/socks5"
+)
+
+/*
+CredentialStore keeps the state of configured credentials, surviving configuration reloads:
+- healthy: credential can be used
+- suspended: too many failures, credential is not used until suspension ends, to prevent locking the account
+- awaiting password: password is invalid, credential is not used until a new password is provided
+*/
+type CredentialStore struct {
+	mutex       sync.Mutex
+	updateMutex sync.Mutex // prevent concurrent updates of login/password: password commands, local web server, reloads
+	status      map[string]*CredentialStatus
+	refreshes   map[string]*CredentialRefresh // password commands in progress, by credential name
+}
+
+// CredentialRefresh is a password command in progress, its result being shared with callers waiting for done
+type CredentialRefresh struct {
+	done    chan struct{}
+	changed bool
+}
+
+type CredentialState int
+
+const (
+	CredentialHealthy CredentialState = iota
+	CredentialSuspended
+	CredentialAwaitingPassword
+)
+
+func (cs CredentialState) String() string {
+	switch cs {
+	case CredentialHealthy:
+		return "healthy"
+	case CredentialSuspended:
+		return "suspended"
+	case CredentialAwaitingPassword:
+		return "awaiting password"
+	}
+	return "unknown"
+}
+
+type CredentialStatus struct {
+	state    CredentialState
+	failures int
+	until    time.Time // end of suspension
+	err      error     // last error
+}
+
+func NewCredentialStore() *CredentialStore {
+	return &CredentialStore{
+		status:    make(map[string]*CredentialStatus),
+		refreshes: make(map[string]*CredentialRefresh),
+	}
+}
+
+// get credential state, automatically ending suspension if expired
+func (cs *CredentialStore) safeGetState(name string) (CredentialState, CredentialStatus) {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	status := cs.status[name]
+	if status == nil {
+		return CredentialHealthy, CredentialStatus{}
+	}
+	if status.state == CredentialSuspended && time.Now().After(status.until) {
+		logInfo("[-] Credential '%s' is no longer suspended", name)
+		status.state = CredentialHealthy
+		status.failures = 0
+	}
+	return status.state, *status
+}
+
+// record a failure, suspending the credential after maxFailures, or immediately waiting for a new password if password is invalid
+func (cs *CredentialStore) safeFailed(name string, err error, maxFailures int, suspendTime int) {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	status := cs.status[name]
+	if status == nil {
+		status = &CredentialStatus{}
+		cs.status[name] = status
+	}
+	if status.state != CredentialHealthy {
+		return
+	}
+	status.failures++
+	status.err = err
+	switch {
+	case isInvalidPassword(err):
+		status.state = CredentialAwaitingPassword
+		logInfo("[-] Credential '%s' is waiting for a new password, as password is invalid", name)
+	case status.failures >= maxFailures:
+		status.state = CredentialSuspended
+		status.until = time.Now().Add(time.Duration(suspendTime) * time.Second)
+		logInfo("[-] Credential '%s' is suspended for %ds after %d failures", name, suspendTime, status.failures)
+	}
+}
+
+// record a success, resetting failures
+func (cs *CredentialStore) safeSucceeded(name string) {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	status := cs.status[name]
+	if status != nil && status.state == CredentialHealthy {
+		delete(cs.status, name)
+	}
+}
+
+// reset credential state, when a new password is provided
+func (cs *CredentialStore) safeReset(name string) {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	if status := cs.status[name]; status != nil && status.state != CredentialHealthy {
+		logInfo("[-] Credential '%s' is now healthy", name)
+	}
+	delete(cs.status, name)
+}
+
+// mark credential as waiting for a new password
+func (cs *CredentialStore) safeAwaitPassword(name string) {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	cs.status[name] = &CredentialStatus{state: CredentialAwaitingPassword}
+}
+
+func (cs *CredentialStore) metrics(w io.Writer) {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	names := make([]string, 0, len(cs.status))
+	for name := range cs.status {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		status := cs.status[name]
+		_, _ = fmt.Fprintf(w, "kpx_credential_state{name=%q,state=%q} 1\n", name, status.state)
+		_, _ = fmt.Fprintf(w, "kpx_credential_failures{name=%q} %d\n", name, status.failures)
+	}
+}
+
+// message explaining why the credential cannot be used
+func (cs CredentialStatus) message(name string) string {
+	switch cs.state {
+	case CredentialSuspended:
+		return fmt.Sprintf("Credential '%s' is suspended until %s after %d failures, to prevent locking the account.\nLast error: %v\n", name, cs.until.Format(time.DateTime), cs.failures, cs.err)
+	case CredentialAwaitingPassword:
+		if cs.err == nil {
+			return fmt.Sprintf("Credential '%s' is waiting for a password.\n", name)
+		}
+		return fmt.Sprintf("Credential '%s' is waiting for a new password, as password is invalid.\nLast error: %v\n", name, cs.err)
+	}
+	return ""
+}
+
+// kerberos errors meaning that retrying with the same password would lock the account
+func isInvalidPassword(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "KDC_ERR_PREAUTH_FAILED") || strings.Contains(msg, "KDC_ERR_CLIENT_REVOKED") || strings.Contains(msg, "KDC_ERR_C_PRINCIPAL_UNKNOWN")
+}
+
+// socks errors meaning that upstream proxy rejected the credential, from x/net/proxy or txthinking/socks5 clients
+func isSocksAuthFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "username/password authentication failed") || strings.Contains(msg, socks5.ErrUserPassAuth.Error())
+}
+
+// check if a credential can be used, returning a message if not
+func (p *Proxy) checkCredential(cred *ConfCred) (bool, string) {
+	if cred == nil || cred.isPerUser {
+		return true, ""
+	}
+	state, status := p.credentials.safeGetState(*cred.name)
+	if state == CredentialHealthy {
+		return true, ""
+	}
+	return false, status.message(*cred.name)
+}
+
+func (p *Proxy) credentialFailed(cred *ConfCred, err error) {
+	if cred == nil || cred.isPerUser {
+		return
+	}
+	conf := p.getConfig().conf
+	p.credentials.safeFailed(*cred.name, err, conf.CredentialFailures, conf.CredentialSuspend)
+}
+
+func (p *Proxy) credentialSucceeded(cred *ConfCred) {
+	if cred == nil || cred.isPerUser {
+		return
+	}
+	p.credentials.safeSucceeded(*cred.name)
+}
+
+// run password command again when the proxy rejects the password, returning true if password has changed.
+// command runs without lock, concurrent callers waiting for the same refresh.
+func (p *Proxy) refreshCredential(cred *ConfCred) bool {
+	if cred == nil || cred.PasswordCommand == "" {
+		return false
+	}
+	refresh, first := p.credentials.safeStartRefresh(*cred.name)
+	if !first {
+		<-refresh.done
+		return refresh.changed
+	}
+	defer p.credentials.safeEndRefresh(*cred.name, refresh)
+	_, current := cred.safeGet()
+	password, err := cred.readPassword()
+	if err != nil {
+		logError("[-] Unable to refresh credential '%s' password: %s", *cred.name, err)
+		return false
+	}
+	p.credentials.updateMutex.Lock()
+	defer p.credentials.updateMutex.Unlock()
+	// password may have been set while command was running, then it is kept
+	login, latest := cred.safeGet()
+	if !equalPtr(latest, current) {
+		refresh.changed = true
+		return true
+	}
+	if equalPtr(password, current) {
+		return false
+	}
+	cred.safeSet(login, password)
+	p.credentials.safeReset(*cred.name)
+	// force new connections to use the new password
+	p.loadCounter.Add(1)
+	logInfo("[-] Credential '%s' password refreshed from command", *cred.name)
+	refresh.changed = true
+	return true
+}
+
+// start a password refresh, returning the refresh in progress and false if there is one
+func (cs *CredentialStore) safeStartRefresh(name string) (*CredentialRefresh, bool) {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	if refresh := cs.refreshes[name]; refresh != nil {
+		return refresh, false
+	}
+	refresh := &CredentialRefresh{done: make(chan struct{})}
+	cs.refreshes[name] = refresh
+	return refresh, true
+}
+
+// end a password refresh, releasing waiting callers
+func (cs *CredentialStore) safeEndRefresh(name string, refresh *CredentialRefresh) {
+	cs.mutex.Lock()
+	delete(cs.refreshes, name)
+	cs.mutex.Unlock()
+	close(refresh.done)
+}
+
+// set a new login/password for a credential, validating it first against all kerberos proxies using it,
+// returning the names of other proxies using it, which only check it on their next request
+func (p *Proxy) setCredential(name string, login string, password string) ([]string, error) {
+	p.credentials.updateMutex.Lock()
+	defer p.credentials.updateMutex.Unlock()
+	config := p.getConfig()
+	cred := config.conf.Credentials[name]
+	if cred == nil || cred.isPerUser || cred.isNative {
+		return nil, stacktrace.NewError("credential '%s' does not exist", name)
+	}
+	if login == "" {
+		current, _ := cred.safeGet()
+		if current == nil {
+			return nil, stacktrace.NewError("credential '%s' requires a login", name)
+		}
+		login = *current
+	}
+	if password == "" {
+		return nil, stacktrace.NewError("credential '%s' requires a password", name)
+	}
+	// basic and socks proxies can only check it with a real request, which could count as a failure
+	var unchecked []string
+	for _, proxy := range config.conf.Proxies {
+		if proxy.cred != cred {
+			continue
+		}
+		if *proxy.Type != ProxyKerberos {
+			unchecked = append(unchecked, *proxy.name)
+			continue
+		}
+		_, err := p.kerberos.safeTryLogin(login, *proxy.Realm, password, true)
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "unable to login to kerberos")
+		}
+	}
+	sort.Strings(unchecked)
+	cred.safeSet(&login, &password)
+	p.credentials.safeReset(name)
+	// force new connections to use the new password
+	p.loadCounter.Add(1)
+	logInfo("[-] Credential '%s' updated", name)
+	return unchecked, nil
+}
+
+// proxies not validating a new password, which only fails on their next request
+func uncheckedMessage(unchecked []string) string {
+	if len(unchecked) == 0 {
+		return ""
+	}
+	return fmt.Sprintf(", not checked by proxies '%s' until their next request", strings.Join(unchecked, "', '"))
+}
+
+// get login and password, which are updated together at runtime
+func (cred *ConfCred) safeGet() (*string, *string) {
+	cred.mutex.Lock()
+	defer cred.mutex.Unlock()
+	return cred.Login, cred.Password
+}
+
+func (cred *ConfCred) safeSet(login *string, password *string) {
+	cred.mutex.Lock()
+	defer cred.mutex.Unlock()
+	cred.Login = login
+	cred.Password = password
+}
+
+func equalPtr(a, b *string) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// local web page listing used credentials, with a form to provide a new login/password
+func (p *Process) loginPage(channel *ProxyRequest) (string, error) {
+	message := ""
+	if strings.EqualFold(channel.header.method, "POST") {
+		body, err := channel.readBody(HEADER_MAX_SIZE)
+		if err != nil {
+			return "", err // no wrap
+		}
+		values, err := url.ParseQuery(string(body))
+		if err != nil {
+			return "", stacktrace.Propagate(err, "invalid form body")
+		}
+		// random token from the form, so other sites can't post it
+		if subtle.ConstantTimeCompare([]byte(values.Get("token")), []byte(p.proxy.loginToken)) != 1 {
+			return "", stacktrace.NewError("invalid login token")
+		}
+		name := values.Get("credential")
+		unchecked, err := p.proxy.setCredential(name, values.Get("login"), values.Get("password"))
+		if err != nil {
+			logError("[-] Unable to update credential: %#s", err)
+			message = fmt.Sprintf("Credential '%s' not updated: %#s", name, err)
+		} else {
+			message = fmt.Sprintf("Credential '%s' updated%s", name, uncheckedMessage(unchecked))
+		}
+	}
+	config := p.proxy.getConfig()
+	names := make([]string, 0, len(config.conf.Credentials))
+	for name, cred := range config.conf.Credentials {
+		if cred.isUsed && !cred.isPerUser && !cred.isNative {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	builder := strings.Builder{}
+	builder.WriteString("<!DOCTYPE html>\n<html><head><title>" + AppName + " credentials</title></head><body>\n")
+	builder.WriteString("<h1>" + AppName + " credentials</h1>\n")
+	if message != "" {
+		builder.WriteString("<p><b>" + html.EscapeString(message) + "</b></p>\n")
+	}
+	for _, name := range names {
+		cred := config.conf.Credentials[name]
+		login, _ := cred.safeGet()
+		state, _ := p.proxy.credentials.safeGetState(name)
+		label := fmt.Sprintf("Credential %s", name)
+		if cred.isNull {
+			label = fmt.Sprintf("Proxy %s", strings.SplitN(name, "-", 2)[1])
+		}
+		loginValue := ""
+		if login != nil {
+			loginValue = *login
+		}
+		_, _ = fmt.Fprintf(&builder, `<form method="post" action="/login"><fieldset><legend>%s (%s)</legend>
+<input type="hidden" name="credential" value="%s">
+<input type="hidden" name="token" value="%s">
+<label>Login <input type="text" name="login" value="%s"></label>
+<label>Password <input type="password" name="password"></label>
+<input type="submit" value="Update">
+</fieldset></form>
+`, html.EscapeString(label), state, html.EscapeString(name), p.proxy.loginToken, html.EscapeString(loginValue))
+	}
+	builder.WriteString("</body></html>\n")
+	return builder.String(), nil
+}
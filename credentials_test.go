@@ -0,0 +1,188 @@
+package kpx
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCredentialStoreSuspend(t *testing.T) {
+	cs := NewCredentialStore()
+	for i := 0; i < 2; i++ {
+		cs.safeFailed("user", errors.New("proxy returned 407"), 3, 60)
+		if state, _ := cs.safeGetState("user"); state != CredentialHealthy {
+			t.Fatalf("expected healthy after %d failures, got %s", i+1, state)
+		}
+	}
+	cs.safeFailed("user", errors.New("proxy returned 407"), 3, 60)
+	state, status := cs.safeGetState("user")
+	if state != CredentialSuspended {
+		t.Fatalf("expected suspended, got %s", state)
+	}
+	if status.message("user") == "" {
+		t.Fatalf("expected a message for suspended credential")
+	}
+	// suspension ends automatically
+	cs.safeFailed("other", errors.New("proxy returned 407"), 1, 0)
+	if state, _ := cs.safeGetState("other"); state != CredentialHealthy {
+		t.Fatalf("expected healthy after suspension, got %s", state)
+	}
+	// a new password resets state
+	cs.safeReset("user")
+	if state, _ := cs.safeGetState("user"); state != CredentialHealthy {
+		t.Fatalf("expected healthy after reset, got %s", state)
+	}
+}
+
+func TestCredentialStoreInvalidPassword(t *testing.T) {
+	cs := NewCredentialStore()
+	cs.safeFailed("user", errors.New("KRB Error: (24) KDC_ERR_PREAUTH_FAILED Pre-authentication information was invalid"), 3, 60)
+	if state, _ := cs.safeGetState("user"); state != CredentialAwaitingPassword {
+		t.Fatalf("expected awaiting password, got %s", state)
+	}
+	// success does not reset a credential waiting for a new password
+	cs.safeSucceeded("user")
+	if state, _ := cs.safeGetState("user"); state != CredentialAwaitingPassword {
+		t.Fatalf("expected awaiting password, got %s", state)
+	}
+}
+
+func TestLoginPage(t *testing.T) {
+	proxy := newTestSocksProxyConfig(t, "proxies:\n  up:\n    type: basic\n    host: 127.0.0.1\n    port: 1\n    credential: team\n"+
+		"credentials:\n  team:\n    login: alice\n    password: secret\n"+
+		"rules:\n  - host: \"*\"\n    proxy: up\n")
+	p := NewProcess(proxy, nil)
+	for _, test := range []struct {
+		token string
+		valid bool
+	}{
+		{"", false},
+		{"bad", false},
+		{proxy.loginToken, true},
+	} {
+		body := "credential=team&password=new&token=" + test.token
+		r := newTestRequest(fmt.Sprintf("POST /login HTTP/1.1\r\nHost: h\r\nContent-Length: %d\r\n\r\n%s", len(body), body), false)
+		if err := r.readRequestHeaders(); err != nil {
+			t.Fatal(err)
+		}
+		content, err := p.loginPage(r)
+		if (err == nil) != test.valid {
+			t.Fatalf("token %q: unexpected error %v", test.token, err)
+		}
+		if test.valid && !strings.Contains(content, "updated, not checked by proxies &#39;up&#39;") || !test.valid && content != "" {
+			t.Fatalf("token %q: unexpected content %q", test.token, content)
+		}
+	}
+	// form contains the token
+	r := newTestRequest("GET /login HTTP/1.1\r\nHost: h\r\n\r\n", false)
+	if err := r.readRequestHeaders(); err != nil {
+		t.Fatal(err)
+	}
+	content, err := p.loginPage(r)
+	if err != nil || !strings.Contains(content, `name="token" value="`+proxy.loginToken) {
+		t.Fatalf("expected token in form: %v", err)
+	}
+}
+
+func TestSameOrigin(t *testing.T) {
+	local := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8888}
+	for _, test := range []struct {
+		origin string
+		valid  bool
+	}{
+		{"http://localhost:8888", true},
+		{"http://127.0.0.1:8888", true},
+		{"http://127.0.0.1:8080", false},
+		{"http://evil.example.com:8888", false},
+		{"http://127.0.0.1", false},
+		{"null", false},
+	} {
+		if isSameOrigin(&test.origin, local) != test.valid {
+			t.Fatalf("origin %q: expected %v", test.origin, test.valid)
+		}
+	}
+	if !isSameOrigin(nil, local) {
+		t.Fatalf("expected no origin to be allowed")
+	}
+}
+
+func TestPostCredential(t *testing.T) {
+	proxy := newTestSocksProxyConfig(t, "credentials:\n  team:\n    login: alice\n    password: secret\n")
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = ln.Close() }()
+	for _, test := range []struct {
+		headers string
+		status  string
+	}{
+		{"", "403"},
+		{CREDENTIALS_HEADER + ": 1\r\nOrigin: http://evil.example.com\r\n", "403"},
+		{CREDENTIALS_HEADER + ": 1\r\n", "200"},
+	} {
+		client, err := net.Dial("tcp4", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		server, err := ln.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		body := "password=new"
+		request := fmt.Sprintf("POST /credentials/team HTTP/1.1\r\nHost: h\r\n%sContent-Length: %d\r\n\r\n%s", test.headers, len(body), body)
+		r := &ProxyRequest{conn: NewTimedConn(NewBufferedConn(server, []byte(request)), nil)}
+		if err := r.readRequestHeaders(); err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			_ = NewProcess(proxy, server).webServer(r)
+			_ = server.Close()
+		}()
+		response, _ := io.ReadAll(client)
+		if !strings.HasPrefix(string(response), "HTTP/1.0 "+test.status) && !strings.HasPrefix(string(response), "HTTP/1.1 "+test.status) {
+			t.Fatalf("headers %q: unexpected response %q", test.headers, response)
+		}
+		_ = client.Close()
+	}
+}
+
+func TestRefreshCredential(t *testing.T) {
+	runs := filepath.Join(t.TempDir(), "runs")
+	proxy := newTestSocksProxyConfig(t, fmt.Sprintf("credentials:\n  user:\n    login: alice\n    passwordCommand: echo run >> %s; sleep 0.2; wc -l < %s\n", runs, runs))
+	cred := proxy.getConfig().conf.Credentials["user"]
+	if _, password := cred.safeGet(); password == nil || *password != "1" {
+		t.Fatalf("unexpected password %v", password)
+	}
+	// concurrent callers share one command, which runs without blocking updates
+	var wait sync.WaitGroup
+	changed := make(chan bool, 4)
+	for i := 0; i < 4; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			changed <- proxy.refreshCredential(cred)
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	if !proxy.credentials.updateMutex.TryLock() {
+		t.Fatalf("updates are blocked while password command runs")
+	}
+	proxy.credentials.updateMutex.Unlock()
+	wait.Wait()
+	close(changed)
+	for ok := range changed {
+		if !ok {
+			t.Fatalf("expected password to be changed for all callers")
+		}
+	}
+	if _, password := cred.safeGet(); password == nil || *password != "2" {
+		t.Fatalf("unexpected password %v, command must run once", password)
+	}
+}
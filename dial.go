@@ -0,0 +1,160 @@
+package kpx
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/palantir/stacktrace"
+	netproxy "golang.org/x/net/proxy"
+)
+
+/*
+Proxies can be chained with 'via', the connection to a proxy being a tunnel opened through its 'via' proxy:
+- http proxies (kerberos, basic, anonymous) open the tunnel with a CONNECT request, using their credential
+- socks proxies open the tunnel with a socks CONNECT request, using their credential
+- chains can be of any length, as each 'via' proxy can have its own 'via'
+*/
+
+// dial a proxy host, through its 'via' proxies if any, and wrap the connection in tls if required
+func (p *Process) dialProxy(dialer *net.Dialer, proxy *ConfProxy, hostPort string) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	if proxy.via == nil {
+		conn, err = dialer.Dial("tcp4", hostPort)
+	} else {
+		conn, err = p.dialVia(dialer, proxy.via, hostPort)
+	}
+	if err != nil {
+		return nil, err // no wrap
+	}
+	if !proxy.Ssl {
+		return conn, nil
+	}
+	host, _, _ := net.SplitHostPort(hostPort)
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: host})
+	_ = tlsConn.SetDeadline(time.Now().Add(dialer.Timeout))
+	err = tlsConn.Handshake()
+	if err != nil {
+		_ = conn.Close()
+		return nil, err // no wrap
+	}
+	_ = tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+// open a tunnel to hostPort through a 'via' proxy, trying each of its hosts in order
+func (p *Process) dialVia(dialer *net.Dialer, via *ConfProxy, hostPort string) (net.Conn, error) {
+	var authorizationFunc func() (*string, error)
+	if via.cred != nil {
+		// fail fast if credential is suspended or waiting for a new password
+		if ok, message := p.proxy.checkCredential(via.cred); !ok {
+			return nil, stacktrace.NewError("via proxy '%s': %s", *via.name, strings.SplitN(message, "\n", 2)[0])
+		}
+		var authenticated bool
+		authenticated, _, authorizationFunc = p.computeAuthPerConf(via)
+		if !authenticated {
+			return nil, stacktrace.NewError("via proxy '%s': no credentials available", *via.name)
+		}
+	}
+	var err error
+	for _, host := range strings.Split(*via.Host, ",") {
+		viaHostPort := net.JoinHostPort(host, strconv.Itoa(via.Port))
+		// get authorization, a new one is needed for each connection with kerberos
+		var authorization *string
+		if authorizationFunc != nil {
+			authorization, err = authorizationFunc()
+			if err != nil {
+				p.proxy.credentialFailed(via.cred, err)
+				return nil, stacktrace.Propagate(err, "via proxy '%s': authentication failed", *via.name)
+			}
+		}
+		var conn net.Conn
+		var status int
+		if *via.Type == ProxySocks {
+			conn, err = p.dialSocks(dialer, via, viaHostPort, socksAuth(authorization), hostPort)
+		} else {
+			conn, status, err = p.dialConnect(dialer, via, viaHostPort, hostPort, authorization)
+		}
+		if err == nil {
+			if via.cred != nil {
+				p.proxy.credentialSucceeded(via.cred)
+			}
+			return conn, nil
+		}
+		if via.cred != nil && (status == 407 || isSocksAuthFailure(err)) {
+			// don't try other hosts, to prevent locking user account
+			// password may have been changed, so the next request will use the new one
+			if status != 407 || !p.proxy.refreshCredential(via.cred) {
+				p.proxy.credentialFailed(via.cred, err)
+			}
+			// don't propagate the error, so it is not taken for a failure of the next proxy credential
+			return nil, stacktrace.NewError("via proxy '%s': credential rejected", *via.name)
+		}
+	}
+	return nil, stacktrace.Propagate(err, "via proxy '%s'", *via.name)
+}
+
+// socks username/password from a "login:password" authorization
+func socksAuth(authorization *string) *netproxy.Auth {
+	if authorization == nil || *authorization == "" {
+		return nil
+	}
+	userDetails := strings.SplitN(*authorization, ":", 2)
+	if len(userDetails) != 2 {
+		return nil
+	}
+	return &netproxy.Auth{
+		User:     userDetails[0],
+		Password: userDetails[1],
+	}
+}
+
+// tunnel to hostPort through an http proxy with a CONNECT request, returning the http status if a response was received
+func (p *Process) dialConnect(dialer *net.Dialer, proxy *ConfProxy, proxyHostPort string, hostPort string, auth *string) (net.Conn, int, error) {
+	conn, err := p.dialProxy(dialer, proxy, proxyHostPort)
+	if err != nil {
+		return nil, 0, err // no wrap
+	}
+	proxyChannel := &ProxyRequest{
+		conn: NewTimedConn(conn, newTraceInfo(p.reqId, "proxy")),
+	}
+	if debug {
+		proxyChannel.prefix = fmt.Sprintf("[%s] P>", *proxy.name)
+	}
+	err = proxyChannel.writeRequestLine("CONNECT", hostPort, Http11)
+	if err == nil {
+		err = proxyChannel.writeHeader("Host", hostPort)
+	}
+	if err == nil && auth != nil && *auth != "" {
+		err = proxyChannel.writeHeader("Proxy-Authorization", *auth)
+	}
+	if err == nil {
+		err = proxyChannel.closeHeader()
+	}
+	if err == nil {
+		if debug {
+			proxyChannel.prefix = fmt.Sprintf("[%s] P<", *proxy.name)
+		}
+		proxyChannel.conn.setTimeout(p.config.conf.ConnectTimeout)
+		err = proxyChannel.readResponseHeaders()
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, 0, err // no wrap
+	}
+	status := proxyChannel.header.status
+	if status != 200 {
+		_ = conn.Close()
+		return nil, status, stacktrace.NewError("proxy returned %d %s", status, proxyChannel.header.reason)
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+	// data received after response headers belongs to the tunnel
+	if len(proxyChannel.header.data) > 0 {
+		return NewBufferedConn(conn, proxyChannel.header.data), status, nil
+	}
+	return conn, status, nil
+}
@@ -0,0 +1,78 @@
+package kpx
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/txthinking/socks5"
+)
+
+// tunnel of a test http proxy, connected to the target of the CONNECT request
+func tunnelToTarget(conn net.Conn, request *http.Request) {
+	target, err := net.Dial("tcp4", request.Host)
+	if err != nil {
+		_, _ = conn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\n\r\n"))
+		return
+	}
+	defer func() { _ = target.Close() }()
+	_, _ = conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+	go func() { _, _ = io.Copy(target, conn) }()
+	_, _ = io.Copy(conn, target)
+}
+
+func TestViaChain(t *testing.T) {
+	port := newTestEchoServer(t)
+	httpPort := newTestHttpConnectProxy(t, tunnelToTarget)
+	// partner socks proxy is kpx itself, with a dns override to localhost
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go newTestSocksProxy(t).serve(ln, &ConfListener{Protocol: LISTENER_SOCKS})
+	socksPort := ln.Addr().(*net.TCPAddr).Port
+	// socks client => partner (socks) via corp (basic)
+	config := fmt.Sprintf("proxies:\n"+
+		"  corp:\n    type: basic\n    host: 127.0.0.1\n    port: %d\n    credential: user\n"+
+		"  partner:\n    type: socks\n    host: 127.0.0.1\n    port: %d\n    via: corp\n"+
+		"credentials:\n  user:\n    login: alice\n    password: secret\n"+
+		"socksRules:\n  - host: \"*\"\n    proxy: partner\n", httpPort, socksPort)
+	server, client := net.Pipe()
+	defer func() { _ = client.Close() }()
+	go NewProcess(newTestSocksProxyConfig(t, config), server).processSocksConn()
+	_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+	socksClientNegotiate(t, client, []byte{socks5.MethodNone}, "", "")
+	_, err = socks5.NewRequest(socks5.CmdConnect, socks5.ATYPDomain, []byte("echo.example.com"), []byte{byte(port >> 8), byte(port)}).WriteTo(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, err := socks5.NewReplyFrom(client)
+	if err != nil || reply.Rep != socks5.RepSuccess {
+		t.Fatalf("unexpected reply: %v %v", reply, err)
+	}
+	expectEcho(t, client)
+}
+
+func TestViaCycle(t *testing.T) {
+	for _, test := range []struct {
+		config string
+		error  string
+	}{
+		{"proxies:\n  a:\n    type: anonymous\n    host: h\n    port: 1\n    via: b\n  b:\n    type: anonymous\n    host: h\n    port: 1\n    via: a\n", "cycle"},
+		{"proxies:\n  a:\n    type: anonymous\n    host: h\n    port: 1\n    via: a\n", "cycle"},
+		{"proxies:\n  a:\n    type: anonymous\n    host: h\n    port: 1\n    via: b\n", "must exist"},
+	} {
+		file := filepath.Join(t.TempDir(), "kpx.yaml")
+		_ = os.WriteFile(file, []byte(test.config), 0600)
+		_, err := NewConfig(file)
+		if err == nil || !strings.Contains(err.Error(), test.error) {
+			t.Fatalf("expected error %q, got %v", test.error, err)
+		}
+	}
+}
@@ -35,20 +35,107 @@ const DEFAULT_IDLE_TIMOUT = 0
 // timeout in seconds for closing infinite pipes once one peer has closed it's connection
 const DEFAULT_CLOSE_TIMEOUT = 10
 
-// timeout in seconds for a connection to stay in pool before closing
-const POOL_CLOSE_TIMEOUT = 30
-const POOL_CLOSE_TIMEOUT_ADD = 5
+// timeout in seconds for active connections to finish on exit, and interval in milliseconds between checks
+const DEFAULT_DRAIN_TIMEOUT = 30
+const DRAIN_CHECK_INTERVAL = 100
+
+// upstream connection pool: max idle connections and max connections per upstream (0 for no limit),
+// timeout in seconds for a connection to stay idle in pool before closing, and automatic vacuum in seconds
+const DEFAULT_POOL_MAX_IDLE = 8
+const DEFAULT_POOL_MAX_TOTAL = 0
+const DEFAULT_POOL_IDLE_TIMEOUT = 30
+const POOL_VACUUM_TIMEOUT = 10
+
+// timeout in seconds for a server to answer an 'Expect: 100-continue' request, before sending the body anyway
+const EXPECT_CONTINUE_TIMEOUT = 1
 
 // config automatic reloading
 const RELOAD_TEST_TIMEOUT = 10
 const RELOAD_FORCE_TIMEOUT = 60 * 60
+
+// remote config: default interval in seconds between polls of the config url
+const DEFAULT_REMOTE_INTERVAL = 60
 const KDC_TEST_TIMEOUT = 10
 
+// kerberos identity cache: max clients, idle timeout in seconds and automatic vacuum in seconds
+const DEFAULT_KRB_MAX_CLIENTS = 1000
+const DEFAULT_KRB_IDLE_TIMEOUT = 60 * 60
+const KRB_VACUUM_TIMEOUT = 60
+
+// kerberos failed logins: initial and max backoff in seconds before retrying the same password, lockout threshold and time in seconds per user
+const DEFAULT_KRB_FAILURE_BACKOFF = 30
+const DEFAULT_KRB_MAX_BACKOFF = 15 * 60
+const DEFAULT_KRB_LOCKOUT_THRESHOLD = 3
+const DEFAULT_KRB_LOCKOUT_TIME = 30 * 60
+
+// configured credentials: number of failures before suspending, and suspension time in seconds
+const DEFAULT_CREDENTIAL_FAILURES = 3
+const DEFAULT_CREDENTIAL_SUSPEND = 5 * 60
+
+// socks authentication: none, or per-user to forward username/password to upstream proxies, otherwise a credential name
+const SOCKS_AUTH_NONE = "none"
+const SOCKS_AUTH_PER_USER = "per-user"
+
+// socks udp associations: default idle timeout in seconds, and max datagram size
+const DEFAULT_UDP_TIMEOUT = 60
+const UDP_MAX_SIZE = 65507
+
+// socks protocol versions, socks4 reply codes, and max length of socks4 user id and domain name
+const SOCKS4_VERSION = 0x04
+const SOCKS5_VERSION = 0x05
+const SOCKS4_GRANTED = 0x5a
+const SOCKS4_REJECTED = 0x5b
+const SOCKS4_MAX_FIELD = 255
+
+// upstream socks proxies: host resolution by the proxy (socks5h/socks4a), or locally
+const SOCKS_RESOLVE_REMOTE = "remote"
+const SOCKS_RESOLVE_LOCAL = "local"
+
+// listeners protocols, and names of the default rule sets
+const LISTENER_HTTP = "http"
+const LISTENER_SOCKS = "socks"
+const LISTENER_TRANSPARENT = "transparent"
+const LISTENER_ADMIN = "admin"
+const RULES_HTTP = "rules"
+const RULES_SOCKS = "socksRules"
+
+// systemd: first socket passed by socket activation, and notification states
+const SD_LISTEN_FDS_START = 3
+const SD_READY = "READY=1"
+const SD_RELOADING = "RELOADING=1"
+const SD_STOPPING = "STOPPING=1"
+
+// tls record type of client hello, to detect tls in transparent connections
+const TLS_RECORD_HANDSHAKE = 0x16
+
+// socks bind: max time in seconds to wait for the incoming connection
+const SOCKS_BIND_TIMEOUT = 120
+
 // max header size, to buffer request headers
 const HEADER_MAX_SIZE = 32 * 1024
 
+// content length of a body not delimited by content-length: chunked, or until the connection is closed
+const BODY_CHUNKED = -1
+const BODY_UNTIL_CLOSE = -2
+
+// header required to update credentials, browsers can't send it cross-site without a CORS preflight, which is never accepted
+const CREDENTIALS_HEADER = "X-Kpx-Credentials"
+
 // encrypted password
 const ENCRYPTED = "encrypted:"
+const ENCRYPTED_V2 = "v2:"
+
+// scrypt parameters used to derive encryption key, for v2 encrypted passwords
+const SCRYPT_N = 1 << 15
+const SCRYPT_R = 8
+const SCRYPT_P = 1
+const SCRYPT_SALT_SIZE = 16
+
+// max time in seconds for a password command to return the password
+const PASSWORD_COMMAND_TIMEOUT = 10
+
+// max time in seconds to wait for the output of a killed password command, held by its children
+const PASSWORD_COMMAND_WAIT_DELAY = 1
 
 type Options struct {
 	ShowHelp    bool
@@ -65,6 +152,7 @@ type Options struct {
 	Verbose     bool
 	ACL         string
 	ConsoleUI   bool
+	ConfigProxy string // bootstrap proxy used to download a remote config
 
 	bindHost  string
 	bindPort  int
@@ -0,0 +1,479 @@
+package kpx
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/http2/hpack"
+)
+
+/*
+HTTP/2 on http and admin listeners, with prior knowledge h2c, or 'h2' negotiated by ALPN on tls listeners:
+- each stream is sent as an HTTP/1.1 request to a new process over an in-memory connection, using the same rules, authentication and upstream proxies
+- CONNECT streams, and extended CONNECT streams (RFC 8441) translated to an HTTP/1.1 upgrade, are tunnels once established
+- requests to the listener itself, like /proxy.pac, are served by the local web server
+
+In MITM sessions where both sides negotiated 'h2', frames are forwarded as is, header blocks being decoded to log each stream.
+*/
+
+const HTTP2_PREFACE = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+// http/2 frame types and flags used to find header blocks and settings
+const (
+	HTTP2_FRAME_HEADERS      = 0x1
+	HTTP2_FRAME_SETTINGS     = 0x4
+	HTTP2_FRAME_PUSH_PROMISE = 0x5
+	HTTP2_FRAME_CONTINUATION = 0x9
+	HTTP2_FLAG_ACK           = 0x1
+	HTTP2_FLAG_END_HEADERS   = 0x4
+	HTTP2_FLAG_PADDED        = 0x8
+	HTTP2_FLAG_PRIORITY      = 0x20
+)
+
+// http/2 settings limiting frames and header blocks sent by the peer, and their initial values
+const (
+	HTTP2_SETTINGS_HEADER_TABLE_SIZE = 0x1
+	HTTP2_SETTINGS_MAX_FRAME_SIZE    = 0x5
+	HTTP2_DEFAULT_HEADER_TABLE_SIZE  = 4096
+	HTTP2_DEFAULT_MAX_FRAME_SIZE     = 16384
+)
+
+// hop-by-hop headers, not forwarded between http/2 streams and HTTP/1.1 requests
+var hopHeaders = []string{"Connection", "Proxy-Connection", "Keep-Alive", "Transfer-Encoding", "Te", "Trailer", "Upgrade"}
+
+// serve a connection of an http listener, using http/2 if negotiated by ALPN or if the client starts with the http/2 preface
+func (p *Process) processHttpConn() {
+	if tlsConn, ok := p.trafficConn.conn.(*tls.Conn); ok {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(p.config.conf.ConnectTimeout)*time.Second)
+		err := tlsConn.HandshakeContext(ctx)
+		cancel()
+		if err != nil {
+			logInfo("[-] TLS connection from %s failed: %#s", p.conn.RemoteAddr(), err)
+			_ = p.conn.Close()
+			return
+		}
+		if tlsConn.ConnectionState().NegotiatedProtocol == "h2" {
+			p.processHttp2(tlsConn)
+			return
+		}
+		p.processHttp()
+		return
+	}
+	// read until the data read can't be the preface
+	p.conn.setTimeout(p.config.conf.ConnectTimeout)
+	data := make([]byte, 0, len(HTTP2_PREFACE))
+	for len(data) < len(HTTP2_PREFACE) && strings.HasPrefix(HTTP2_PREFACE, string(data)) {
+		n, err := p.conn.Read(data[len(data):cap(data)])
+		if err != nil {
+			_ = p.conn.Close()
+			return
+		}
+		data = data[:len(data)+n]
+	}
+	p.conn.conn = NewBufferedConn(p.conn.conn, data)
+	if string(data) == HTTP2_PREFACE {
+		p.processHttp2(p.conn.conn)
+		return
+	}
+	p.processHttp()
+}
+
+// serve http/2 streams of the connection until it is closed
+func (p *Process) processHttp2(conn net.Conn) {
+	defer func() { _ = p.conn.Close() }()
+	p.conn.setTimeout(0)
+	if p.config.conf.Verbose {
+		logInfo("(%d) HTTP/2 connection from %s", p.reqId, p.conn.RemoteAddr())
+	}
+	ln := &singleListener{conn: conn, done: make(chan struct{})}
+	protocols := &http.Protocols{}
+	protocols.SetHTTP2(true)
+	protocols.SetUnencryptedHTTP2(true)
+	server := &http.Server{
+		Handler:   http.HandlerFunc(p.serveStream),
+		Protocols: protocols,
+		ErrorLog:  log.New(io.Discard, "", 0),
+		ConnState: func(_ net.Conn, state http.ConnState) {
+			if state == http.StateClosed || state == http.StateHijacked {
+				_ = ln.Close()
+			}
+		},
+	}
+	_ = server.Serve(ln)
+}
+
+// serve an http/2 stream with a new process, as an HTTP/1.1 request
+func (p *Process) serveStream(w http.ResponseWriter, r *http.Request) {
+	client, server := net.Pipe()
+	defer func() { _ = client.Close() }()
+	process := NewProcess(p.proxy, &streamConn{Conn: server, local: p.conn.LocalAddr(), remote: p.conn.RemoteAddr()})
+	process.listener = p.listener
+	go process.processHttp()
+	tunnel := r.Method == http.MethodConnect
+	protocol := r.Header.Get(":protocol")
+	request, method := p.streamRequest(r, protocol)
+	// request body is sent while response is read, but tunnel data is only sent once established
+	go func() {
+		_, err := client.Write(request)
+		if err == nil && !tunnel && r.ContentLength != 0 {
+			err = writeStreamBody(client, r)
+		}
+		if err != nil {
+			_ = client.Close()
+		}
+	}()
+	reader := bufio.NewReader(client)
+	response, err := http.ReadResponse(reader, &http.Request{Method: method})
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	defer func() { _ = response.Body.Close() }()
+	copyHeaders(w.Header(), response.Header)
+	established := tunnel && (protocol == "" && response.StatusCode == http.StatusOK || protocol != "" && response.StatusCode == http.StatusSwitchingProtocols)
+	if !established {
+		w.WriteHeader(response.StatusCode)
+		_, _ = io.Copy(&flushWriter{w: w, rc: http.NewResponseController(w)}, response.Body)
+		for key, values := range response.Trailer {
+			for _, value := range values {
+				w.Header().Add(http.TrailerPrefix+key, value)
+			}
+		}
+		return
+	}
+	// tunnel is established, data is copied both ways until one side closes
+	w.Header().Del("Sec-Websocket-Accept")
+	w.WriteHeader(http.StatusOK)
+	rc := http.NewResponseController(w)
+	_ = rc.Flush()
+	go func() {
+		_, _ = io.Copy(client, r.Body)
+		_ = client.Close()
+	}()
+	_, _ = io.Copy(&flushWriter{w: w, rc: rc}, reader)
+}
+
+// HTTP/1.1 request line and headers of a stream, with the method used to read the response
+func (p *Process) streamRequest(r *http.Request, protocol string) ([]byte, string) {
+	var b bytes.Buffer
+	method := r.Method
+	switch {
+	case r.Method == http.MethodConnect && protocol == "":
+		_, _ = fmt.Fprintf(&b, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n", r.Host, r.Host)
+	case r.Method == http.MethodConnect:
+		// extended connect is an HTTP/1.1 upgrade, websocket key being only required by HTTP/1.1
+		method = http.MethodGet
+		_, _ = fmt.Fprintf(&b, "GET %s HTTP/1.1\r\nHost: %s\r\nConnection: Upgrade\r\nUpgrade: %s\r\n", p.streamUrl(r), r.Host, protocol)
+		if strings.EqualFold(protocol, "websocket") && r.Header.Get("Sec-Websocket-Key") == "" {
+			key := make([]byte, 16)
+			_, _ = rand.Read(key)
+			_, _ = fmt.Fprintf(&b, "Sec-WebSocket-Key: %s\r\n", base64.StdEncoding.EncodeToString(key))
+		}
+	default:
+		_, _ = fmt.Fprintf(&b, "%s %s HTTP/1.1\r\nHost: %s\r\nConnection: close\r\n", r.Method, p.streamUrl(r), r.Host)
+		if r.ContentLength > 0 {
+			_, _ = fmt.Fprintf(&b, "Content-Length: %d\r\n", r.ContentLength)
+		} else if r.ContentLength < 0 {
+			b.WriteString("Transfer-Encoding: chunked\r\n")
+		}
+	}
+	headers := r.Header.Clone()
+	removeHopHeaders(headers)
+	// pseudo-header of extended connect, already sent as upgrade
+	headers.Del(":protocol")
+	headers.Del("Host")
+	headers.Del("Content-Length")
+	_ = headers.Write(&b)
+	b.WriteString("\r\n")
+	return b.Bytes(), method
+}
+
+// url of a stream, relative for the local web server
+func (p *Process) streamUrl(r *http.Request) string {
+	if p.isLocalAuthority(r.Host) {
+		return r.URL.RequestURI()
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + r.URL.RequestURI()
+}
+
+// check if authority is the address of the listener, to serve local pages like proxy.pac
+func (p *Process) isLocalAuthority(authority string) bool {
+	local, ok := p.conn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	host, port, err := net.SplitHostPort(authority)
+	if err != nil || port != fmt.Sprint(local.Port) {
+		return false
+	}
+	hostname, _ := os.Hostname()
+	ip := net.ParseIP(host)
+	return strings.EqualFold(host, "localhost") || strings.EqualFold(host, hostname) || ip != nil && (ip.IsLoopback() || ip.Equal(local.IP))
+}
+
+// send request body, chunked if its length is unknown
+func writeStreamBody(w io.Writer, r *http.Request) error {
+	if r.ContentLength > 0 {
+		_, err := io.Copy(w, r.Body)
+		return err // no wrap
+	}
+	chunked := httputil.NewChunkedWriter(w)
+	_, err := io.Copy(chunked, r.Body)
+	if err == nil {
+		err = chunked.Close()
+	}
+	if err == nil {
+		_, err = io.WriteString(w, "\r\n")
+	}
+	return err // no wrap
+}
+
+func copyHeaders(dst, src http.Header) {
+	for key, values := range src {
+		dst[key] = append(dst[key], values...)
+	}
+	removeHopHeaders(dst)
+}
+
+// remove hop-by-hop headers, and headers listed in Connection header
+func removeHopHeaders(header http.Header) {
+	for _, value := range header.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			header.Del(strings.TrimSpace(name))
+		}
+	}
+	for _, name := range hopHeaders {
+		header.Del(name)
+	}
+}
+
+// writer flushing each write, for streamed responses and tunnels
+type flushWriter struct {
+	w  io.Writer
+	rc *http.ResponseController
+}
+
+func (f *flushWriter) Write(b []byte) (int, error) {
+	n, err := f.w.Write(b)
+	if err == nil {
+		err = f.rc.Flush()
+	}
+	return n, err
+}
+
+// in-memory connection of a stream, with the addresses of the http/2 connection
+type streamConn struct {
+	net.Conn
+	local  net.Addr
+	remote net.Addr
+}
+
+func (c *streamConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *streamConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// listener accepting a single connection, then blocking until closed
+type singleListener struct {
+	conn net.Conn
+	once sync.Once
+	done chan struct{}
+	lock sync.Mutex
+}
+
+func (l *singleListener) Accept() (net.Conn, error) {
+	l.lock.Lock()
+	conn := l.conn
+	l.conn = nil
+	l.lock.Unlock()
+	if conn != nil {
+		return conn, nil
+	}
+	<-l.done
+	return nil, net.ErrClosed
+}
+
+func (l *singleListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *singleListener) Addr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+// protocols of a client hello that can be intercepted, offered to the server in MITM sessions
+func mitmProtocols(protocols []string) []string {
+	var supported []string
+	for _, protocol := range protocols {
+		if protocol == "h2" || protocol == "http/1.1" || protocol == "http/1.0" {
+			supported = append(supported, protocol)
+		}
+	}
+	return supported
+}
+
+// settings advertised by one side of an intercepted http/2 connection, limiting what the other side sends
+type Http2Settings struct {
+	headerTableSize atomic.Uint32
+	maxFrameSize    atomic.Uint32
+}
+
+func NewHttp2Settings() *Http2Settings {
+	settings := &Http2Settings{}
+	settings.headerTableSize.Store(HTTP2_DEFAULT_HEADER_TABLE_SIZE)
+	settings.maxFrameSize.Store(HTTP2_DEFAULT_MAX_FRAME_SIZE)
+	return settings
+}
+
+// update settings from the payload of a SETTINGS frame, made of 6 bytes entries
+func (s *Http2Settings) update(payload []byte) {
+	for i := 0; i+6 <= len(payload); i += 6 {
+		value := binary.BigEndian.Uint32(payload[i+2 : i+6])
+		switch binary.BigEndian.Uint16(payload[i : i+2]) {
+		case HTTP2_SETTINGS_HEADER_TABLE_SIZE:
+			s.headerTableSize.Store(value)
+		case HTTP2_SETTINGS_MAX_FRAME_SIZE:
+			s.maxFrameSize.Store(value)
+		}
+	}
+}
+
+// forward http/2 frames of an intercepted connection, logging headers of each stream.
+// headers are decoded with their own hpack table, and no longer logged if decoding fails.
+// settings sent by source are stored in sourceSettings, frames of source are limited by targetSettings.
+func (p *Process) pipeHttp2(source *ProxyRequest, target *ProxyRequest, request bool, sourceSettings *Http2Settings, targetSettings *Http2Settings, wait *sync.WaitGroup) {
+	defer wait.Done()
+	defer func() {
+		p.closeChannel(source)
+		p.closeChannel(target)
+	}()
+	if request {
+		preface := make([]byte, len(HTTP2_PREFACE))
+		_, err := io.ReadFull(source.conn, preface)
+		if err != nil || string(preface) != HTTP2_PREFACE {
+			return
+		}
+		_, err = target.conn.Write(preface)
+		if err != nil {
+			return
+		}
+	}
+	decoder := hpack.NewDecoder(HTTP2_DEFAULT_HEADER_TABLE_SIZE, nil)
+	decode := true
+	var block []byte
+	frame := make([]byte, 9)
+	for {
+		_, err := io.ReadFull(source.conn, frame[:9])
+		if err != nil {
+			return
+		}
+		length := int(frame[0])<<16 | int(frame[1])<<8 | int(frame[2])
+		if length > int(targetSettings.maxFrameSize.Load()) {
+			logInfo("%s http/2 frame of %d bytes is larger than max frame size", p.logPrefix, length)
+			return
+		}
+		if cap(frame) < 9+length {
+			frame = append(frame[:9], make([]byte, length)...)
+		}
+		frame = frame[:9+length]
+		_, err = io.ReadFull(source.conn, frame[9:])
+		if err != nil {
+			return
+		}
+		kind, flags, stream := frame[3], frame[4], binary.BigEndian.Uint32(frame[5:9])&0x7fffffff
+		payload := frame[9:]
+		// settings apply to frames sent by the other side, once it receives them
+		if kind == HTTP2_FRAME_SETTINGS && flags&HTTP2_FLAG_ACK == 0 {
+			sourceSettings.update(payload)
+		}
+		_, err = target.conn.Write(frame)
+		if err != nil {
+			return
+		}
+		if !decode {
+			continue
+		}
+		switch kind {
+		case HTTP2_FRAME_HEADERS, HTTP2_FRAME_PUSH_PROMISE:
+			padding := 0
+			if flags&HTTP2_FLAG_PADDED != 0 && len(payload) > 0 {
+				padding = int(payload[0])
+				payload = payload[1:]
+			}
+			if kind == HTTP2_FRAME_HEADERS && flags&HTTP2_FLAG_PRIORITY != 0 {
+				payload = payload[min(5, len(payload)):]
+			}
+			if kind == HTTP2_FRAME_PUSH_PROMISE {
+				payload = payload[min(4, len(payload)):]
+			}
+			block = append(block[:0], payload[:max(0, len(payload)-padding)]...)
+		case HTTP2_FRAME_CONTINUATION:
+			block = append(block, payload...)
+		default:
+			continue
+		}
+		if flags&HTTP2_FLAG_END_HEADERS == 0 {
+			continue
+		}
+		// dynamic table size updates sent by source are limited by the size advertised by target
+		decoder.SetAllowedMaxDynamicTableSize(targetSettings.headerTableSize.Load())
+		fields, err := decoder.DecodeFull(block)
+		if err != nil {
+			decode = false
+			continue
+		}
+		p.logHttp2Headers(stream, fields, request && kind == HTTP2_FRAME_HEADERS)
+	}
+}
+
+// log request line of a stream if verbose, and its headers if debug
+func (p *Process) logHttp2Headers(stream uint32, fields []hpack.HeaderField, request bool) {
+	prefix := fmt.Sprintf("%s #%d", p.logPrefix, stream)
+	if request && p.verbose {
+		pseudo := map[string]string{}
+		for _, field := range fields {
+			pseudo[field.Name] = field.Value
+		}
+		url := pseudo[":authority"]
+		if pseudo[":path"] != "" {
+			url = pseudo[":scheme"] + "://" + url + pseudo[":path"]
+		}
+		// trailers have no pseudo headers
+		if pseudo[":method"] != "" {
+			logInfo("%s %s %s HTTP/2", prefix, pseudo[":method"], url)
+		}
+	}
+	if debug {
+		direction := " P<"
+		if request {
+			direction = " C<"
+		}
+		for _, field := range fields {
+			logHeader("%s %s", prefix+direction, field.Name+": "+field.Value)
+		}
+	}
+}
@@ -0,0 +1,311 @@
+package kpx
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2/hpack"
+)
+
+// start a proxy with a listener on a free port, returning its address
+func newTestHttp2Proxy(t *testing.T, content string) string {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	_ = ln.Close()
+	proxy := newTestSocksProxyConfig(t, fmt.Sprintf(content, port))
+	listener := proxy.getConfig().conf.listeners[0]
+	ln, err = listener.listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	go proxy.serve(ln, listener)
+	return ln.Addr().String()
+}
+
+func newTestHttp2Client(tlsConfig *tls.Config) *http.Client {
+	protocols := &http.Protocols{}
+	if tlsConfig != nil {
+		protocols.SetHTTP2(true)
+	} else {
+		protocols.SetUnencryptedHTTP2(true)
+	}
+	return &http.Client{Transport: &http.Transport{Protocols: protocols, TLSClientConfig: tlsConfig}, Timeout: 5 * time.Second}
+}
+
+func TestHttp2(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = ln.Close() }()
+	go func() {
+		_ = http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			_, _ = fmt.Fprintf(w, "%s %s %s", r.Method, r.URL.Path, body)
+		}))
+	}()
+	echoPort := newTestEchoServer(t)
+	dir := t.TempDir()
+	cert, _ := NewCert(NewBasicHttpsCertConfig("localhost", nil, 1), 2048, nil)
+	_ = cert.SaveToFiles(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"))
+	rules := "rules:\n  - host: \"*\"\n    proxy: direct\n    dns: 127.0.0.1\n"
+	for _, test := range []struct {
+		name     string
+		listener string
+		tls      *tls.Config
+	}{
+		{"h2c", "listeners:\n  - port: %d\n", nil},
+		{"h2", fmt.Sprintf("listeners:\n  - port: %%d\n    cert: %s\n    key: %s\n", filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")), &tls.Config{InsecureSkipVerify: true}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			address := newTestHttp2Proxy(t, rules+test.listener)
+			client := newTestHttp2Client(test.tls)
+			scheme := "http"
+			if test.tls != nil {
+				scheme = "https"
+			}
+			// streams are requests to the target given by the authority
+			request, _ := http.NewRequest(http.MethodPost, scheme+"://"+address+"/path", strings.NewReader("data"))
+			request.Host = ln.Addr().String()
+			response, err := client.Do(request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(response.Body)
+			_ = response.Body.Close()
+			if response.ProtoMajor != 2 || response.StatusCode != 200 || string(body) != "POST /path data" {
+				t.Fatalf("unexpected response: %s %d %q", response.Proto, response.StatusCode, body)
+			}
+			// CONNECT stream is a tunnel
+			reader, writer := io.Pipe()
+			request, _ = http.NewRequest(http.MethodConnect, scheme+"://"+address, reader)
+			request.Host = fmt.Sprintf("127.0.0.1:%d", echoPort)
+			response, err = client.Do(request)
+			if err != nil || response.StatusCode != 200 {
+				t.Fatalf("unexpected connect: %v %v", response, err)
+			}
+			_, _ = writer.Write([]byte("hello"))
+			buffer := make([]byte, 5)
+			_, err = io.ReadFull(response.Body, buffer)
+			if err != nil || string(buffer) != "hello" {
+				t.Fatalf("unexpected echo: %q %v", buffer, err)
+			}
+			_ = writer.Close()
+			_ = response.Body.Close()
+			// HTTP/1.1 is still served
+			request, _ = http.NewRequest(http.MethodGet, scheme+"://"+address+"/proxy.pac", nil)
+			var tlsConfig *tls.Config
+			if test.tls != nil {
+				tlsConfig = &tls.Config{InsecureSkipVerify: true}
+			}
+			response, err = (&http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}, Timeout: 5 * time.Second}).Do(request)
+			if err != nil || response.ProtoMajor != 1 || response.StatusCode != 200 {
+				t.Fatalf("unexpected response: %v %v", response, err)
+			}
+			_ = response.Body.Close()
+			// local pages over http/2
+			request, _ = http.NewRequest(http.MethodGet, scheme+"://"+address+"/proxy.pac", nil)
+			response, err = client.Do(request)
+			if err != nil || response.StatusCode != 200 {
+				t.Fatalf("unexpected response: %v %v", response, err)
+			}
+			body, _ = io.ReadAll(response.Body)
+			_ = response.Body.Close()
+			if !strings.Contains(string(body), "FindProxyForURL") {
+				t.Fatalf("unexpected pac: %q", body)
+			}
+		})
+	}
+	// extended CONNECT stream (RFC 8441) is a websocket upgrade, only enabled by GODEBUG
+	t.Run("websocket", func(t *testing.T) {
+		if !strings.Contains(os.Getenv("GODEBUG"), "http2xconnect=1") {
+			cmd := exec.Command(os.Args[0], "-test.run=^TestHttp2$/^websocket$", "-test.count=1")
+			cmd.Env = append(os.Environ(), "GODEBUG=http2xconnect=1")
+			output, err := cmd.CombinedOutput()
+			if err != nil {
+				t.Fatalf("%s%v", output, err)
+			}
+			return
+		}
+		target, err := net.Listen("tcp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = target.Close() }()
+		go func() {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			defer func() { _ = conn.Close() }()
+			reader := bufio.NewReader(conn)
+			request, err := http.ReadRequest(reader)
+			if err != nil || request.Header.Get("Upgrade") != "websocket" || request.Header.Get("Sec-Websocket-Key") == "" {
+				_, _ = conn.Write([]byte("HTTP/1.1 400 Bad Request\r\nContent-Length: 0\r\n\r\n"))
+				return
+			}
+			_, _ = conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n"))
+			_, _ = io.Copy(conn, reader)
+		}()
+		// go http client doesn't send :protocol, frames are written as is
+		address := newTestHttp2Proxy(t, "strictHttp: true\n"+rules+"listeners:\n  - port: %d\n")
+		conn, err := net.Dial("tcp4", address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = conn.Close() }()
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		writeFrame := func(kind byte, flags byte, payload []byte) {
+			frame := []byte{byte(len(payload) >> 16), byte(len(payload) >> 8), byte(len(payload)), kind, flags, 0, 0, 0, 1}
+			if kind == HTTP2_FRAME_SETTINGS {
+				frame[8] = 0
+			}
+			_, _ = conn.Write(append(frame, payload...))
+		}
+		var block bytes.Buffer
+		encoder := hpack.NewEncoder(&block)
+		for _, field := range [][2]string{{":method", "CONNECT"}, {":protocol", "websocket"}, {":scheme", "http"}, {":path", "/chat"}, {":authority", target.Addr().String()}} {
+			_ = encoder.WriteField(hpack.HeaderField{Name: field[0], Value: field[1]})
+		}
+		_, _ = conn.Write([]byte(HTTP2_PREFACE))
+		writeFrame(HTTP2_FRAME_SETTINGS, 0, nil)
+		writeFrame(HTTP2_FRAME_HEADERS, HTTP2_FLAG_END_HEADERS, block.Bytes())
+		// response headers, then echoed data frames
+		decoder := hpack.NewDecoder(HTTP2_DEFAULT_HEADER_TABLE_SIZE, nil)
+		var data []byte
+		for len(data) < 5 {
+			frame := make([]byte, 9)
+			_, err = io.ReadFull(conn, frame)
+			if err != nil {
+				t.Fatalf("unexpected read: %q %v", data, err)
+			}
+			payload := make([]byte, int(frame[0])<<16|int(frame[1])<<8|int(frame[2]))
+			_, _ = io.ReadFull(conn, payload)
+			switch {
+			case frame[3] == HTTP2_FRAME_SETTINGS && frame[4]&HTTP2_FLAG_ACK == 0:
+				writeFrame(HTTP2_FRAME_SETTINGS, HTTP2_FLAG_ACK, nil)
+			case frame[3] == HTTP2_FRAME_HEADERS:
+				fields, _ := decoder.DecodeFull(payload)
+				if len(fields) == 0 || fields[0].Name != ":status" || fields[0].Value != "200" {
+					t.Fatalf("unexpected response: %v", fields)
+				}
+				writeFrame(0x0, 0, []byte("hello"))
+			case frame[3] == 0x0:
+				data = append(data, payload...)
+			}
+		}
+		if string(data) != "hello" {
+			t.Fatalf("unexpected echo: %q", data)
+		}
+	})
+}
+
+func TestMitmHttp2(t *testing.T) {
+	t.Chdir(t.TempDir())
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "Grpc-Status")
+		_, _ = fmt.Fprintf(w, "%s %s", r.Proto, r.URL.Path)
+		w.Header().Set("Grpc-Status", "0")
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+	address := newTestHttp2Proxy(t, "rules:\n  - host: \"*\"\n    proxy: direct\n    mitm: true\nlisteners:\n  - port: %d\n")
+	proxyUrl, _ := url.Parse("http://" + address)
+	for _, test := range []struct {
+		http2    bool
+		expected string
+	}{
+		{true, "HTTP/2.0 /path"},
+		{false, "HTTP/1.1 /path"},
+	} {
+		// protocol negotiated by the client is negotiated with the server
+		protocols := &http.Protocols{}
+		protocols.SetHTTP1(true)
+		protocols.SetHTTP2(test.http2)
+		client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyUrl), Protocols: protocols, TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}, Timeout: 5 * time.Second}
+		response, err := client.Get(server.URL + "/path")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(response.Body)
+		_ = response.Body.Close()
+		if string(body) != test.expected || response.Proto != test.expected[:8] {
+			t.Fatalf("unexpected response: %s %q", response.Proto, body)
+		}
+		if test.http2 && response.Trailer.Get("Grpc-Status") != "0" {
+			t.Fatalf("unexpected trailers: %v", response.Trailer)
+		}
+	}
+}
+
+func TestPipeHttp2FrameSize(t *testing.T) {
+	frame := func(kind byte, payload []byte) []byte {
+		length := len(payload)
+		return append([]byte{byte(length >> 16), byte(length >> 8), byte(length), kind, 0, 0, 0, 0, 0}, payload...)
+	}
+	// max frame size advertised by target
+	settings := []byte{0, HTTP2_SETTINGS_MAX_FRAME_SIZE, 0, 0, 0x80, 0}
+	for _, test := range []struct {
+		settings  []byte
+		forwarded bool
+	}{
+		{nil, false},
+		{settings, true},
+	} {
+		sourceConn, source := net.Pipe()
+		target, targetConn := net.Pipe()
+		_ = sourceConn.SetDeadline(time.Now().Add(5 * time.Second))
+		_ = targetConn.SetDeadline(time.Now().Add(5 * time.Second))
+		targetSettings := NewHttp2Settings()
+		targetSettings.update(test.settings)
+		var wait sync.WaitGroup
+		wait.Add(1)
+		go (&Process{}).pipeHttp2(&ProxyRequest{conn: NewTimedConn(source, nil)}, &ProxyRequest{conn: NewTimedConn(target, nil)}, false, NewHttp2Settings(), targetSettings, &wait)
+		// data frame larger than the default max frame size
+		data := frame(0, make([]byte, HTTP2_DEFAULT_MAX_FRAME_SIZE+1))
+		go func() { _, _ = sourceConn.Write(data) }()
+		received, _ := io.ReadAll(io.LimitReader(targetConn, int64(len(data))))
+		if (len(received) == len(data)) != test.forwarded {
+			t.Fatalf("settings %v: unexpected %d bytes forwarded", test.settings, len(received))
+		}
+		_ = sourceConn.Close()
+		_ = targetConn.Close()
+		wait.Wait()
+	}
+	// settings sent by a side are stored, acknowledgements are ignored
+	sourceSettings, targetSettings := NewHttp2Settings(), NewHttp2Settings()
+	sourceConn, source := net.Pipe()
+	target, targetConn := net.Pipe()
+	var wait sync.WaitGroup
+	wait.Add(1)
+	go (&Process{}).pipeHttp2(&ProxyRequest{conn: NewTimedConn(source, nil)}, &ProxyRequest{conn: NewTimedConn(target, nil)}, false, sourceSettings, targetSettings, &wait)
+	go func() {
+		_, _ = sourceConn.Write(frame(HTTP2_FRAME_SETTINGS, append([]byte{0, HTTP2_SETTINGS_HEADER_TABLE_SIZE, 0, 0, 0, 0}, settings...)))
+	}()
+	_, _ = io.ReadFull(targetConn, make([]byte, 9+12))
+	_ = sourceConn.Close()
+	_ = targetConn.Close()
+	wait.Wait()
+	if sourceSettings.headerTableSize.Load() != 0 || sourceSettings.maxFrameSize.Load() != 0x8000 || targetSettings.maxFrameSize.Load() != HTTP2_DEFAULT_MAX_FRAME_SIZE {
+		t.Fatalf("unexpected settings %d %d", sourceSettings.headerTableSize.Load(), sourceSettings.maxFrameSize.Load())
+	}
+}
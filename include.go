@@ -0,0 +1,391 @@
+package kpx
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/palantir/stacktrace"
+	yaml2 "gopkg.in/yaml.v2"
+)
+
+/*
+Layered configuration:
+- 'include' loads other files or globs first, relative to the including file, the including file being applied last
+- maps (proxies, credentials, domains, ruleSets...) are merged by key, other values are replaced when set
+- 'prependRules' and 'appendRules' add rules before and after the rules of previous layers
+- ${VAR} and ${VAR:-default} are replaced by environment variables, $${ is kept as ${
+*/
+
+var envRegex = regexp.MustCompile(`\$\$\{|\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?}`)
+
+// replace ${VAR} and ${VAR:-default} by environment variables, escaping values so they can't change the yaml structure
+func expandEnv(content string) (string, error) {
+	var builder strings.Builder
+	last := 0
+	for _, match := range envRegex.FindAllStringSubmatchIndex(content, -1) {
+		builder.WriteString(content[last:match[0]])
+		last = match[1]
+		token := content[match[0]:match[1]]
+		if token == "$${" {
+			builder.WriteString("${")
+			continue
+		}
+		name := content[match[2]:match[3]]
+		value, ok := os.LookupEnv(name)
+		if (!ok || value == "") && match[4] >= 0 {
+			value = content[match[6]:match[7]]
+		}
+		lineStart := strings.LastIndexByte(content[:match[0]], '\n') + 1
+		lineEnd := strings.IndexByte(content[match[1]:], '\n')
+		if lineEnd < 0 {
+			lineEnd = len(content) - match[1]
+		}
+		escaped, err := escapeEnv(token, name, value, content[lineStart:match[0]], content[match[1]:match[1]+lineEnd])
+		if err != nil {
+			return "", err // no wrap
+		}
+		builder.WriteString(escaped)
+	}
+	builder.WriteString(content[last:])
+	return builder.String(), nil
+}
+
+// escape a value depending on where it is in its line: in a comment, a quoted string, or a plain value
+func escapeEnv(token string, name string, value string, before string, after string) (string, error) {
+	quote := byte(0)
+	for i := 0; i < len(before); i++ {
+		c := before[i]
+		switch {
+		case quote == '"' && c == '\\':
+			i++
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote == 0 && (c == '"' || c == '\''):
+			quote = c
+		case quote == 0 && c == '#' && (i == 0 || before[i-1] == ' ' || before[i-1] == '\t'):
+			// comments are not expanded
+			return token, nil
+		}
+	}
+	switch quote {
+	case '"':
+		quoted := strconv.Quote(value)
+		return quoted[1 : len(quoted)-1], nil
+	case '\'':
+		if strings.ContainsAny(value, "\r\n") {
+			return "", stacktrace.NewError("environment variable '%s' contains a new line, use it in a double quoted value", name)
+		}
+		return strings.ReplaceAll(value, "'", "''"), nil
+	}
+	if isPlainValue(value) {
+		return value, nil
+	}
+	// value is the whole plain value of a key or a list item, so it can be quoted
+	trimmed := strings.TrimRight(before, " \t")
+	after = strings.TrimLeft(after, " \t")
+	if len(trimmed) < len(before) && (strings.HasSuffix(trimmed, ":") || strings.HasSuffix(trimmed, "-")) && (after == "" || after[0] == '#') {
+		return strconv.Quote(value), nil
+	}
+	return "", stacktrace.NewError("environment variable '%s' contains yaml special characters, use it in a double quoted value", name)
+}
+
+// check a value can be used as is in a plain yaml value
+func isPlainValue(value string) bool {
+	if value == "" {
+		return true
+	}
+	if strings.ContainsAny(value[:1], ",[]{}#&*!|>'\"%@` \t") || strings.ContainsAny(value[:1], "-?:") && (len(value) == 1 || value[1] == ' ') {
+		return false
+	}
+	if strings.Contains(value, ": ") || strings.Contains(value, " #") || strings.HasSuffix(value, ":") || strings.HasSuffix(value, " ") {
+		return false
+	}
+	for _, r := range value {
+		if r < 0x20 || r == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// read a config file and its includes, merging them into current config
+func (c *Config) readLayer(filename string, visiting map[string]bool) error {
+	abs, content, err := c.readLayerContent(filename)
+	if err != nil {
+		return err // no wrap
+	}
+	if visiting[abs] {
+		return stacktrace.NewError("file '%s' is included recursively", filename)
+	}
+	visiting[abs] = true
+	defer delete(visiting, abs)
+	// structs are read over current values, so their missing fields keep current or default values
+	var layer Conf
+	layer.inheritStructs(&c.conf)
+	expanded, err := expandEnv(string(content))
+	if err != nil {
+		return stacktrace.Propagate(err, "unable to read file '%s'", filename)
+	}
+	keys, unknown, err := unmarshalConf(expanded, &layer)
+	if err != nil {
+		return stacktrace.Propagate(err, "unable to read file '%s' as yaml/json", filename)
+	}
+	for _, message := range unknown {
+		c.unknownFields = append(c.unknownFields, newUnknownField(filename, message))
+	}
+	// a remote config can't read local files or run commands, which belong to local includes
+	if isRemoteConfig(abs) {
+		for name, cred := range layer.Credentials {
+			if cred != nil && (cred.PasswordCommand != "" || cred.PasswordFile != "") {
+				return stacktrace.NewError("credential '%s': passwordCommand and passwordFile are not allowed in a remote config, use a local include", name)
+			}
+		}
+	}
+	// included files are applied first, so current file overrides them
+	for _, pattern := range layer.Include {
+		// includes of a remote config are local files, relative to current directory
+		if !filepath.IsAbs(pattern) && !isRemoteConfig(abs) {
+			pattern = filepath.Join(filepath.Dir(abs), pattern)
+		}
+		pattern, _ = filepath.Abs(pattern)
+		matches := []string{pattern}
+		// a glob may match no file, but a file must exist
+		if strings.ContainsAny(pattern, "*?[") {
+			c.includes = append(c.includes, pattern)
+			matches, err = filepath.Glob(pattern)
+			if err != nil {
+				return stacktrace.Propagate(err, "invalid include '%s'", pattern)
+			}
+		}
+		for _, match := range matches {
+			err = c.readLayer(match, visiting)
+			if err != nil {
+				return stacktrace.Propagate(err, "unable to include '%s'", match)
+			}
+		}
+	}
+	c.conf.merge(&layer, keys, filename)
+	return nil
+}
+
+// read a local file, or a remote config
+func (c *Config) readLayerContent(filename string) (string, []byte, error) {
+	if isRemoteConfig(filename) {
+		httpClient, err := c.newRemoteHttpClient()
+		if err != nil {
+			return "", nil, err // no wrap
+		}
+		content, err := remoteConfig.read(filename, httpClient)
+		return filename, content, err
+	}
+	abs, err := filepath.Abs(filename)
+	if err != nil {
+		return "", nil, stacktrace.Propagate(err, "unable to read file")
+	}
+	content, err := os.ReadFile(abs)
+	if err != nil {
+		return "", nil, stacktrace.Propagate(err, "unable to read file")
+	}
+	// only local files are watched
+	if !slices.Contains(c.files, abs) {
+		c.files = append(c.files, abs)
+	}
+	return abs, content, nil
+}
+
+// unmarshal a yaml or json config, returning the keys that are set, lower-cased for json as json is case-insensitive,
+// and the unknown fields found by a strict decoding
+func unmarshalConf(content string, conf *Conf) (map[string]bool, []string, error) {
+	keys := map[string]bool{}
+	var unknown []string
+	if strings.HasPrefix(strings.TrimSpace(content), "{") {
+		var values map[string]any
+		err := json.Unmarshal([]byte(content), &values)
+		if err != nil {
+			return nil, nil, err // no wrap
+		}
+		for key := range values {
+			keys["json:"+strings.ToLower(key)] = true
+		}
+		err = json.Unmarshal([]byte(content), conf)
+		if err != nil {
+			return nil, nil, err // no wrap
+		}
+		// json decoder stops on first unknown field
+		decoder := json.NewDecoder(strings.NewReader(content))
+		decoder.DisallowUnknownFields()
+		if err = decoder.Decode(&Conf{}); err != nil {
+			unknown = append(unknown, err.Error())
+		}
+		return keys, unknown, nil
+	}
+	var values map[string]any
+	err := yaml2.Unmarshal([]byte(content), &values)
+	if err != nil {
+		return nil, nil, err // no wrap
+	}
+	for key := range values {
+		keys["yaml:"+key] = true
+	}
+	err = yaml2.Unmarshal([]byte(content), conf)
+	if err != nil {
+		return nil, nil, err // no wrap
+	}
+	var typeError *yaml2.TypeError
+	if err = yaml2.UnmarshalStrict([]byte(content), &Conf{}); errors.As(err, &typeError) {
+		unknown = typeError.Errors
+	}
+	return keys, unknown, nil
+}
+
+var yamlLineRegex = regexp.MustCompile(`^line (\d+): `)
+
+// unknown field of a config file, with its line when known
+func newUnknownField(filename string, message string) ConfigIssue {
+	issue := ConfigIssue{file: filename}
+	if match := yamlLineRegex.FindStringSubmatch(message); match != nil {
+		issue.line, _ = strconv.Atoi(match[1])
+		message = message[len(match[0]):]
+	}
+	issue.err = stacktrace.NewError("%s", message)
+	return issue
+}
+
+// copy struct fields, like kerberosCache or pool
+func (c *Conf) inheritStructs(from *Conf) {
+	dst := reflect.ValueOf(c).Elem()
+	src := reflect.ValueOf(from).Elem()
+	for i := 0; i < dst.NumField(); i++ {
+		if field := dst.Type().Field(i); field.IsExported() && field.Type.Kind() == reflect.Struct {
+			dst.Field(i).Set(src.Field(i))
+		}
+	}
+}
+
+// merge the keys set in a layer, recording the file they come from
+func (c *Conf) merge(layer *Conf, keys map[string]bool, file string) {
+	if c.sources == nil {
+		c.sources = map[string]string{}
+	}
+	dst := reflect.ValueOf(c).Elem()
+	src := reflect.ValueOf(layer).Elem()
+	for i := 0; i < dst.NumField(); i++ {
+		field := dst.Type().Field(i)
+		if !field.IsExported() || field.Name == "Include" || field.Name == "PrependRules" || field.Name == "AppendRules" {
+			continue
+		}
+		yamlKey, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+		if yamlKey == "" {
+			yamlKey = strings.ToLower(field.Name)
+		}
+		if !keys["yaml:"+yamlKey] && !keys["json:"+strings.ToLower(field.Name)] {
+			continue
+		}
+		if field.Type.Kind() == reflect.Map && !src.Field(i).IsNil() {
+			if dst.Field(i).IsNil() {
+				dst.Field(i).Set(reflect.MakeMap(field.Type))
+			}
+			iter := src.Field(i).MapRange()
+			for iter.Next() {
+				dst.Field(i).SetMapIndex(iter.Key(), iter.Value())
+				c.sources[yamlKey+"."+iter.Key().String()] = file
+			}
+			continue
+		}
+		dst.Field(i).Set(src.Field(i))
+		c.sources[yamlKey] = file
+		if field.Name == "Rules" {
+			c.ruleSources = ruleSources(file, "rules", layer.Rules)
+		}
+	}
+	c.Rules = slices.Concat(layer.PrependRules, c.Rules, layer.AppendRules)
+	c.ruleSources = slices.Concat(ruleSources(file, "prependRules", layer.PrependRules), c.ruleSources, ruleSources(file, "appendRules", layer.AppendRules))
+}
+
+// sources of the rules of a yaml key
+func ruleSources(file string, key string, rules []*ConfRule) []ConfSource {
+	sources := make([]ConfSource, len(rules))
+	for i := range rules {
+		sources[i] = ConfSource{file: file, path: []string{key, strconv.Itoa(i)}}
+	}
+	return sources
+}
+
+// file and yaml path in this file of a config entry, or an empty file if it is not read from a file
+func (c *Conf) source(path []string) (string, []string) {
+	if len(path) > 1 && path[0] == "rules" {
+		if i, err := strconv.Atoi(path[1]); err == nil && i < len(c.ruleSources) && len(c.ruleSources) == len(c.Rules) {
+			return c.ruleSources[i].file, slices.Concat(c.ruleSources[i].path, path[2:])
+		}
+		return "", path
+	}
+	if len(path) > 1 {
+		if file, ok := c.sources[path[0]+"."+path[1]]; ok {
+			return file, path
+		}
+	}
+	if len(path) > 0 {
+		if file, ok := c.sources[path[0]]; ok {
+			return file, path
+		}
+	}
+	return "", path
+}
+
+// directories to watch for config changes: directories of all files and of include globs
+func (c *Config) watchPaths() []string {
+	paths := c.globDirs()
+	for _, file := range c.files {
+		paths = append(paths, filepath.Dir(file))
+	}
+	slices.Sort(paths)
+	return slices.Compact(paths)
+}
+
+// directories of include globs, changed when a file is added or removed
+func (c *Config) globDirs() []string {
+	var dirs []string
+	for _, pattern := range c.includes {
+		if dir := filepath.Dir(pattern); !strings.ContainsAny(dir, "*?[") {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
+
+// check if a file is part of the config, or may be included by a glob
+func (c *Config) isConfigFile(name string) bool {
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		return false
+	}
+	if slices.Contains(c.files, abs) {
+		return true
+	}
+	for _, pattern := range c.includes {
+		if match, _ := filepath.Match(pattern, abs); match {
+			return true
+		}
+	}
+	return false
+}
+
+// last modification time of config files, and of include globs directories to detect new files
+func (c *Config) modTime() time.Time {
+	var modTime time.Time
+	for _, name := range append(slices.Clone(c.files), c.globDirs()...) {
+		stat, err := os.Stat(name)
+		if err == nil && stat.ModTime().After(modTime) {
+			modTime = stat.ModTime()
+		}
+	}
+	return modTime
+}
@@ -4,18 +4,65 @@ import (
 	"crypto/sha1"
 	"encoding/base64"
 	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
 	"github.com/jcmturner/gokrb5/v8/client"
 	"github.com/jcmturner/gokrb5/v8/krberror"
 	"github.com/jcmturner/gokrb5/v8/spnego"
 	"github.com/palantir/stacktrace"
-	"strings"
-	"sync"
 )
 
+/*
+KerberosStore is a bounded cache of kerberos identities, keyed by user/realm/password:
+- successful logins are cached and evicted when idle or when the cache is full (least recently used first)
+- failed logins are cached, and not retried before an exponential backoff, to prevent locking accounts
+- a user is locked out for some time after too many failed logins, whatever the password used
+- concurrent logins for the same user/realm/password are merged, later callers waiting for the first result
+*/
 type KerberosStore struct {
 	kerberos     *Kerberos
 	clients      map[string]*KerberosClient
+	failures     map[string]*KerberosFailure
+	users        map[string]*KerberosUser
+	logins       map[string]*KerberosLogin // logins in progress
 	clientsMutex sync.Mutex
+	cache        ConfKerberosCache
+	stats        KerberosStats
+}
+
+// KerberosFailure is a failed login for a user/realm/password
+type KerberosFailure struct {
+	count int
+	next  time.Time
+	err   error
+}
+
+// KerberosLogin is a login in progress, its result being shared with callers waiting for done
+type KerberosLogin struct {
+	done   chan struct{}
+	client *KerberosClient
+	err    error
+}
+
+// KerberosUser counts failed logins for a user/realm, whatever the password
+type KerberosUser struct {
+	count  int
+	last   time.Time
+	locked time.Time
+}
+
+type KerberosStats struct {
+	hits      atomic.Int64
+	misses    atomic.Int64
+	logins    atomic.Int64
+	failures  atomic.Int64
+	backoffs  atomic.Int64
+	lockouts  atomic.Int64
+	evictions atomic.Int64
 }
 
 func NewKerberosStore(config *Config) (*KerberosStore, error) {
@@ -24,35 +71,131 @@ func NewKerberosStore(config *Config) (*KerberosStore, error) {
 	if err != nil {
 		return nil, stacktrace.Propagate(err, "unable to initialize kerberos")
 	}
+	return newKerberosStore(kerberos, config.conf.KerberosCache), nil
+}
+
+func newKerberosStore(kerberos *Kerberos, cache ConfKerberosCache) *KerberosStore {
 	return &KerberosStore{
 		kerberos: kerberos,
 		clients:  make(map[string]*KerberosClient),
-	}, nil
+		failures: make(map[string]*KerberosFailure),
+		users:    make(map[string]*KerberosUser),
+		logins:   make(map[string]*KerberosLogin),
+		cache:    cache,
+	}
+}
+
+// update cache settings on config reload
+func (ks *KerberosStore) safeSetCache(cache ConfKerberosCache) {
+	ks.clientsMutex.Lock()
+	ks.cache = cache
+	ks.clientsMutex.Unlock()
 }
 
 func (ks *KerberosStore) safeGetClient(key string) *KerberosClient {
 	ks.clientsMutex.Lock()
 	cl := ks.clients[key]
+	if cl != nil {
+		cl.lastUsed = time.Now()
+	}
 	ks.clientsMutex.Unlock()
 	return cl
 }
 
 func (ks *KerberosStore) safeSaveClient(key string, client *KerberosClient) {
 	ks.clientsMutex.Lock()
+	defer ks.clientsMutex.Unlock()
+	client.lastUsed = time.Now()
 	ks.clients[key] = client
-	ks.clientsMutex.Unlock()
+	// evict least recently used clients if cache is full
+	for ks.cache.MaxClients > 0 && len(ks.clients) > ks.cache.MaxClients {
+		oldestKey := ""
+		var oldest time.Time
+		for k, cl := range ks.clients {
+			if k != key && (oldestKey == "" || cl.lastUsed.Before(oldest)) {
+				oldestKey = k
+				oldest = cl.lastUsed
+			}
+		}
+		if oldestKey == "" {
+			break
+		}
+		delete(ks.clients, oldestKey)
+		ks.stats.evictions.Add(1)
+	}
 }
 
 func (ks *KerberosStore) safeRemoveClient(key string) {
 	ks.clientsMutex.Lock()
-	ks.clients[key] = nil
+	delete(ks.clients, key)
 	ks.clientsMutex.Unlock()
 }
 
+// Check if a login can be tried, returning an error if the last login with the same password failed recently or if the user is locked
+func (ks *KerberosStore) safeCheckLogin(key, userKey string) error {
+	ks.clientsMutex.Lock()
+	defer ks.clientsMutex.Unlock()
+	now := time.Now()
+	if user := ks.users[userKey]; user != nil && now.Before(user.locked) {
+		ks.stats.lockouts.Add(1)
+		return stacktrace.NewError("Login for user '%s' is locked for %s after %d failed logins", strings.ReplaceAll(userKey, "\x00", "@"), user.locked.Sub(now).Round(time.Second), user.count)
+	}
+	if failure := ks.failures[key]; failure != nil && now.Before(failure.next) {
+		ks.stats.backoffs.Add(1)
+		return stacktrace.Propagate(failure.err, "Login for user '%s' is suspended for %s after %d failed logins", strings.ReplaceAll(userKey, "\x00", "@"), failure.next.Sub(now).Round(time.Second), failure.count)
+	}
+	return nil
+}
+
+// Save a failed login, to back off from retrying the same password and to lock out the user after too many failures
+func (ks *KerberosStore) safeFailedLogin(key, userKey string, err error) {
+	ks.clientsMutex.Lock()
+	defer ks.clientsMutex.Unlock()
+	ks.stats.failures.Add(1)
+	now := time.Now()
+	// exponential backoff for this password
+	failure := ks.failures[key]
+	if failure == nil {
+		failure = &KerberosFailure{}
+		ks.failures[key] = failure
+	}
+	failure.count++
+	failure.err = err
+	backoff := time.Duration(ks.cache.FailureBackoff) * time.Second
+	for i := 1; i < failure.count && backoff < time.Duration(ks.cache.MaxBackoff)*time.Second; i++ {
+		backoff *= 2
+	}
+	if ks.cache.MaxBackoff > 0 && backoff > time.Duration(ks.cache.MaxBackoff)*time.Second {
+		backoff = time.Duration(ks.cache.MaxBackoff) * time.Second
+	}
+	failure.next = now.Add(backoff)
+	// lockout for this user, failures are counted only during lockout time
+	user := ks.users[userKey]
+	if user == nil || now.Sub(user.last) > time.Duration(ks.cache.LockoutTime)*time.Second {
+		user = &KerberosUser{}
+		ks.users[userKey] = user
+	}
+	user.count++
+	user.last = now
+	if ks.cache.LockoutThreshold > 0 && user.count >= ks.cache.LockoutThreshold {
+		user.locked = now.Add(time.Duration(ks.cache.LockoutTime) * time.Second)
+		logInfo("[-] Locking user '%s' for %ds after %d failed logins", strings.ReplaceAll(userKey, "\x00", "@"), ks.cache.LockoutTime, user.count)
+	}
+}
+
+// Save a successful login, resetting failures for this user
+func (ks *KerberosStore) safeSucceededLogin(key, userKey string) {
+	ks.clientsMutex.Lock()
+	defer ks.clientsMutex.Unlock()
+	delete(ks.failures, key)
+	delete(ks.users, userKey)
+}
+
 // Try to login with the given credentials, only if not yet logged in
 func (ks *KerberosStore) safeTryLogin(username, realm, password string, force bool) (*KerberosClient, error) {
 	// create key
 	key := ks.clientKey(username, realm, password)
+	userKey := ks.userKey(username, realm)
 	// remove client to force login?
 	if force {
 		ks.safeRemoveClient(key)
@@ -60,22 +203,67 @@ func (ks *KerberosStore) safeTryLogin(username, realm, password string, force bo
 	// get existing client
 	kcl := ks.safeGetClient(key)
 	if kcl != nil {
+		ks.stats.hits.Add(1)
 		return kcl, nil
 	}
+	ks.stats.misses.Add(1)
+	return ks.safeShareLogin(key, func() (*KerberosClient, error) {
+		return ks.login(username, realm, password, key, userKey)
+	})
+}
+
+// Run a login once for concurrent callers with the same key, later callers waiting for the result of the first one
+func (ks *KerberosStore) safeShareLogin(key string, login func() (*KerberosClient, error)) (*KerberosClient, error) {
+	ks.clientsMutex.Lock()
+	if current := ks.logins[key]; current != nil {
+		ks.clientsMutex.Unlock()
+		<-current.done
+		return current.client, current.err
+	}
+	// a login may have ended since the client was looked up
+	if cl := ks.clients[key]; cl != nil {
+		ks.clientsMutex.Unlock()
+		return cl, nil
+	}
+	current := &KerberosLogin{done: make(chan struct{})}
+	ks.logins[key] = current
+	ks.clientsMutex.Unlock()
+	defer func() {
+		ks.clientsMutex.Lock()
+		delete(ks.logins, key)
+		ks.clientsMutex.Unlock()
+		close(current.done)
+	}()
+	current.client, current.err = login()
+	return current.client, current.err
+}
+
+// Login with the given credentials, saving the client on success
+func (ks *KerberosStore) login(username, realm, password, key, userKey string) (*KerberosClient, error) {
+	// do not retry a failed login too early
+	err := ks.safeCheckLogin(key, userKey)
+	if err != nil {
+		return nil, err // no wrap
+	}
 	// create new client
 	krbClient := ks.kerberos.NewWithPassword(username, realm, password)
 	if krbClient == nil {
 		return nil, nil
 	}
-	err := krbClient.Login()
+	ks.stats.logins.Add(1)
+	err = krbClient.Login()
 	if err != nil {
 		if e, ok := err.(krberror.Krberror); ok {
-			return nil, stacktrace.Propagate(err, "Invalid login/password for user '%s' on realm '%s'\n%s\n%s", username, realm, e.RootCause, strings.Join(e.EText, "\n"))
+			err = stacktrace.Propagate(err, "Invalid login/password for user '%s' on realm '%s'\n%s\n%s", username, realm, e.RootCause, strings.Join(e.EText, "\n"))
+		} else {
+			err = stacktrace.Propagate(err, "Invalid login/password for user '%s' on realm '%s'", username, realm)
 		}
-		return nil, stacktrace.Propagate(err, "Invalid login/password for user '%s' on realm '%s'", username, realm)
+		ks.safeFailedLogin(key, userKey, err)
+		return nil, err
 	}
+	ks.safeSucceededLogin(key, userKey)
 	// save client
-	kcl = NewKerberosClient(krbClient)
+	kcl := NewKerberosClient(krbClient)
 	ks.safeSaveClient(key, kcl)
 	return kcl, nil
 }
@@ -105,6 +293,61 @@ func (ks *KerberosStore) safeGetToken(username, realm, password, protocol string
 	return token, nil
 }
 
+// remove idle clients and expired failures
+func (ks *KerberosStore) vacuum() {
+	ks.clientsMutex.Lock()
+	defer ks.clientsMutex.Unlock()
+	now := time.Now()
+	count := 0
+	if ks.cache.IdleTimeout > 0 {
+		idle := time.Duration(ks.cache.IdleTimeout) * time.Second
+		for key, cl := range ks.clients {
+			if now.Sub(cl.lastUsed) > idle {
+				delete(ks.clients, key)
+				count++
+			}
+		}
+	}
+	ks.stats.evictions.Add(int64(count))
+	for key, failure := range ks.failures {
+		if now.Sub(failure.next) > time.Duration(ks.cache.MaxBackoff)*time.Second {
+			delete(ks.failures, key)
+		}
+	}
+	for key, user := range ks.users {
+		if now.After(user.locked) && now.Sub(user.last) > time.Duration(ks.cache.LockoutTime)*time.Second {
+			delete(ks.users, key)
+		}
+	}
+	if trace {
+		logInfo("%d kerberos clients removed from cache, %d remaining", count, len(ks.clients))
+	}
+}
+
+func (ks *KerberosStore) metrics(w io.Writer) {
+	ks.clientsMutex.Lock()
+	clients := len(ks.clients)
+	failures := len(ks.failures)
+	locked := 0
+	now := time.Now()
+	for _, user := range ks.users {
+		if now.Before(user.locked) {
+			locked++
+		}
+	}
+	ks.clientsMutex.Unlock()
+	_, _ = fmt.Fprintf(w, "kpx_kerberos_clients %d\n", clients)
+	_, _ = fmt.Fprintf(w, "kpx_kerberos_failed_passwords %d\n", failures)
+	_, _ = fmt.Fprintf(w, "kpx_kerberos_locked_users %d\n", locked)
+	_, _ = fmt.Fprintf(w, "kpx_kerberos_cache_hits_total %d\n", ks.stats.hits.Load())
+	_, _ = fmt.Fprintf(w, "kpx_kerberos_cache_misses_total %d\n", ks.stats.misses.Load())
+	_, _ = fmt.Fprintf(w, "kpx_kerberos_logins_total %d\n", ks.stats.logins.Load())
+	_, _ = fmt.Fprintf(w, "kpx_kerberos_login_failures_total %d\n", ks.stats.failures.Load())
+	_, _ = fmt.Fprintf(w, "kpx_kerberos_login_backoffs_total %d\n", ks.stats.backoffs.Load())
+	_, _ = fmt.Fprintf(w, "kpx_kerberos_login_lockouts_total %d\n", ks.stats.lockouts.Load())
+	_, _ = fmt.Fprintf(w, "kpx_kerberos_evictions_total %d\n", ks.stats.evictions.Load())
+}
+
 func (ks *KerberosStore) clientKey(username string, realm string, password string) string {
 	hasher := sha1.New()
 	hasher.Write([]byte(password))
@@ -113,9 +356,15 @@ func (ks *KerberosStore) clientKey(username string, realm string, password strin
 	return key
 }
 
+func (ks *KerberosStore) userKey(username string, realm string) string {
+	username, realm = splitUsername(username, realm)
+	return fmt.Sprintf("%s\x00%s", strings.ToLower(username), realm)
+}
+
 type KerberosClient struct {
 	mutex     sync.Mutex
 	krbClient *client.Client
+	lastUsed  time.Time // protected by KerberosStore.clientsMutex
 }
 
 func NewKerberosClient(krbClient *client.Client) *KerberosClient {
@@ -0,0 +1,123 @@
+package kpx
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestKerberosStore() *KerberosStore {
+	return newKerberosStore(nil, ConfKerberosCache{
+		MaxClients:       2,
+		IdleTimeout:      60,
+		FailureBackoff:   30,
+		MaxBackoff:       120,
+		LockoutThreshold: 3,
+		LockoutTime:      600,
+	})
+}
+
+func TestKerberosStoreBackoff(t *testing.T) {
+	ks := newTestKerberosStore()
+	key := ks.clientKey("user", "EXAMPLE.COM", "bad")
+	userKey := ks.userKey("user", "EXAMPLE.COM")
+	if err := ks.safeCheckLogin(key, userKey); err != nil {
+		t.Fatalf("unexpected error before any failure: %v", err)
+	}
+	ks.safeFailedLogin(key, userKey, errors.New("invalid password"))
+	if err := ks.safeCheckLogin(key, userKey); err == nil {
+		t.Fatalf("expected backoff error after a failure")
+	}
+	// another password is not suspended
+	other := ks.clientKey("user", "EXAMPLE.COM", "good")
+	if err := ks.safeCheckLogin(other, userKey); err != nil {
+		t.Fatalf("unexpected error for another password: %v", err)
+	}
+	// backoff doubles and is capped
+	ks.safeFailedLogin(key, userKey, errors.New("invalid password"))
+	ks.safeFailedLogin(key, userKey, errors.New("invalid password"))
+	backoff := time.Until(ks.failures[key].next)
+	if backoff > 120*time.Second || backoff < 110*time.Second {
+		t.Fatalf("unexpected backoff %v", backoff)
+	}
+}
+
+func TestKerberosStoreLockout(t *testing.T) {
+	ks := newTestKerberosStore()
+	userKey := ks.userKey("EUR\\User", "")
+	for _, password := range []string{"a", "b", "c"} {
+		ks.safeFailedLogin(ks.clientKey("EUR\\User", "", password), userKey, errors.New("invalid password"))
+	}
+	if err := ks.safeCheckLogin(ks.clientKey("EUR\\User", "", "d"), ks.userKey("user@eur", "")); err == nil {
+		t.Fatalf("expected user to be locked")
+	}
+	ks.safeSucceededLogin(ks.clientKey("EUR\\User", "", "d"), userKey)
+	if err := ks.safeCheckLogin(ks.clientKey("EUR\\User", "", "d"), userKey); err != nil {
+		t.Fatalf("unexpected error after success: %v", err)
+	}
+}
+
+func TestKerberosStoreEviction(t *testing.T) {
+	ks := newTestKerberosStore()
+	ks.safeSaveClient("a", &KerberosClient{})
+	ks.safeSaveClient("b", &KerberosClient{})
+	ks.clients["a"].lastUsed = time.Now().Add(-time.Hour)
+	ks.safeSaveClient("c", &KerberosClient{})
+	if len(ks.clients) != 2 || ks.clients["a"] != nil {
+		t.Fatalf("expected least recently used client to be evicted")
+	}
+	ks.clients["b"].lastUsed = time.Now().Add(-time.Hour)
+	ks.vacuum()
+	if len(ks.clients) != 1 || ks.clients["c"] == nil {
+		t.Fatalf("expected idle client to be evicted")
+	}
+	if ks.stats.evictions.Load() != 2 {
+		t.Fatalf("unexpected evictions count %d", ks.stats.evictions.Load())
+	}
+}
+
+func TestKerberosStoreSharedLogin(t *testing.T) {
+	ks := newTestKerberosStore()
+	var logins atomic.Int32
+	started := make(chan struct{})
+	release := make(chan struct{})
+	login := func() (*KerberosClient, error) {
+		if logins.Add(1) == 1 {
+			close(started)
+		}
+		<-release
+		return nil, errors.New("invalid password")
+	}
+	// first login is in progress, other callers wait for its result
+	var wait sync.WaitGroup
+	errs := make(chan error, 5)
+	wait.Add(1)
+	go func() {
+		defer wait.Done()
+		_, err := ks.safeShareLogin("key", login)
+		errs <- err
+	}()
+	<-started
+	for i := 0; i < 4; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			_, err := ks.safeShareLogin("key", login)
+			errs <- err
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wait.Wait()
+	close(errs)
+	for err := range errs {
+		if err == nil || err.Error() != "invalid password" {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if logins.Load() != 1 || len(ks.logins) != 0 {
+		t.Fatalf("expected one login, got %d with %d in progress", logins.Load(), len(ks.logins))
+	}
+}
@@ -0,0 +1,333 @@
+package kpx
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/palantir/stacktrace"
+	"github.com/txthinking/socks5"
+)
+
+/*
+Listeners, each with its own protocol, ACL, rules and inbound authentication:
+- http: http proxy, also serving proxy.pac, metrics and login pages, with HTTP/1.x or HTTP/2 and optional tls
+- socks: socks4/4a/5 proxy
+- transparent: connections redirected by a firewall, target is read from tls client hello or http host header
+- admin: only proxy.pac, metrics and login pages
+*/
+
+var errServerName = errors.New("server name found")
+
+// dialer for upstream connections, with connect timeout, never connecting to kpx itself
+func (p *Process) newDialer() *net.Dialer {
+	return &net.Dialer{Timeout: time.Duration(p.config.conf.ConnectTimeout) * time.Second, Control: p.proxy.rejectSelf}
+}
+
+// reject connections to listeners of kpx, so remote clients can't reach local only pages through the proxy
+func (p *Proxy) rejectSelf(_ string, address string, _ syscall.RawConn) error {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil
+	}
+	p.listenersMutex.Lock()
+	defer p.listenersMutex.Unlock()
+	for _, ln := range p.listeners {
+		addr, ok := ln.Addr().(*net.TCPAddr)
+		if !ok || strconv.Itoa(addr.Port) != port {
+			continue
+		}
+		if addr.IP.Equal(ip) || ip.IsUnspecified() || addr.IP.IsUnspecified() && isLocalIp(ip) {
+			return stacktrace.NewError("connection to %s is not allowed, as it is a %s listener", address, AppName)
+		}
+	}
+	return nil
+}
+
+func isLocalIp(ip net.IP) bool {
+	if ip.IsLoopback() {
+		return true
+	}
+	addrs, _ := net.InterfaceAddrs()
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// serve connections of a listener, using live configuration of the listener for ACL, rules and authentication
+func (p *Proxy) serve(ln net.Listener, listener *ConfListener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			// listener is closed on exit
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		current := p.getConfig().findListener(listener.address())
+		if current == nil {
+			current = listener
+		}
+		// unix sockets are protected by file permissions, not by ACL
+		remoteIp, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+		if _, unix := conn.LocalAddr().(*net.UnixAddr); !unix && !p.isAllowed(remoteIp, current.ACL) {
+			logInfo("[-] Connection from %s to %s is not allowed by ACL", remoteIp, current.address())
+			_ = conn.Close() // force closing client, ignore any error
+			continue
+		}
+		ConfigureConn(conn)
+		if current.tls != nil && (current.Protocol == LISTENER_HTTP || current.Protocol == LISTENER_ADMIN) {
+			conn = tls.Server(conn, current.tls)
+		}
+		if p.stopped() {
+			_ = conn.Close() // force closing client, ignore any error
+			break
+		}
+		if trace {
+			logInfo("new connection")
+		}
+		go func() {
+			c := p.requestsCount.Add(1)
+			if trace {
+				logInfo("connections count=%d", c)
+			}
+			process := NewProcess(p, conn)
+			process.listener = current
+			switch current.Protocol {
+			case LISTENER_SOCKS:
+				process.processSocksConn()
+			case LISTENER_TRANSPARENT:
+				process.processTransparent(originalDst(conn))
+			default:
+				process.processHttpConn()
+			}
+			c = p.requestsCount.Add(-1)
+			if trace {
+				logInfo("connections count=%d", c)
+			}
+		}()
+	}
+}
+
+// open a listener on a tcp port, a unix socket, or a socket passed by systemd
+func (l *ConfListener) listen() (net.Listener, error) {
+	if l.Systemd != "" {
+		return systemdListener(l.Systemd)
+	}
+	if l.Unix == "" {
+		ln, err := net.Listen("tcp4", l.address())
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "unable to listen on %s", l.address())
+		}
+		return ln, nil
+	}
+	// remove socket left by a previous run, but never a regular file
+	if stat, err := os.Lstat(l.Unix); err == nil && stat.Mode()&os.ModeSocket != 0 {
+		_ = os.Remove(l.Unix)
+	}
+	ln, err := net.Listen("unix", l.Unix)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "unable to listen on %s", l.Unix)
+	}
+	err = l.setPermissions()
+	if err != nil {
+		_ = ln.Close()
+		return nil, err // no wrap
+	}
+	return ln, nil
+}
+
+// set unix socket mode and owner
+func (l *ConfListener) setPermissions() error {
+	if l.Mode != "" {
+		mode, _ := strconv.ParseUint(l.Mode, 8, 32)
+		err := os.Chmod(l.Unix, os.FileMode(mode))
+		if err != nil {
+			return stacktrace.Propagate(err, "unable to set mode of %s", l.Unix)
+		}
+	}
+	if l.Owner != "" {
+		uid, gid := -1, -1
+		name, group, _ := strings.Cut(l.Owner, ":")
+		if name != "" {
+			u, err := user.Lookup(name)
+			if err != nil {
+				return stacktrace.Propagate(err, "unable to find user %s", name)
+			}
+			uid, _ = strconv.Atoi(u.Uid)
+		}
+		if group != "" {
+			g, err := user.LookupGroup(group)
+			if err != nil {
+				return stacktrace.Propagate(err, "unable to find group %s", group)
+			}
+			gid, _ = strconv.Atoi(g.Gid)
+		}
+		err := os.Chown(l.Unix, uid, gid)
+		if err != nil {
+			return stacktrace.Propagate(err, "unable to set owner of %s", l.Unix)
+		}
+	}
+	return nil
+}
+
+// log listener address and usage
+func (l *ConfListener) logStart(hostPort string) {
+	name := l.Name
+	if name != "" {
+		name = " '" + name + "'"
+	}
+	switch l.Protocol {
+	case LISTENER_SOCKS:
+		logInfo("[-] Use %s as your socks proxy%s and configure it to use remote dns - curl syntax is 'curl -x socks5h://%s' or 'curl --socks5-hostname %s'", hostPort, name, hostPort, hostPort)
+	case LISTENER_TRANSPARENT:
+		logInfo("[-] Redirect connections to %s to use transparent proxy%s", hostPort, name)
+	case LISTENER_ADMIN:
+		logInfo("[-] Use http://%s/login to enter passwords or http://%s/proxy.pac as your proxy PAC url%s", hostPort, hostPort, name)
+	default:
+		logInfo("[-] Use %s as your http proxy%s or http://%s/proxy.pac as your proxy PAC url", hostPort, name, hostPort)
+	}
+}
+
+// serve a transparent connection, the target being the server name of the tls client hello,
+// or the host header of the http request, with the original destination port if known
+func (p *Process) processTransparent(originalDst string) {
+	p.transparent = true
+	p.originalDst = originalDst
+	// set timeout for reading client hello or http headers
+	p.conn.setTimeout(p.config.conf.ConnectTimeout)
+	first := make([]byte, 1)
+	_, err := io.ReadFull(p.conn, first)
+	if err != nil {
+		_ = p.conn.Close()
+		return
+	}
+	if first[0] != TLS_RECORD_HANDSHAKE {
+		// http request, read again by processHttp
+		p.conn.conn = NewBufferedConn(p.conn.conn, first)
+		p.processHttp()
+		return
+	}
+	// automatically close connection on exit
+	defer func() { _ = p.conn.Close() }()
+	serverName, data := readServerName(io.MultiReader(bytes.NewReader(first), p.conn))
+	// client hello is replayed to the target
+	p.conn.conn = NewBufferedConn(p.conn.conn, data)
+	if serverName == "" {
+		logInfo("[-] Transparent connection from %s failed: no server name in tls client hello", p.conn.RemoteAddr())
+		return
+	}
+	port := "443"
+	if originalDst != "" {
+		_, port, _ = net.SplitHostPort(originalDst)
+	}
+	atyp, addr, portBytes, err := socks5.ParseAddress(net.JoinHostPort(serverName, port))
+	if err != nil {
+		logInfo("[-] Transparent connection from %s failed: %#s", p.conn.RemoteAddr(), err)
+		return
+	}
+	p.conn.setTimeout(0)
+	p.processSocks(&socks5.Request{Ver: socks5.Ver, Cmd: socks5.CmdConnect, Atyp: atyp, DstAddr: addr, DstPort: portBytes})
+}
+
+// connection only used to read the tls client hello, writes are discarded
+type helloConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c *helloConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func (c *helloConn) Write(_ []byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
+
+// read the server name of a tls client hello, returning all the bytes read
+func readServerName(r io.Reader) (string, []byte) {
+	var data bytes.Buffer
+	serverName := ""
+	config := &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			return nil, errServerName
+		},
+	}
+	_ = tls.Server(&helloConn{reader: io.TeeReader(r, &data)}, config).Handshake()
+	return serverName, data.Bytes()
+}
+
+// transparent http request only contains the path, the url is rebuilt from host header or original destination
+func (p *Process) transparentRequestLine(channel *ProxyRequest) error {
+	host := p.originalDst
+	if header := channel.findHeader("host"); header != nil && *header != "" {
+		host = *header
+		// host header has no port when it is the default one
+		if _, _, err := net.SplitHostPort(host); err != nil && p.originalDst != "" {
+			if _, port, _ := net.SplitHostPort(p.originalDst); port != "80" {
+				host = net.JoinHostPort(host, port)
+			}
+		}
+	}
+	if host == "" {
+		return stacktrace.NewError("no host header in transparent request")
+	}
+	header := channel.header
+	header.headers[0] = fmt.Sprintf("%s http://%s%s HTTP/%s", header.method, host, header.url, header.version.Version())
+	return header.analyseRequestLine()
+}
+
+// check basic Proxy-Authorization header against the credential of the listener, if any
+func (p *Process) checkListenerAuth(channel *ProxyRequest) bool {
+	if p.listener == nil || p.listener.Auth == "" || p.listener.Auth == SOCKS_AUTH_NONE {
+		return true
+	}
+	header := channel.findHeader("proxy-authorization")
+	if header == nil || !strings.HasPrefix(strings.ToLower(*header), "basic ") {
+		return false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace((*header)[6:]))
+	if err != nil {
+		return false
+	}
+	login, password, ok := strings.Cut(string(decoded), ":")
+	return ok && p.checkSocksCredential(p.listener.Auth, login, password)
+}
+
+// socks authentication of the listener, or 'socksAuth'
+func (p *Process) socksAuth() string {
+	if p.listener != nil && p.listener.Auth != "" {
+		return p.listener.Auth
+	}
+	return p.config.conf.SocksAuth
+}
+
+// name of the listener for logs and authentication realm
+func (p *Process) listenerName() string {
+	if p.listener == nil {
+		return AppName
+	}
+	if p.listener.Name != "" {
+		return p.listener.Name
+	}
+	return p.listener.Protocol + ":" + strconv.Itoa(p.listener.Port)
+}
@@ -0,0 +1,41 @@
+//go:build linux
+
+package kpx
+
+import (
+	"net"
+	"strconv"
+	"syscall"
+)
+
+// netfilter socket option to get the destination of a redirected connection
+const SO_ORIGINAL_DST = 80
+
+// original destination of a connection redirected by iptables, empty if not redirected
+func originalDst(conn net.Conn) string {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return ""
+	}
+	raw, err := tcpConn.SyscallConn()
+	if err != nil {
+		return ""
+	}
+	var mreq *syscall.IPv6Mreq
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		// sockaddr_in is returned in the ipv6 mreq structure, which has the same size
+		mreq, sockErr = syscall.GetsockoptIPv6Mreq(int(fd), syscall.IPPROTO_IP, SO_ORIGINAL_DST)
+	})
+	if err != nil || sockErr != nil || mreq == nil {
+		return ""
+	}
+	addr := mreq.Multiaddr
+	ip := net.IPv4(addr[4], addr[5], addr[6], addr[7])
+	port := int(addr[2])<<8 | int(addr[3])
+	dst := net.JoinHostPort(ip.String(), strconv.Itoa(port))
+	if dst == conn.LocalAddr().String() {
+		return ""
+	}
+	return dst
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package kpx
+
+import "net"
+
+// original destination of redirected connections is only available on linux
+func originalDst(_ net.Conn) string {
+	return ""
+}
@@ -0,0 +1,236 @@
+package kpx
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/txthinking/socks5"
+)
+
+func TestListenersCheck(t *testing.T) {
+	proxies := "proxies:\n  user:\n    type: basic\n    host: h\n    port: 1\n    credential: \"\"\n" +
+		"credentials:\n  team:\n    login: alice\n    password: secret\n"
+	for _, test := range []struct {
+		config string
+		error  string
+	}{
+		{"listeners:\n  - port: 1\n    protocol: ftp\n", "protocol"},
+		{"listeners:\n  - protocol: http\n", "port"},
+		{"listeners:\n  - port: 1\n  - port: 1\n", "already used"},
+		{"listeners:\n  - port: 1\n    rules: lan\n", "ruleSets"},
+		{"listeners:\n  - port: 1\n    auth: nobody\n", "credential"},
+		{"listeners:\n  - port: 1\n    auth: per-user\n", "only allowed for socks"},
+		{"listeners:\n  - port: 1\n    cert: cert.pem\n", "must be both set"},
+		{"listeners:\n  - port: 1\n    protocol: socks\n    cert: cert.pem\n    key: key.pem\n", "only allowed for http and admin"},
+		{"listeners:\n  - port: 1\n    cert: missing.pem\n    key: missing.pem\n", "unable to load certificate"},
+		{"ruleSets:\n  rules:\n    - host: \"*\"\n      proxy: direct\n", "name cannot be"},
+		{"ruleSets:\n  lan:\n    - host: \"*\"\n      proxy: unknown\n", "rule set 'lan' rule 0"},
+		{proxies + "ruleSets:\n  lan:\n    - host: \"*\"\n      proxy: user\nlisteners:\n  - port: 1\n    rules: lan\n    auth: team\n", "per-user"},
+		{proxies + "ruleSets:\n  lan:\n    - host: \"*\"\n      proxy: user\nlisteners:\n  - port: 1\n    protocol: socks\n    rules: lan\n", "per-user"},
+		{"ruleSets:\n  lan:\n    - host: \"*\"\n      proxy: direct\nlisteners:\n  - port: 1\n    protocol: socks\n    rules: lan\n    auth: per-user\n", "per-user credential"},
+		{"socksPort: 1\nsocksAuth: per-user\nsocksRules:\n  - host: \"*\"\n    proxy: direct\n", "per-user credential"},
+	} {
+		file := filepath.Join(t.TempDir(), "kpx.yaml")
+		_ = os.WriteFile(file, []byte(test.config), 0600)
+		_, err := NewConfig(file)
+		if err == nil || !strings.Contains(err.Error(), test.error) {
+			t.Fatalf("expected error %q, got %v", test.error, err)
+		}
+	}
+	// port and socksPort are listeners too
+	proxy := newTestSocksProxyConfig(t, "port: 8888\nsocksPort: 8889\nacl: [10.0.0.0/8]\n"+
+		"ruleSets:\n  lan:\n    - host: \"*\"\n      proxy: direct\n"+
+		"listeners:\n  - bind: 0.0.0.0\n    port: 3128\n    rules: lan\n  - port: 8080\n    protocol: admin\n    acl: [127.0.0.1]\n")
+	config := proxy.getConfig()
+	var listeners []string
+	for _, listener := range config.conf.listeners {
+		listeners = append(listeners, fmt.Sprintf("%s %s %s %v", listener.Protocol, listener.address(), listener.Rules, listener.ACL))
+	}
+	expected := "http 127.0.0.1:8888 rules [10.0.0.0/8]," +
+		"socks 127.0.0.1:8889 socksRules [10.0.0.0/8]," +
+		"http 0.0.0.0:3128 lan [10.0.0.0/8]," +
+		"admin 127.0.0.1:8080  [127.0.0.1]"
+	if strings.Join(listeners, ",") != expected {
+		t.Fatalf("unexpected listeners: %v", listeners)
+	}
+	if config.adminAddress() != "127.0.0.1:8888" || config.conf.pacProxy != "PROXY 127.0.0.1:8888" {
+		t.Fatalf("unexpected admin address %s or pac proxy %s", config.adminAddress(), config.conf.pacProxy)
+	}
+}
+
+func TestTransparentTls(t *testing.T) {
+	// target reads the client hello, which must be forwarded as is
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = ln.Close() }()
+	serverNames := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		serverName, _ := readServerName(conn)
+		serverNames <- serverName
+		_ = conn.Close()
+	}()
+	proxy := newTestSocksProxyConfig(t, "rules:\n  - host: \"*\"\n    proxy: direct\n    dns: 127.0.0.1\n")
+	server, client := net.Pipe()
+	defer func() { _ = client.Close() }()
+	p := NewProcess(proxy, server)
+	p.listener = &ConfListener{Protocol: LISTENER_TRANSPARENT}
+	go p.processTransparent(ln.Addr().String())
+	_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+	go func() { _ = tls.Client(client, &tls.Config{ServerName: "secure.example.com"}).Handshake() }()
+	select {
+	case serverName := <-serverNames:
+		if serverName != "secure.example.com" {
+			t.Fatalf("unexpected server name %q", serverName)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for client hello")
+	}
+}
+
+func TestOriginalDstNotRedirected(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = ln.Close() }()
+	client, err := net.Dial("tcp4", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = client.Close() }()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn.Close() }()
+	// getsockopt fails without netfilter redirection
+	if dst := originalDst(conn); dst != "" {
+		t.Fatalf("unexpected original destination %q", dst)
+	}
+}
+
+func TestTransparentHttp(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = ln.Close() }()
+	go func() {
+		_ = http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = fmt.Fprintf(w, "%s %s", r.Host, r.URL.Path)
+		}))
+	}()
+	proxy := newTestSocksProxyConfig(t, "rules:\n  - host: \"*\"\n    proxy: direct\n    dns: 127.0.0.1\n")
+	server, client := net.Pipe()
+	defer func() { _ = client.Close() }()
+	p := NewProcess(proxy, server)
+	p.listener = &ConfListener{Protocol: LISTENER_TRANSPARENT}
+	go p.processTransparent(ln.Addr().String())
+	_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = client.Write([]byte("GET /path HTTP/1.1\r\nHost: web.example.com\r\nConnection: close\r\n\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := http.ReadResponse(bufio.NewReader(client), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(response.Body)
+	// host header is forwarded as is, target port being the original destination port
+	if response.StatusCode != 200 || string(body) != "web.example.com /path" {
+		t.Fatalf("unexpected response: %d %q", response.StatusCode, body)
+	}
+}
+
+func TestUnixListener(t *testing.T) {
+	port := newTestEchoServer(t)
+	path := filepath.Join(t.TempDir(), "kpx.sock")
+	// acl does not apply to unix sockets
+	proxy := newTestSocksProxyConfig(t, "acl: [10.0.0.1]\nsocksRules:\n  - host: \"*\"\n    proxy: direct\n    dns: 127.0.0.1\n"+
+		"listeners:\n  - unix: "+path+"\n    mode: \"0600\"\n    protocol: socks\n")
+	listener := proxy.getConfig().conf.listeners[0]
+	ln, err := listener.listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat, err := os.Stat(path)
+	if err != nil || stat.Mode().Perm() != 0600 {
+		t.Fatalf("unexpected socket mode: %v %v", stat, err)
+	}
+	go proxy.serve(ln, listener)
+	client, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = client.Close() }()
+	_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+	socksClientNegotiate(t, client, []byte{socks5.MethodNone}, "", "")
+	_, err = socks5.NewRequest(socks5.CmdConnect, socks5.ATYPDomain, []byte("echo.example.com"), []byte{byte(port >> 8), byte(port)}).WriteTo(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, err := socks5.NewReplyFrom(client)
+	if err != nil || reply.Rep != socks5.RepSuccess {
+		t.Fatalf("unexpected reply: %v %v", reply, err)
+	}
+	expectEcho(t, client)
+}
+
+func TestRejectSelf(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	_ = ln.Close()
+	proxy := newTestSocksProxyConfig(t, fmt.Sprintf("bind: 0.0.0.0\nport: %d\nsocksPort: %d\nrules:\n  - host: \"*\"\n    proxy: direct\n"+
+		"socksRules:\n  - host: \"*\"\n    proxy: direct\n", port, port+1))
+	if err = proxy.updateListeners(proxy.getConfig()); err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.shutdown()
+	// login page can't be reached through the proxy itself
+	address := fmt.Sprint("127.0.0.1:", port)
+	conn, err := net.Dial("tcp4", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn.Close() }()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, _ = fmt.Fprintf(conn, "GET http://%s/login HTTP/1.1\r\nHost: %s\r\n\r\n", address, address)
+	response, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err == nil && response.StatusCode == http.StatusOK {
+		t.Fatalf("unexpected response: %v", response)
+	}
+	// neither through socks, using another local address
+	client, err := net.Dial("tcp4", fmt.Sprint("127.0.0.1:", port+1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = client.Close() }()
+	_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+	socksClientNegotiate(t, client, []byte{socks5.MethodNone}, "", "")
+	_, err = socks5.NewRequest(socks5.CmdConnect, socks5.ATYPIPv4, []byte{127, 0, 0, 2}, []byte{byte(port >> 8), byte(port)}).WriteTo(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, err := socks5.NewReplyFrom(client)
+	if err != nil || reply.Rep == socks5.RepSuccess {
+		t.Fatalf("unexpected reply: %v %v", reply, err)
+	}
+}
@@ -6,6 +6,13 @@ import (
 	"testing"
 )
 
+func TestMain(m *testing.M) {
+	logInit()
+	code := m.Run()
+	logDestroy()
+	os.Exit(code)
+}
+
 func TestLogging(t *testing.T) {
 	logFormat := "%s\nmessage"
 	timeFormat := "2006-01-02 15:04:05"
@@ -30,16 +30,29 @@ It also provides a javascript proxy.pac to be used in browser or system proxy, a
 Usage: {{.AppName}} [-dtv] [-u <user@domain>] [-l <[ip:]port>] [-c <config>] [-k <key>]
        {{.AppName}} [-dtv] [-u <user@domain>] [-l <[ip:]port>] [--timeout <timeout>] [--acl <ips>] <proxy:port>
        {{.AppName}} -e [-k <key>]
+       {{.AppName}} key rotate [-k <key>] [-c <config>]
+       {{.AppName}} login [-u <login>] [-c <config>] <credential>
+       {{.AppName}} check [-c <config>]
+       {{.AppName}} resolve [-c <config>] <url>
+       {{.AppName}} pac [-c <config>]
+       {{.AppName}} schema
 
 Use the first form to start the proxy with a configuration file, and the second form to start the proxy with a single proxy.
 In second form, the upstream proxy is of type 'kerberos' if a user is provided, and 'anonymous' otherwise, unless port number is 0 and in that case it is 'direct'.
 The third form is used to encrypt a password, using the encryption key provided by '-k' option.
+The fourth form re-encrypts all passwords of the configuration file, its included files and password files with a new key, keeping backups of the old key and modified files as '.bak' files.
+The fifth form sends a new password for a credential to the running proxy, which validates it before using it, without restarting.
+The last forms never listen nor ask passwords: 'check' validates the configuration file and reports all errors with their line number,
+'resolve' prints the rule, pac result, proxies in failover order and authentication that would be used for an url, 'pac' prints the generated proxy.pac,
+and 'schema' prints the JSON schema of the configuration file, to validate and autocomplete it in editors.
 
 Example:
        {{.AppName}} -u user_login@eur -l 8888 proxy:8080
 
 Options:
-      -c, --config=<config>      config file, in yaml format (defaults to '{{.AppName}}.yaml' then '{{.AppName}}.json')
+      -c, --config=<config>      config file or https url, in yaml format (defaults to '{{.AppName}}.yaml' then '{{.AppName}}.json')
+                                 a remote config is cached on disk to start when offline, and polled every 'remoteInterval' seconds
+          --config-proxy=<url>   proxy used to download a remote config, like http://proxy:8080
       -k, --key=<key>            encryption key location (defaults to '{{.AppName}}.key')
       -l, --listen=<[ip:]port>   listen to this ip port (ip defaults to 127.0.0.1, port defaults to 8080)
       -u, --user=<user@domain>   user for authentication, like login@domain or domain\login
@@ -69,12 +82,22 @@ CONFIG FILE
 A config file can be provided as json or yaml format.
 Content should be similar to this:
 
+# load these files or globs first, relative to this file, then apply this file: 'proxies', 'credentials', 'domains' and other maps
+# are merged by key, other settings are replaced. ${VAR} and ${VAR:-default} are replaced by environment variables in all files
+include:
+  - /etc/kpx/base.yaml
+  - conf.d/*.yaml
 # listen to this ip, use 0.0.0.0 to listen on all ips
 bind: 127.0.0.1
 # listen to this port to serve HTTP requests
 port: 7777
 # listen to this port to serve SOCKS requests
 socksPort: 7778
+# socks authentication: 'none' (default), a credential whose login/password must be used by socks clients,
+# or 'per-user' to forward socks clients username/password to upstream proxies with an empty 'credential', which must then be used by all socks rules
+socksAuth: none
+# idle timeout in seconds of socks UDP associations, defaults to 60
+udpTimeout: 60
 # set verbose to see all requests
 verbose: true
 # set debug to view all requests and responses headers
@@ -87,6 +110,10 @@ connectTimeout: 10
 idleTimeout: 0
 # timeout for closing connections after one side closed it, allowing to flush the remaining buffered data
 closeTimeout: 10
+# on exit (SIGTERM, SIGINT, timeout or update), stop accepting connections and wait up to drainTimeout seconds for active ones, defaults to 30
+drainTimeout: 30
+# seconds between polls of the config url, when started with '-c https://...', defaults to 60
+remoteInterval: 60
 # check for updates, defaults to true
 check: true
 # automatically update, defaults to false
@@ -95,10 +122,39 @@ update: false
 restart: false
 # use proxy environment variables for downloading updates and pac files, defaults to false
 useEnvProxy: false
+# unknown fields, like misspelled ones, are reported as warnings, or as errors in strict mode
+strict: false
+# reject ambiguous or malformed http messages (RFC 9112), like both content-length and transfer-encoding, obsolete line folding or bare LF, defaults to false
+strictHttp: false
 # experimental features, defaults to none
-experimental: connection-pools hosts-cache
+experimental: hosts-cache
 # experimental console ui
 ui: false
+# kerberos identity cache, mostly used by per-user credentials, all values are optional
+kerberosCache:
+  # max number of cached identities, least recently used are evicted first
+  maxClients: 1000
+  # evict identities unused for this number of seconds
+  idleTimeout: 3600
+  # do not retry a failed password before this number of seconds, doubled on each failure up to maxBackoff
+  failureBackoff: 30
+  maxBackoff: 900
+  # lock a user for lockoutTime seconds after lockoutThreshold failed logins, whatever the password, to prevent locking the account
+  lockoutThreshold: 3
+  lockoutTime: 1800
+# pool of upstream connections, reused by http requests to the same proxy or server, all values are optional
+pool:
+  # max idle connections kept per upstream
+  maxIdle: 8
+  # max connections per upstream, in use or idle, 0 for no limit. requests wait up to connectTimeout for a free one
+  maxTotal: 0
+  # close connections idle for this number of seconds
+  idleTimeout: 30
+
+# suspend a configured credential for credentialSuspend seconds after credentialFailures failures, instead of using it again
+# an invalid kerberos password suspends it until a new password is set in the configuration file or posted to the proxy
+credentialFailures: 3
+credentialSuspend: 300
 
 # list of proxies
 proxies:
@@ -145,11 +201,21 @@ proxies:
     host: 127.0.0.1
     port: 3128
 	ssl: false
-# sample of socks proxy
+# sample of socks proxy. 'socksVersion' is 5 (default) or 4, 'ssl' for socks over tls
+# 'resolve' is remote (default) to send host names to the proxy (socks5h/socks4a), or local to send ip addresses
   nets:
     type: socks
     host: localhost
     port: 1080
+    socksVersion: 5
+    resolve: remote
+# sample of proxy chaining: 'via' is the proxy used to reach this proxy, using CONNECT or socks with its credential
+# chains can be of any length, 'via' proxies must not be pac or per-user proxies
+  partner:
+    type: socks
+    host: socks.partner.com
+    port: 1080
+    via: mkt
   dev:
     type: anonymous
     host: localhost
@@ -173,6 +239,17 @@ credentials:
   user:
     login: a443939
     password: encrypted:SECRET_KEY
+# password can also be read from an environment variable, a file, or the first line of a command output
+# the command is run again on reload, or when the proxy rejects the password
+  user2:
+    login: a443939
+    passwordEnv: KPX_PASSWORD
+  user3:
+    login: a443939
+    passwordFile: /run/secrets/kpx
+  user4:
+    login: a443939
+    passwordCommand: pass show proxy
 
 # list of rules to determine which proxy to use for HTTP proxy
 rules:
@@ -197,6 +274,7 @@ rules:
     proxy: mkt
     verbose: true
 # sample: use mitm to have man-int-the-middle hijacked connections, CA is written in {{.AppName}}.ca.crt
+# the protocol offered by the client (http/2 or http/1.1) is negotiated with the server, and each http/2 stream is logged
   - host: "update.microsoft.com"
     proxy: mkt
     verbose: true
@@ -220,16 +298,57 @@ socksRules:
   - host: "*"
     proxy: net
 
+# rules added before and after the 'rules' of included files
+prependRules:
+  - host: "*.lab.local"
+    proxy: direct
+appendRules:
+  - host: "*"
+    proxy: none
+
 # list some domain aliases, allowing to use 'EUR' instead of 'EUR.MSD.WORLD.COMPANY'
 domains:
   EUR: EUR.MSD.WORLD.COMPANY
   ASI: ASI.MSD.WORLD.COMPANY
   AME: AME.MSD.WORLD.COMPANY
 
-# list of IPs who is allowed to connect. If empty - everybody is allowed
+# list of IPs who is allowed to connect to http and socks ports, and listeners without 'acl'. If empty - everybody is allowed
 acl:
   - 127.0.0.1
   - 192.168.0.1
+
+# named rule sets, used by listeners in addition to 'rules' and 'socksRules'
+ruleSets:
+  lan:
+    - host: "*"
+      proxy: mkt
+
+# additional listeners, 'port' and 'socksPort' being listeners with global settings
+# protocol is http (default), socks, transparent (connections redirected by iptables) or admin (pac and login pages only)
+# 'rules' defaults to 'rules', or 'socksRules' for socks listeners, and 'acl' defaults to the global 'acl'
+# 'auth' is 'none' (default), a credential whose login/password must be used by clients, or 'per-user' for socks listeners
+listeners:
+  - name: team
+    bind: 0.0.0.0
+    port: 3128
+    acl:
+      - 192.168.0.0/16
+    rules: lan
+    auth: user2
+  - port: 7779
+    protocol: transparent
+  - port: 7780
+    protocol: admin
+# unix socket, with optional mode and owner, and socket passed by systemd socket activation (FileDescriptorName= or index)
+  - unix: /run/kpx/kpx.sock
+    mode: "0660"
+    owner: kpx:docker
+  - systemd: kpx-socks
+    protocol: socks
+# https proxy, with http/2 negotiated by ALPN, http listeners also accepting http/2 without tls (h2c prior knowledge)
+  - port: 7443
+    cert: /etc/kpx/proxy.crt
+    key: /etc/kpx/proxy.key
 `
 
 func Main() {
@@ -270,9 +389,11 @@ func version() {
 }
 
 func cmd() {
+	command := findCommand()
 	flag.Usage = usage
 	flag.StringVar(&options.Config, "c", "", "")
 	flag.StringVar(&options.Config, "config", "", "")
+	flag.StringVar(&options.ConfigProxy, "config-proxy", "", "")
 	flag.StringVar(&options.KeyFile, "k", AppName+".key", "")
 	flag.StringVar(&options.KeyFile, "key", AppName+".key", "")
 	flag.StringVar(&options.Listen, "l", "", "")
@@ -304,6 +425,8 @@ func cmd() {
 		version()
 	case options.Encrypt:
 		encryptPassword()
+	case command != nil:
+		command(args)
 	case len(args) == 1 && options.Config != "":
 		println("invalid arguments")
 		usage()
@@ -317,15 +440,7 @@ func cmd() {
 	logPrintf("[-] Proxy %s started\n", VersionValue)
 
 	if options.Proxy == "" {
-		if options.Config == "" {
-			if _, err := os.Stat(AppName + ".yaml"); err == nil {
-				options.Config = AppName + ".yaml"
-			} else if _, err := os.Stat(AppName + ".json"); err == nil {
-				options.Config = AppName + ".json"
-			} else {
-				options.Config = AppName + ".yaml"
-			}
-		}
+		options.Config = defaultConfig()
 		options.Timeout = 0
 	} else {
 		options.Config = ""
@@ -413,6 +528,8 @@ func start() {
 	proxy.consoleUI = proxy.getConfig().conf.ConsoleUI || options.ConsoleUI
 	if proxy.consoleUI {
 		go proxy.ui()
+	} else {
+		go proxy.handleSignals()
 	}
 	// reload task
 	go proxy.watch1()
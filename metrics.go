@@ -0,0 +1,23 @@
+package kpx
+
+import (
+	"fmt"
+	"strings"
+)
+
+// metrics returns all metrics in prometheus text format, served by local web server at '/metrics'
+func (p *Proxy) metrics() string {
+	builder := strings.Builder{}
+	_, _ = fmt.Fprintf(&builder, "kpx_connections %d\n", p.requestsCount.Load())
+	_, _ = fmt.Fprintf(&builder, "kpx_requests_total %d\n", p.newRequestId.Load())
+	if p.kerberos != nil {
+		p.kerberos.metrics(&builder)
+	}
+	if p.credentials != nil {
+		p.credentials.metrics(&builder)
+	}
+	if p.pool != nil {
+		p.pool.metrics(&builder)
+	}
+	return builder.String()
+}
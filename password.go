@@ -1,6 +1,8 @@
 package kpx
 
 import (
+	"bytes"
+	"context"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/md5"
@@ -11,6 +13,13 @@ import (
 	"github.com/howeyc/gopass"
 	"io"
 	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/palantir/stacktrace"
+	"golang.org/x/crypto/scrypt"
 )
 
 func createKey() []byte {
@@ -32,34 +41,80 @@ func readKey() []byte {
 	return key
 }
 
-func createHash() string {
+// v1 key derivation, kept to decrypt old passwords
+func createHash(key []byte) string {
 	hasher := md5.New()
-	hasher.Write(readKey())
+	hasher.Write(key)
 	return hex.EncodeToString(hasher.Sum(nil))
 }
 
+// v2 key derivation, using scrypt with a random salt for each password
+func deriveKey(key []byte, salt []byte) ([]byte, error) {
+	return scrypt.Key(key, salt, SCRYPT_N, SCRYPT_R, SCRYPT_P, 32)
+}
+
 func encrypt(data string) string {
-	block, _ := aes.NewCipher([]byte(createHash()))
-	gcm, err := cipher.NewGCM(block)
+	encrypted, err := encryptWithKey(readKey(), data)
 	if err != nil {
 		panic(err.Error())
 	}
+	return encrypted
+}
+
+// encrypt data with v2 format, returning 'v2:' + base64(salt + nonce + ciphertext)
+func encryptWithKey(key []byte, data string) (string, error) {
+	salt := make([]byte, SCRYPT_SALT_SIZE)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return "", err // no wrap
+	}
+	derived, err := deriveKey(key, salt)
+	if err != nil {
+		return "", err // no wrap
+	}
+	block, err := aes.NewCipher(derived)
+	if err != nil {
+		return "", err // no wrap
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err // no wrap
+	}
 	nonce := make([]byte, gcm.NonceSize())
 	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
-		panic(err.Error())
+		return "", err // no wrap
 	}
-	ciphertext := gcm.Seal(nonce, nonce, []byte(data), nil)
-	encrypted := base64.StdEncoding.EncodeToString(ciphertext)
-	return encrypted
+	ciphertext := gcm.Seal(append(salt, nonce...), nonce, []byte(data), nil)
+	return ENCRYPTED_V2 + base64.StdEncoding.EncodeToString(ciphertext), nil
 }
 
 func decrypt(data string) (string, error) {
+	return decryptWithKey(readKey(), data)
+}
+
+// decrypt data, either in v2 format 'v2:...' or in original v1 format
+func decryptWithKey(key []byte, data string) (string, error) {
+	v2 := strings.HasPrefix(data, ENCRYPTED_V2)
+	if v2 {
+		data = data[len(ENCRYPTED_V2):]
+	}
 	encoded, err := base64.StdEncoding.DecodeString(data)
 	if err != nil {
 		return "", err
 	}
-	key := []byte(createHash())
-	block, err := aes.NewCipher(key)
+	var derived []byte
+	if v2 {
+		if len(encoded) < SCRYPT_SALT_SIZE {
+			return "", stacktrace.NewError("invalid encrypted data")
+		}
+		derived, err = deriveKey(key, encoded[:SCRYPT_SALT_SIZE])
+		if err != nil {
+			return "", err
+		}
+		encoded = encoded[SCRYPT_SALT_SIZE:]
+	} else {
+		derived = []byte(createHash(key))
+	}
+	block, err := aes.NewCipher(derived)
 	if err != nil {
 		return "", err
 	}
@@ -68,6 +123,9 @@ func decrypt(data string) (string, error) {
 		return "", err
 	}
 	nonceSize := gcm.NonceSize()
+	if len(encoded) < nonceSize {
+		return "", stacktrace.NewError("invalid encrypted data")
+	}
 	nonce, ciphertext := encoded[:nonceSize], encoded[nonceSize:]
 	decrypted, err := gcm.Open(nil, nonce, ciphertext, nil)
 	if err != nil {
@@ -86,3 +144,67 @@ func encryptPassword() {
 	fmt.Printf("Encrypted: %s%s\n", ENCRYPTED, encrypt(string(pwdBytes)))
 	os.Exit(0)
 }
+
+// read password from the configured source, which can then also be encrypted
+func (cred *ConfCred) readPassword() (*string, error) {
+	var password string
+	switch {
+	case cred.PasswordEnv != "":
+		value, ok := os.LookupEnv(cred.PasswordEnv)
+		if !ok {
+			return nil, stacktrace.NewError("environment variable '%s' is not set", cred.PasswordEnv)
+		}
+		password = value
+	case cred.PasswordFile != "":
+		value, err := os.ReadFile(cred.PasswordFile)
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "unable to read password file '%s'", cred.PasswordFile)
+		}
+		password = strings.TrimRight(string(value), "\r\n")
+	case cred.PasswordCommand != "":
+		value, err := runPasswordCommand(cred.PasswordCommand)
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "unable to run password command")
+		}
+		password = value
+	default:
+		if cred.Password == nil {
+			return nil, nil
+		}
+		password = *cred.Password
+	}
+	if strings.HasPrefix(password, ENCRYPTED) {
+		decrypted, err := decrypt(password[len(ENCRYPTED):])
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "unable to decrypt password")
+		}
+		password = decrypted
+	}
+	return &password, nil
+}
+
+// run a password helper like 'pass show proxy' or 'vault kv get -field=password secret/proxy', using first line of output
+func runPasswordCommand(command string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), PASSWORD_COMMAND_TIMEOUT*time.Second)
+	defer cancel()
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", command)
+	} else {
+		cmd = exec.CommandContext(ctx, "sh", "-c", command)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	cmd.Stdin = nil
+	// children of the shell may keep stdout open after it is killed
+	cmd.WaitDelay = PASSWORD_COMMAND_WAIT_DELAY * time.Second
+	output, err := cmd.Output()
+	if ctx.Err() != nil {
+		return "", stacktrace.NewError("command timed out after %ds", PASSWORD_COMMAND_TIMEOUT)
+	}
+	if err != nil {
+		return "", stacktrace.Propagate(err, "command failed: %s", strings.TrimSpace(stderr.String()))
+	}
+	password := strings.SplitN(string(output), "\n", 2)[0]
+	return strings.TrimRight(password, "\r"), nil
+}
@@ -0,0 +1,101 @@
+package kpx
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEncryptV2(t *testing.T) {
+	key := createKey()
+	encrypted, err := encryptWithKey(key, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(encrypted, ENCRYPTED_V2) {
+		t.Fatalf("expected v2 format, got %s", encrypted)
+	}
+	decrypted, err := decryptWithKey(key, encrypted)
+	if err != nil || decrypted != "secret" {
+		t.Fatalf("unexpected decrypt result: %q %v", decrypted, err)
+	}
+	if _, err = decryptWithKey(createKey(), encrypted); err == nil {
+		t.Fatalf("expected error with another key")
+	}
+}
+
+func TestDecryptV1(t *testing.T) {
+	key := createKey()
+	block, _ := aes.NewCipher([]byte(createHash(key)))
+	gcm, _ := cipher.NewGCM(block)
+	nonce := make([]byte, gcm.NonceSize())
+	encrypted := base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, []byte("secret"), nil))
+	decrypted, err := decryptWithKey(key, encrypted)
+	if err != nil || decrypted != "secret" {
+		t.Fatalf("unexpected decrypt result: %q %v", decrypted, err)
+	}
+}
+
+func TestReadPassword(t *testing.T) {
+	t.Setenv("KPX_TEST_PASSWORD", "from-env")
+	file := filepath.Join(t.TempDir(), "password")
+	_ = os.WriteFile(file, []byte("from-file\n"), 0600)
+	for _, test := range []struct {
+		cred     *ConfCred
+		expected string
+	}{
+		{&ConfCred{PasswordEnv: "KPX_TEST_PASSWORD"}, "from-env"},
+		{&ConfCred{PasswordFile: file}, "from-file"},
+		{&ConfCred{PasswordCommand: "echo from-command"}, "from-command"},
+	} {
+		password, err := test.cred.readPassword()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if password == nil || *password != test.expected {
+			t.Fatalf("expected %q, got %v", test.expected, password)
+		}
+	}
+	cred := ConfCred{PasswordCommand: "exit 1"}
+	if _, err := cred.readPassword(); err == nil {
+		t.Fatalf("expected error for failing command")
+	}
+}
+
+func TestEncryptedRegex(t *testing.T) {
+	content := "password: encrypted:v2:ab+/cd==\nother: encrypted:AbC=\n"
+	matches := encryptedRegex.FindAllString(content, -1)
+	if len(matches) != 2 || matches[0] != "encrypted:v2:ab+/cd==" || matches[1] != "encrypted:AbC=" {
+		t.Fatalf("unexpected matches: %v", matches)
+	}
+}
+
+func TestRotateContent(t *testing.T) {
+	oldKey, newKey := createKey(), createKey()
+	encrypted, err := encryptWithKey(oldKey, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// password file content, with a trailing newline
+	rotated, count, err := rotateContent(oldKey, newKey, ENCRYPTED+encrypted+"\n")
+	if err != nil || count != 1 || !strings.HasSuffix(rotated, "\n") {
+		t.Fatalf("unexpected rotation: %q %d %v", rotated, count, err)
+	}
+	password, err := decryptWithKey(newKey, strings.TrimSpace(rotated)[len(ENCRYPTED):])
+	if err != nil || password != "secret" {
+		t.Fatalf("unexpected password: %q %v", password, err)
+	}
+	// plain passwords are kept
+	rotated, count, err = rotateContent(oldKey, newKey, "plain\n")
+	if err != nil || count != 0 || rotated != "plain\n" {
+		t.Fatalf("unexpected rotation: %q %d %v", rotated, count, err)
+	}
+	_, _, err = rotateContent(newKey, oldKey, ENCRYPTED+encrypted)
+	if err == nil {
+		t.Fatalf("expected decryption error")
+	}
+}
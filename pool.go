@@ -0,0 +1,255 @@
+package kpx
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/palantir/stacktrace"
+)
+
+/*
+Upstream connection pool, reusing http connections to proxies and servers:
+- connections are pooled by key: upstream address, authentication context, and target host for servers and tunnels
+- at most 'maxIdle' idle connections and 'maxTotal' connections in use or idle per key, waiting up to connectTimeout for a free one
+- idle connections are closed after 'idleTimeout' seconds
+- an idle connection is checked before reuse, and discarded if closed by peer or if it has unexpected data to read
+*/
+
+type ConnPool struct {
+	mutex    sync.Mutex
+	idle     map[string][]*PooledConn // idle connections by key, most recently used last
+	total    map[string]int           // idle and in use connections by key
+	released chan struct{}            // closed and replaced when a connection is released, to wake up waiting requests
+	conf     ConfPool
+	stats    ConnPoolStats
+}
+
+type ConnPoolStats struct {
+	hits     atomic.Int64
+	misses   atomic.Int64
+	waits    atomic.Int64
+	expired  atomic.Int64
+	dead     atomic.Int64
+	overflow atomic.Int64
+}
+
+// PooledConn is a connection of the pool, returned to the pool with release() or discarded with Close()
+type PooledConn struct {
+	net.Conn
+	pool      *ConnPool
+	key       string
+	reqId     int32 // request that created the connection
+	inUse     bool
+	idleSince time.Time
+}
+
+func NewConnPool() *ConnPool {
+	return &ConnPool{
+		idle:     map[string][]*PooledConn{},
+		total:    map[string]int{},
+		released: make(chan struct{}),
+		conf:     ConfPool{MaxIdle: DEFAULT_POOL_MAX_IDLE, MaxTotal: DEFAULT_POOL_MAX_TOTAL, IdleTimeout: DEFAULT_POOL_IDLE_TIMEOUT},
+	}
+}
+
+func (cp *ConnPool) safeSetConf(conf ConfPool) {
+	cp.mutex.Lock()
+	defer cp.mutex.Unlock()
+	cp.conf = conf
+}
+
+// get an idle connection, or dial a new one if none is available.
+// when 'maxTotal' connections are already used, wait up to timeout for one to be released.
+func (cp *ConnPool) get(key string, reqId int32, timeout time.Duration, dial func() (net.Conn, error)) (*PooledConn, bool, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		pc, wait := cp.safeTake(key)
+		if pc != nil {
+			if pc.isAlive() {
+				cp.stats.hits.Add(1)
+				if trace {
+					logInfo("(%d) reusing connection %d from pool", reqId, pc.reqId)
+				}
+				return pc, true, nil
+			}
+			cp.stats.dead.Add(1)
+			if trace {
+				logInfo("(%d) removed closed connection %d from pool", reqId, pc.reqId)
+			}
+			_ = pc.Close()
+			continue
+		}
+		if wait == nil {
+			break
+		}
+		// too many connections, wait for one to be released
+		cp.stats.waits.Add(1)
+		select {
+		case <-wait:
+		case <-time.After(time.Until(deadline)):
+			return nil, false, stacktrace.NewError("too many connections to %s", key)
+		}
+	}
+	cp.stats.misses.Add(1)
+	conn, err := dial()
+	if err != nil {
+		cp.safeRemove(key)
+		return nil, false, err // no wrap
+	}
+	return &PooledConn{Conn: conn, pool: cp, key: key, reqId: reqId, inUse: true}, false, nil
+}
+
+// take the most recently used idle connection, or reserve a new connection.
+// if no connection can be created, return a channel to wait for a release.
+func (cp *ConnPool) safeTake(key string) (*PooledConn, chan struct{}) {
+	cp.mutex.Lock()
+	defer cp.mutex.Unlock()
+	idle := cp.idle[key]
+	if len(idle) > 0 {
+		pc := idle[len(idle)-1]
+		cp.idle[key] = idle[:len(idle)-1]
+		pc.inUse = true
+		return pc, nil
+	}
+	if cp.conf.MaxTotal > 0 && cp.total[key] >= cp.conf.MaxTotal {
+		return nil, cp.released
+	}
+	cp.total[key]++
+	return nil, nil
+}
+
+// remove a connection from the count, waking up waiting requests
+func (cp *ConnPool) safeRemove(key string) {
+	cp.mutex.Lock()
+	defer cp.mutex.Unlock()
+	cp.removeLocked(key)
+}
+
+func (cp *ConnPool) removeLocked(key string) {
+	cp.total[key]--
+	if cp.total[key] <= 0 {
+		delete(cp.total, key)
+	}
+	close(cp.released)
+	cp.released = make(chan struct{})
+}
+
+// return connection to the pool for later reuse, or close it if pool is full or disabled
+func (pc *PooledConn) release(reqId int32) {
+	cp := pc.pool
+	cp.mutex.Lock()
+	if !pc.inUse {
+		cp.mutex.Unlock()
+		return
+	}
+	if len(cp.idle[pc.key]) >= cp.conf.MaxIdle {
+		cp.mutex.Unlock()
+		cp.stats.overflow.Add(1)
+		_ = pc.Close()
+		return
+	}
+	if trace {
+		logInfo("(%d) pushing connection %d to pool for later reuse", reqId, pc.reqId)
+	}
+	pc.inUse = false
+	pc.idleSince = time.Now()
+	_ = pc.Conn.SetDeadline(time.Time{})
+	cp.idle[pc.key] = append(cp.idle[pc.key], pc)
+	close(cp.released)
+	cp.released = make(chan struct{})
+	cp.mutex.Unlock()
+}
+
+// close connection, removing it from the pool
+func (pc *PooledConn) Close() error {
+	cp := pc.pool
+	cp.mutex.Lock()
+	if pc.inUse {
+		pc.inUse = false
+		cp.removeLocked(pc.key)
+	}
+	cp.mutex.Unlock()
+	return pc.Conn.Close()
+}
+
+// check that an idle connection has not been closed by peer, with a non-blocking read:
+// a timeout means there is nothing to read and connection is still open
+func (pc *PooledConn) isAlive() bool {
+	_ = pc.Conn.SetReadDeadline(time.Now())
+	_, err := pc.Conn.Read(make([]byte, 1))
+	_ = pc.Conn.SetReadDeadline(time.Time{})
+	return errors.Is(err, os.ErrDeadlineExceeded)
+}
+
+// close idle connections that have expired
+func (cp *ConnPool) vacuum() {
+	cp.mutex.Lock()
+	expiry := time.Now().Add(-time.Duration(cp.conf.IdleTimeout) * time.Second)
+	var expired []*PooledConn
+	for key, idle := range cp.idle {
+		kept := idle[:0]
+		for _, pc := range idle {
+			if pc.idleSince.Before(expiry) {
+				expired = append(expired, pc)
+				cp.removeLocked(key)
+			} else {
+				kept = append(kept, pc)
+			}
+		}
+		if len(kept) == 0 {
+			delete(cp.idle, key)
+		} else {
+			cp.idle[key] = kept
+		}
+	}
+	cp.mutex.Unlock()
+	for _, pc := range expired {
+		_ = pc.Conn.Close()
+	}
+	cp.stats.expired.Add(int64(len(expired)))
+	if trace && len(expired) > 0 {
+		logInfo("%d connections removed from pool", len(expired))
+	}
+}
+
+// close all idle connections, connections in use being closed when released
+func (cp *ConnPool) close() {
+	cp.mutex.Lock()
+	cp.conf.MaxIdle = 0
+	var idle []*PooledConn
+	for key, conns := range cp.idle {
+		for range conns {
+			cp.removeLocked(key)
+		}
+		idle = append(idle, conns...)
+		delete(cp.idle, key)
+	}
+	cp.mutex.Unlock()
+	for _, pc := range idle {
+		_ = pc.Conn.Close()
+	}
+}
+
+func (cp *ConnPool) metrics(w io.Writer) {
+	cp.mutex.Lock()
+	idle, total := 0, 0
+	for key, count := range cp.total {
+		idle += len(cp.idle[key])
+		total += count
+	}
+	cp.mutex.Unlock()
+	_, _ = fmt.Fprintf(w, "kpx_pool_idle_connections %d\n", idle)
+	_, _ = fmt.Fprintf(w, "kpx_pool_active_connections %d\n", total-idle)
+	_, _ = fmt.Fprintf(w, "kpx_pool_hits_total %d\n", cp.stats.hits.Load())
+	_, _ = fmt.Fprintf(w, "kpx_pool_misses_total %d\n", cp.stats.misses.Load())
+	_, _ = fmt.Fprintf(w, "kpx_pool_waits_total %d\n", cp.stats.waits.Load())
+	_, _ = fmt.Fprintf(w, "kpx_pool_discarded_total{reason=\"expired\"} %d\n", cp.stats.expired.Load())
+	_, _ = fmt.Fprintf(w, "kpx_pool_discarded_total{reason=\"closed\"} %d\n", cp.stats.dead.Load())
+	_, _ = fmt.Fprintf(w, "kpx_pool_discarded_total{reason=\"full\"} %d\n", cp.stats.overflow.Load())
+}
@@ -0,0 +1,75 @@
+package kpx
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConnPool(t *testing.T) {
+	pool := NewConnPool()
+	pool.safeSetConf(ConfPool{MaxIdle: 1, MaxTotal: 2, IdleTimeout: 30})
+	var peers []net.Conn
+	dial := func() (net.Conn, error) {
+		c1, c2 := net.Pipe()
+		peers = append(peers, c2)
+		return c1, nil
+	}
+	// new connection, then reused
+	pc1, reused, err := pool.get("a", 1, time.Second, dial)
+	if err != nil || reused {
+		t.Fatalf("unexpected get: %v %v", reused, err)
+	}
+	pc1.release(1)
+	pc2, reused, _ := pool.get("a", 2, time.Second, dial)
+	if !reused || pc2 != pc1 {
+		t.Fatal("expected reused connection")
+	}
+	// max total reached, waiting for a free connection
+	pc3, _, _ := pool.get("a", 3, time.Second, dial)
+	_, _, err = pool.get("a", 4, 50*time.Millisecond, dial)
+	if err == nil || !strings.Contains(err.Error(), "too many connections") {
+		t.Fatalf("expected too many connections, got %v", err)
+	}
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		_ = pc3.Close()
+	}()
+	pc4, reused, err := pool.get("a", 5, time.Second, dial)
+	if err != nil || reused {
+		t.Fatalf("unexpected get: %v %v", reused, err)
+	}
+	// max idle reached, second connection is closed
+	pc2.release(2)
+	pc4.release(5)
+	if pool.stats.overflow.Load() != 1 {
+		t.Fatalf("expected 1 overflow, got %d", pool.stats.overflow.Load())
+	}
+	// connection closed by peer is discarded
+	_ = peers[0].Close()
+	_, reused, _ = pool.get("a", 6, time.Second, dial)
+	if reused || pool.stats.dead.Load() != 1 {
+		t.Fatalf("expected closed connection to be discarded: %v %d", reused, pool.stats.dead.Load())
+	}
+	// other keys use other connections
+	pc7, _, _ := pool.get("b", 7, time.Second, dial)
+	pc7.release(7)
+	// expired connections are closed
+	pool.safeSetConf(ConfPool{MaxIdle: 1, MaxTotal: 2, IdleTimeout: 0})
+	time.Sleep(10 * time.Millisecond)
+	pool.vacuum()
+	builder := strings.Builder{}
+	pool.metrics(&builder)
+	for _, metric := range []string{
+		"kpx_pool_idle_connections 0\n",
+		"kpx_pool_active_connections 1\n",
+		"kpx_pool_hits_total 1\n",
+		"kpx_pool_misses_total 5\n",
+		"kpx_pool_discarded_total{reason=\"expired\"} 1\n",
+	} {
+		if !strings.Contains(builder.String(), metric) {
+			t.Fatalf("missing metric %q in:\n%s", metric, builder.String())
+		}
+	}
+}
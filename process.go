@@ -1,6 +1,8 @@
 package kpx
 
 import (
+	"bufio"
+	"context"
 	"crypto/sha256"
 	"crypto/tls"
 	"encoding/base64"
@@ -8,7 +10,11 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"net/url"
+	"os"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -21,20 +27,26 @@ import (
 )
 
 type Process struct {
-	config      *Config //copy config here because it is multithreaded
-	proxy       *Proxy
-	conn        *TimedConn
-	reqId       int32
-	verbose     bool
-	logName     string
-	logPrefix   string
-	logLine     string
-	logTraffic  string
-	logHostPort string
-	loadCounter int32
-	ti          *traceInfo
-	traffic     *ui.TrafficRow
-	trafficConn *TrafficConn
+	config        *Config //copy config here because it is multithreaded
+	proxy         *Proxy
+	conn          *TimedConn
+	reqId         int32
+	verbose       bool
+	logName       string
+	logPrefix     string
+	logLine       string
+	logTraffic    string
+	logHostPort   string
+	loadCounter   int32
+	ti            *traceInfo
+	traffic       *ui.TrafficRow
+	trafficConn   *TrafficConn
+	socksLogin    string // socks username, when 'socksAuth' is per-user
+	socksPassword string // socks password, when 'socksAuth' is per-user
+	socksVersion  byte   // socks protocol version of the client, 4 or 5
+	listener      *ConfListener
+	transparent   bool   // connection redirected by a firewall, no socks replies and relative urls in http requests
+	originalDst   string // original destination of a transparent connection, if known
 }
 
 func NewProcess(proxy *Proxy, conn net.Conn) *Process {
@@ -60,7 +72,8 @@ func (p *Process) processHttp() {
 	defer func() { _ = p.conn.Close() }()
 	// loop until proxyChannel is empty, meaning connection should close
 	var clientChannel = &ProxyRequest{
-		conn: p.conn,
+		conn:   p.conn,
+		strict: p.config.conf.StrictHttp,
 	}
 	// loop
 	var proxyChannel *ProxyRequest
@@ -95,12 +108,33 @@ func (p *Process) processChannel(clientChannel, proxyChannel *ProxyRequest) *Pro
 		return p.closeChannels(clientChannel, proxyChannel)
 	}
 
+	// transparent request url is relative, rebuild it from host header
+	if p.transparent && strings.HasPrefix(clientChannel.header.url, "/") {
+		err = p.transparentRequestLine(clientChannel)
+		if err != nil {
+			_ = clientChannel.badRequest()
+			return p.closeChannels(clientChannel, proxyChannel)
+		}
+	}
+
 	// is url for local web server?
 	if strings.HasPrefix(clientChannel.header.url, "/") {
 		_ = p.webServer(clientChannel)
 		return p.closeChannels(clientChannel, proxyChannel)
 	}
 
+	// admin listener only serves local web server
+	if p.listener != nil && p.listener.Protocol == LISTENER_ADMIN {
+		_ = clientChannel.forbidden()
+		return p.closeChannels(clientChannel, proxyChannel)
+	}
+
+	// listener authentication
+	if !p.checkListenerAuth(clientChannel) {
+		_ = clientChannel.requireAuth(p.listenerName())
+		return p.closeChannels(clientChannel, proxyChannel)
+	}
+
 	// prevent timeout on connections
 	clientChannel.conn.setTimeout(0)
 
@@ -109,7 +143,7 @@ func (p *Process) processChannel(clientChannel, proxyChannel *ProxyRequest) *Pro
 	if trace {
 		logTrace(p.ti, "proxy match")
 	}
-	rule, proxies := p.config.matchHttp(clientChannel.header.url, clientChannel.header.hostPort)
+	rule, proxies := p.config.matchListener(p.listener, clientChannel.header.url, clientChannel.header.hostPort, false)
 	firstProxy, firstHostPort := p.findFirstProxy(rule, proxies)
 	if trace {
 		if firstProxy != nil {
@@ -186,6 +220,12 @@ func (p *Process) processChannel(clientChannel, proxyChannel *ProxyRequest) *Pro
 		if trace {
 			logTrace(p.ti, "authentication")
 		}
+		// fail fast if credential is suspended or waiting for a new password
+		if ok, message := p.proxy.checkCredential(firstProxy.cred); !ok {
+			logInfo("%s => %s", p.logLine, strings.SplitN(message, "\n", 2)[0])
+			_ = clientChannel.badGateway(message)
+			return p.closeChannels(clientChannel, proxyChannel)
+		}
 		var authenticated bool
 		authenticated, authorizationContext, authorizationFunc = p.computeAuthPerConf(firstProxy)
 		if !authenticated {
@@ -203,11 +243,15 @@ func (p *Process) processChannel(clientChannel, proxyChannel *ProxyRequest) *Pro
 	// man-in-the-middle - it seems to work for all proxy configuration
 	mitmProxy := true
 	mitmClient := true
-	// if connection from pool
-	var pooledConnInfo *PooledConnectionInfo
+	// if connection from pool, and if it has been reused
+	var pooledConn *PooledConn
+	var reused bool
+	// a reused connection may not need authentication, but a new one does
+	requiresAuthentication := authentication
+	// request body is not sent until the server answered with 100 Continue
+	expectContinue := false
 	// try up to retryable connections
 	for {
-		pooledConnInfo = nil
 		if trace {
 			logTrace(p.ti, "start connection (retryable=%d)", retryable)
 		}
@@ -215,23 +259,33 @@ func (p *Process) processChannel(clientChannel, proxyChannel *ProxyRequest) *Pro
 			if trace {
 				logTrace(p.ti, "create proxy channel")
 			}
+			pooledConn, reused, authentication = nil, false, requiresAuthentication
 			var conn net.Conn
-			dialer := new(net.Dialer)
-			dialer.Timeout = time.Duration(p.config.conf.ConnectTimeout) * time.Second
+			dialer := p.newDialer()
 			switch *firstProxy.Type {
 			case ProxyKerberos, ProxyBasic, ProxyAnonymous:
-				if firstProxy.Ssl {
+				if firstProxy.via != nil {
+					// connections through via proxies are not pooled
+					conn, err = p.dialProxy(dialer, firstProxy, firstHostPort)
+				} else if firstProxy.Ssl {
 					tlsConfig := tls.Config{}
 					conn, err = tls.DialWithDialer(dialer, "tcp4", firstHostPort, &tlsConfig)
-				} else if clientChannel.header.isConnect || clientChannel.header.directToConnect {
+				} else if clientChannel.header.isConnect {
 					conn, err = dialer.Dial("tcp4", firstHostPort)
 				} else {
-					// may reuse a http connection from pool
-					var reused bool
-					reused, pooledConnInfo, err = p.proxy.newPooledConn(dialer, "tcp4", firstHostPort, clientChannel.header.host, authorizationContext, p.reqId)
-					conn = pooledConnInfo.conn
-					if reused && *firstProxy.Type == ProxyKerberos {
-						// reused connection is already authenticated
+					// may reuse a http connection, or a tunnel to an https server, from pool
+					key := "proxy/" + firstHostPort + "/" + authorizationContext
+					if clientChannel.header.directToConnect {
+						key = "tunnel/" + firstHostPort + "/" + authorizationContext + "/" + clientChannel.header.hostPort
+					}
+					pooledConn, reused, err = p.proxy.pool.get(key, p.reqId, dialer.Timeout, func() (net.Conn, error) {
+						return dialer.Dial("tcp4", firstHostPort)
+					})
+					if pooledConn != nil {
+						conn = pooledConn
+					}
+					if reused && (*firstProxy.Type == ProxyKerberos || clientChannel.header.directToConnect) {
+						// reused connection is already authenticated, and tunnel is already established
 						authentication = false
 					}
 				}
@@ -248,17 +302,15 @@ func (p *Process) processChannel(clientChannel, proxyChannel *ProxyRequest) *Pro
 						Password: userDetails[1],
 					}
 				}
-				var socks netproxy.Dialer
-				socks, err = netproxy.SOCKS5("tcp4", firstHostPort, authz, dialer)
-				if err == nil {
-					hostPort := clientChannel.header.hostPort
-					h, p := splitHostPort(hostPort, "", "", false)
-					if rule.Dns != nil {
-						h2, p2 := splitHostPort(*rule.Dns, h, p, false)
-						hostPort = h2 + ":" + p2
-					}
-					conn, err = socks.Dial("tcp4", hostPort)
+				hostPort := clientChannel.header.hostPort
+				h, port := splitHostPort(hostPort, "", "", false)
+				if rule.Dns != nil {
+					h2, p2 := splitHostPort(*rule.Dns, h, port, false)
+					hostPort = h2 + ":" + p2
+				} else {
+					hostPort = h + ":" + port
 				}
+				conn, err = p.dialSocks(dialer, firstProxy, firstHostPort, authz, hostPort)
 			case ProxyDirect:
 				simulateConnect = clientChannel.header.isConnect
 				hostPort := clientChannel.header.hostPort
@@ -270,17 +322,28 @@ func (p *Process) processChannel(clientChannel, proxyChannel *ProxyRequest) *Pro
 				if firstProxy.Ssl {
 					tlsConfig := tls.Config{}
 					conn, err = tls.DialWithDialer(dialer, "tcp4", hostPort, &tlsConfig)
-				} else if clientChannel.header.isConnect || clientChannel.header.directToConnect {
+				} else if clientChannel.header.isConnect {
 					conn, err = dialer.Dial("tcp4", hostPort)
 				} else {
-					// may reuse a http connection from pool
-					_, pooledConnInfo, err = p.proxy.newPooledConn(dialer, "tcp4", hostPort, clientChannel.header.host, authorizationContext, p.reqId)
-					conn = pooledConnInfo.conn
+					// may reuse a http or https connection from pool
+					key := "direct/" + hostPort + "/" + clientChannel.header.host
+					if clientChannel.header.directToConnect {
+						key = "tls/" + hostPort + "/" + clientChannel.header.host
+					}
+					pooledConn, reused, err = p.proxy.pool.get(key, p.reqId, dialer.Timeout, func() (net.Conn, error) {
+						return dialer.Dial("tcp4", hostPort)
+					})
+					if pooledConn != nil {
+						conn = pooledConn
+					}
 				}
 			}
 			// if err == nil and pi>0 or pj>0, update last usage
 			if err != nil {
 				logError("%s => dial: %#s", p.logLine, err)
+				if authentication && !firstProxy.cred.isPerUser && isSocksAuthFailure(err) {
+					p.proxy.credentialFailed(firstProxy.cred, err)
+				}
 				return p.closeChannels(clientChannel, proxyChannel)
 			}
 			// if conn is nil - proxyType=PAC and PAC not downloaded, so it did not resolve to an other proxy
@@ -290,7 +353,8 @@ func (p *Process) processChannel(clientChannel, proxyChannel *ProxyRequest) *Pro
 			}
 			ConfigureConn(conn)
 			proxyChannel = &ProxyRequest{
-				conn: NewTimedConn(conn, newTraceInfo(p.reqId, "proxy")),
+				conn:   NewTimedConn(conn, newTraceInfo(p.reqId, "proxy")),
+				strict: p.config.conf.StrictHttp,
 			}
 		}
 
@@ -298,9 +362,15 @@ func (p *Process) processChannel(clientChannel, proxyChannel *ProxyRequest) *Pro
 		if authentication && authorization == nil {
 			authorization, err = authorizationFunc()
 			if err != nil {
-				logInfo("[-] Shutting down to prevent locking user account with repeated invalid password...")
-				p.proxy.stop()
-				return nil
+				// record failure to prevent locking user account with repeated invalid password
+				p.proxy.credentialFailed(firstProxy.cred, err)
+				_, status := p.proxy.credentials.safeGetState(*firstProxy.cred.name)
+				message := status.message(*firstProxy.cred.name)
+				if message == "" {
+					message = fmt.Sprintf("Authentication failed for credential '%s': %v\n", *firstProxy.cred.name, err)
+				}
+				_ = clientChannel.badGateway(message)
+				return p.closeChannels(clientChannel, proxyChannel)
 			}
 			if authorization == nil {
 				authorization = &noAuth
@@ -314,41 +384,57 @@ func (p *Process) processChannel(clientChannel, proxyChannel *ProxyRequest) *Pro
 			}
 			clientChannel.conn.setTimeout(-p.config.conf.IdleTimeout)
 			proxyChannel.conn.setTimeout(-p.config.conf.IdleTimeout)
-			if !clientChannel.header.directToConnect {
-				err = p.forwardRequest(clientChannel, proxyChannel, *firstProxy.Type, authorization)
-				if err != nil {
-					logError("%s => forward: %#s", p.logLine, err)
-					return p.closeChannels(clientChannel, proxyChannel)
-				}
-			} else {
-				err = p.forwardConnect(clientChannel, proxyChannel, *firstProxy.Type, authorization)
-				if err != nil {
-					logError("%s => forward: %#s", p.logLine, err)
-					return p.closeChannels(clientChannel, proxyChannel)
-				}
-				if debug {
-					proxyChannel.prefix = fmt.Sprintf("%s P<", p.logPrefix)
-				}
-				proxyChannel.conn.setTimeout(p.config.conf.IdleTimeout)
-				err = proxyChannel.readResponseHeaders()
-				if err != nil {
-					logError("%s => forward: %#s", p.logLine, err)
-					return p.closeChannels(clientChannel, proxyChannel)
-				}
-				if strings.ToLower(proxyChannel.header.reason) != "connection established" {
-					err = errors.New("connection not established")
-					logError("%s => forward: %#s", p.logLine, err)
-					return p.closeChannels(clientChannel, proxyChannel)
+			if clientChannel.header.directToConnect && !reused {
+				// open a tunnel to the https server, with a CONNECT to the proxy
+				if *firstProxy.Type != ProxyDirect {
+					err = p.forwardConnect(clientChannel, proxyChannel, *firstProxy.Type, authorization)
+					if err != nil {
+						logError("%s => forward: %#s", p.logLine, err)
+						return p.closeChannels(clientChannel, proxyChannel)
+					}
+					if debug {
+						proxyChannel.prefix = fmt.Sprintf("%s P<", p.logPrefix)
+					}
+					proxyChannel.conn.setTimeout(p.config.conf.IdleTimeout)
+					err = proxyChannel.readResponseHeaders()
+					if err != nil {
+						logError("%s => forward: %#s", p.logLine, err)
+						return p.closeChannels(clientChannel, proxyChannel)
+					}
+					if strings.ToLower(proxyChannel.header.reason) != "connection established" {
+						err = errors.New("connection not established")
+						logError("%s => forward: %#s", p.logLine, err)
+						return p.closeChannels(clientChannel, proxyChannel)
+					}
+					if debug {
+						proxyChannel.prefix = fmt.Sprintf("%s P>", p.logPrefix)
+					}
 				}
-				if debug {
-					proxyChannel.prefix = fmt.Sprintf("%s P>", p.logPrefix)
+				tlsConfig := &tls.Config{ServerName: clientChannel.header.host}
+				if pooledConn != nil {
+					// pooled connection is the tls one, to be reused without a new handshake
+					pooledConn.Conn = tls.Client(pooledConn.Conn, tlsConfig)
+				} else {
+					proxyChannel.conn = NewTimedConn(tls.Client(proxyChannel.conn.conn, tlsConfig), newTraceInfo(p.reqId, "proxy"))
 				}
-				proxyChannel.conn = NewTimedConn(tls.Client(proxyChannel.conn.conn, &tls.Config{ServerName: clientChannel.header.host}), newTraceInfo(p.reqId, "proxy"))
-				err = p.forwardRequest(clientChannel, proxyChannel, *firstProxy.Type, authorization)
-				if err != nil {
-					logError("%s => forward: %#s", p.logLine, err)
-					return p.closeChannels(clientChannel, proxyChannel)
+			}
+			err = p.forwardRequest(clientChannel, proxyChannel, *firstProxy.Type, authorization)
+			if err != nil {
+				// a reused connection may have been closed by peer, retry if request has no body to replay
+				retryable--
+				if reused && clientChannel.header.contentLength == 0 && retryable > 0 {
+					logError("%s => %#s", p.logLine, stacktrace.NewError("Reused connection closed, retrying"))
+					p.closeChannel(proxyChannel)
+					proxyChannel = nil
+					continue
 				}
+				logError("%s => forward: %#s", p.logLine, err)
+				return p.closeChannels(clientChannel, proxyChannel)
+			}
+			expectContinue, err = p.waitContinue(clientChannel, proxyChannel)
+			if err != nil {
+				logError("%s => forward: %#s", p.logLine, err)
+				return p.closeChannels(clientChannel, proxyChannel)
 			}
 		}
 
@@ -381,8 +467,27 @@ func (p *Process) processChannel(clientChannel, proxyChannel *ProxyRequest) *Pro
 				return p.closeChannels(clientChannel, proxyChannel)
 			}
 		}
+		// record credential usage, as a 407 with a configured credential means it has been rejected
+		if authentication && !firstProxy.cred.isPerUser {
+			if proxyChannel.header.status == 407 {
+				// password may have been changed, so the next request will use the new one
+				if !p.proxy.refreshCredential(firstProxy.cred) {
+					p.proxy.credentialFailed(firstProxy.cred, stacktrace.NewError("proxy '%s' returned 407 Proxy Authentication Required", *firstProxy.name))
+				}
+			} else {
+				p.proxy.credentialSucceeded(firstProxy.cred)
+			}
+		}
 		break
 	}
+	if !simulateConnect {
+		err = p.readFinalResponse(clientChannel, proxyChannel, expectContinue)
+		if err != nil {
+			logError("%s => response: %#s", p.logLine, err)
+			return p.closeChannels(clientChannel, proxyChannel)
+		}
+	}
+	p.responseLength(clientChannel, proxyChannel)
 
 	// downgrade version if proxy is lower than client
 	if proxyChannel.header.version.Order() < clientChannel.header.version.Order() {
@@ -419,16 +524,55 @@ func (p *Process) processChannel(clientChannel, proxyChannel *ProxyRequest) *Pro
 					return p.config.certsManager.GetCertificate(name)
 				},
 			}
-			clientChannel.conn.conn = tls.Server(clientChannel.conn.conn, &srvConfig)
-		}
-		// convert proxy connexion to a tls client
-		if mitmProxy {
-			cliConfig := tls.Config{InsecureSkipVerify: true}
+			// offer the server the protocols of the client, then offer the client the one chosen by the server
+			srvConfig.GetConfigForClient = func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+				if !mitmProxy {
+					return nil, nil
+				}
+				serverName := info.ServerName
+				if serverName == "" {
+					serverName = host
+				}
+				tlsConn := tls.Client(proxyChannel.conn.conn, &tls.Config{InsecureSkipVerify: true, ServerName: serverName, NextProtos: mitmProtocols(info.SupportedProtos)})
+				err := tlsConn.HandshakeContext(info.Context())
+				if err != nil {
+					return nil, err // no wrap
+				}
+				proxyChannel.conn.conn = tlsConn
+				config := srvConfig.Clone()
+				config.GetConfigForClient = nil
+				if protocol := tlsConn.ConnectionState().NegotiatedProtocol; protocol != "" {
+					config.NextProtos = []string{protocol}
+				}
+				return config, nil
+			}
+			tlsConn := tls.Server(clientChannel.conn.conn, &srvConfig)
+			clientChannel.conn.conn = tlsConn
+			ctx, cancel := context.WithTimeout(context.Background(), time.Duration(p.config.conf.ConnectTimeout)*time.Second)
+			err = tlsConn.HandshakeContext(ctx)
+			cancel()
+			if err != nil {
+				logError("%s => mitm: %#s", p.logLine, err)
+				return p.closeChannels(clientChannel, proxyChannel)
+			}
+		} else if mitmProxy {
+			// convert proxy connexion to a tls client
+			cliConfig := tls.Config{InsecureSkipVerify: true, ServerName: clientChannel.header.host}
 			proxyChannel.conn.conn = tls.Client(proxyChannel.conn.conn, &cliConfig)
 		}
 		// automatically close connection after long inactivity
 		clientChannel.conn.setTimeout(-p.config.conf.IdleTimeout)
 		proxyChannel.conn.setTimeout(-p.config.conf.IdleTimeout)
+		// http/2 frames are forwarded as is, headers of each stream being logged
+		if tlsConn, ok := clientChannel.conn.conn.(*tls.Conn); ok && tlsConn.ConnectionState().NegotiatedProtocol == "h2" {
+			var wait sync.WaitGroup
+			wait.Add(2)
+			clientSettings, proxySettings := NewHttp2Settings(), NewHttp2Settings()
+			go p.pipeHttp2(clientChannel, proxyChannel, true, clientSettings, proxySettings, &wait)
+			go p.pipeHttp2(proxyChannel, clientChannel, false, proxySettings, clientSettings, &wait)
+			wait.Wait()
+			return p.closeChannels(clientChannel, proxyChannel)
+		}
 		// infinite double pipe sync
 		for {
 			p.logLine = ""
@@ -456,54 +600,52 @@ func (p *Process) processChannel(clientChannel, proxyChannel *ProxyRequest) *Pro
 			if err != nil {
 				break
 			}
+			expectContinue, err := p.waitContinue(clientChannel, proxyChannel)
+			if err != nil {
+				break
+			}
 			if debug {
 				proxyChannel.prefix = fmt.Sprintf("%s P<", p.logPrefix)
 			}
 			err = proxyChannel.readResponseHeaders()
+			if err == nil {
+				err = p.readFinalResponse(clientChannel, proxyChannel, expectContinue)
+			}
 			if err != nil {
 				break
 			}
+			p.responseLength(clientChannel, proxyChannel)
 			err = p.forwardResponse(proxyChannel, clientChannel, false)
 			if err != nil {
 				break
 			}
+			if p.switchedProtocols(clientChannel, proxyChannel) {
+				p.duplexPipe(clientChannel, proxyChannel)
+				break
+			}
+			// body delimited by the connection close
+			if proxyChannel.header.contentLength == BODY_UNTIL_CLOSE {
+				break
+			}
 		}
 		return p.closeChannels(clientChannel, proxyChannel)
 	}
-	// treat CONNECT as a forever duplex pipe
-	if clientChannel.header.isConnect || proxyChannel.header.status == 100 {
-		if trace {
-			logTrace(p.ti, "duplex pipe forever")
-		}
-		// automatically close connection after long inactivity
-		clientChannel.conn.setTimeout(-p.config.conf.IdleTimeout)
-		proxyChannel.conn.setTimeout(-p.config.conf.IdleTimeout)
-		// create a wait group to wait for both to finish
-		var finished sync.WaitGroup
-		finished.Add(2)
-		// double pipe async copy
-		go p.pipe(clientChannel, proxyChannel, &finished)
-		go p.pipe(proxyChannel, clientChannel, &finished)
-		// wait for both copy to finish
-		finished.Wait()
+	// treat CONNECT, and upgraded connections, as a forever duplex pipe
+	if clientChannel.header.isConnect || p.switchedProtocols(clientChannel, proxyChannel) {
+		p.duplexPipe(clientChannel, proxyChannel)
 		return p.closeChannels(clientChannel, proxyChannel)
 	}
-	// if KeepAlive, allow to reuse connection
-	if clientChannel.header.keepAlive {
-		// reuse connection only if config has not changed
-		if p.loadCounter == p.proxy.loadCounter.Load() {
-			// reuse proxy channel for next request
-			if pooledConnInfo != nil {
-				p.proxy.pushConnToPool(pooledConnInfo, p.reqId)
-			}
-			return proxyChannel
-		}
-		return p.closeChannels(clientChannel, proxyChannel)
+	// proxy connection is returned to pool for next requests, or closed if not pooled
+	if pooledConn != nil && proxyChannel.header.keepAlive {
+		pooledConn.release(p.reqId)
+	} else {
+		p.closeChannel(proxyChannel)
 	}
-	// else, return
-	{
-		return p.closeChannels(clientChannel, proxyChannel)
+	// if KeepAlive, allow to reuse client connection, only if config has not changed
+	if clientChannel.header.keepAlive && p.loadCounter == p.proxy.loadCounter.Load() {
+		return proxyChannel
 	}
+	return p.closeChannels(clientChannel, nil)
 }
 
 func (p *Process) computeLog(channel *ProxyRequest, rule *ConfRule, proxy *ConfProxy, hostPort string) {
@@ -548,8 +690,35 @@ func (p *Process) proxyShortName(s string) string {
 
 func (p *Process) webServer(channel *ProxyRequest) error {
 	var err error
-	line := channel.header.method + " " + channel.header.url
-	if !strings.HasPrefix(strings.ToLower(line), "get /proxy.pac") {
+	var content string
+	contentType := CT_PLAIN_UTF8
+	line := strings.ToLower(channel.header.method + " " + channel.header.url)
+	switch {
+	case strings.HasPrefix(line, "get /proxy.pac"):
+		content = p.config.pac
+	case strings.HasPrefix(line, "get /metrics"):
+		content = p.proxy.metrics()
+	case strings.HasPrefix(line, "post /credentials/"):
+		// admin endpoint, only allowed from localhost, and not from pages of other sites
+		if !isLoopback(channel.conn.RemoteAddr()) || !isSameOrigin(channel.findHeader("Origin"), channel.conn.LocalAddr()) || channel.findHeader(CREDENTIALS_HEADER) == nil {
+			return channel.forbidden()
+		}
+		content, err = p.postCredential(channel)
+		if err != nil {
+			logError("[-] Unable to update credential: %#s", err)
+			return channel.badRequestContent(fmt.Sprintf("%#s\n", err))
+		}
+	case strings.HasPrefix(line, "get /login"), strings.HasPrefix(line, "post /login"):
+		// admin page, only allowed from localhost, and not from pages of other sites
+		if !isLoopback(channel.conn.RemoteAddr()) || !isSameOrigin(channel.findHeader("Origin"), channel.conn.LocalAddr()) {
+			return channel.forbidden()
+		}
+		content, err = p.loginPage(channel)
+		if err != nil {
+			return channel.badRequest()
+		}
+		contentType = CT_HTML_UTF8
+	default:
 		return channel.notFound()
 	}
 
@@ -561,7 +730,65 @@ func (p *Process) webServer(channel *ProxyRequest) error {
 	if err != nil {
 		return err // no wrap
 	}
-	return channel.writeContent(p.config.pac, false, CT_PLAIN_UTF8)
+	return channel.writeContent(content, false, contentType)
+}
+
+// update a credential login/password, from a form encoded body with 'login' (optional) and 'password'
+func (p *Process) postCredential(channel *ProxyRequest) (string, error) {
+	name, _ := url.PathUnescape(strings.SplitN(channel.header.url[len("/credentials/"):], "?", 2)[0])
+	body, err := channel.readBody(HEADER_MAX_SIZE)
+	if err != nil {
+		return "", err // no wrap
+	}
+	values, err := url.ParseQuery(string(body))
+	if err != nil {
+		return "", stacktrace.Propagate(err, "invalid form body")
+	}
+	unchecked, err := p.proxy.setCredential(name, values.Get("login"), values.Get("password"))
+	if err != nil {
+		return "", err // no wrap
+	}
+	return fmt.Sprintf("Credential '%s' updated%s\n", name, uncheckedMessage(unchecked)), nil
+}
+
+func isLoopback(addr net.Addr) bool {
+	// unix sockets are local, access is granted by file permissions
+	if _, ok := addr.(*net.UnixAddr); ok {
+		return true
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// check the Origin header, sent by browsers with form posts, is the proxy address itself
+func isSameOrigin(origin *string, addr net.Addr) bool {
+	if origin == nil {
+		return true
+	}
+	u, err := url.Parse(*origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	host, localPort, err := net.SplitHostPort(addr.String())
+	if err != nil || port != localPort {
+		return false
+	}
+	if strings.EqualFold(u.Hostname(), "localhost") {
+		return true
+	}
+	ip, localIp := net.ParseIP(u.Hostname()), net.ParseIP(host)
+	return ip != nil && ip.Equal(localIp)
 }
 
 func (p *Process) closeChannels(clientChannel, proxyChannel *ProxyRequest) *ProxyRequest {
@@ -600,7 +827,6 @@ func (p *Process) forwardRequest(clientChannel *ProxyRequest, proxyChannel *Prox
 			return err // no wrap
 		}
 	}
-	expectContinue := false
 	for _, header := range clientChannel.header.headers[1:] {
 		lower := strings.ToLower(header)
 		switch {
@@ -608,8 +834,6 @@ func (p *Process) forwardRequest(clientChannel *ProxyRequest, proxyChannel *Prox
 			continue
 		case strings.HasPrefix(lower, "proxy-authorization:"):
 			continue
-		case strings.HasPrefix(lower, "expect") && strings.Contains(lower, "100-continue") && strings.ToUpper(clientChannel.header.method) == "PUT":
-			expectContinue = true
 		}
 		err = proxyChannel.writeHeaderLine(header)
 		if err != nil {
@@ -622,7 +846,12 @@ func (p *Process) forwardRequest(clientChannel *ProxyRequest, proxyChannel *Prox
 			return err // no wrap
 		}
 	}
-	err = proxyChannel.writeKeepAlive(clientChannel.header.keepAlive, proxyType != ProxyDirect && proxyType != ProxySocks)
+	if clientChannel.header.isUpgrade() {
+		// upgrade headers are hop-by-hop headers, which must be kept to switch protocols
+		err = proxyChannel.writeHeader("Connection", "Upgrade")
+	} else {
+		err = proxyChannel.writeKeepAlive(clientChannel.header.keepAlive, proxyType != ProxyDirect && proxyType != ProxySocks)
+	}
 	if err != nil {
 		return err // no wrap
 	}
@@ -630,13 +859,75 @@ func (p *Process) forwardRequest(clientChannel *ProxyRequest, proxyChannel *Prox
 	if err != nil {
 		return err // no wrap
 	}
-	// special PUT with Expect: 100-continue
-	if expectContinue {
+	// body is sent once the server answered with 100 Continue
+	if clientChannel.header.expectsContinue() {
 		return nil
 	}
 	return p.forwardStream(clientChannel, proxyChannel)
 }
 
+// wait up to EXPECT_CONTINUE_TIMEOUT for the server to answer a request with 'Expect: 100-continue',
+// and send the body if it does not, returning true if the body is still expected by the server
+func (p *Process) waitContinue(clientChannel *ProxyRequest, proxyChannel *ProxyRequest) (bool, error) {
+	if !clientChannel.header.expectsContinue() {
+		return false, nil
+	}
+	conn := proxyChannel.conn.conn
+	_ = conn.SetReadDeadline(time.Now().Add(EXPECT_CONTINUE_TIMEOUT * time.Second))
+	first := make([]byte, 1)
+	n, err := conn.Read(first)
+	proxyChannel.conn.setTimeout(-p.config.conf.IdleTimeout)
+	if n > 0 {
+		// response is read again with headers
+		proxyChannel.conn.conn = NewBufferedConn(conn, first)
+		return true, nil
+	}
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		return true, nil // response headers will fail reading the closed connection
+	}
+	return false, p.forwardStream(clientChannel, proxyChannel)
+}
+
+// forward interim responses to the client until the final response is read, sending the body after a 100 Continue.
+// if the final response is received before the body is sent, connections can't be reused.
+func (p *Process) readFinalResponse(clientChannel *ProxyRequest, proxyChannel *ProxyRequest, expectContinue bool) error {
+	for status := proxyChannel.header.status; status >= 100 && status < 200 && status != 101; status = proxyChannel.header.status {
+		// interim responses are not sent to HTTP/1.0 clients
+		if clientChannel.header.version != Http10 {
+			if debug {
+				clientChannel.prefix = fmt.Sprintf("%s C>", p.logPrefix)
+			}
+			for _, header := range proxyChannel.header.headers {
+				err := clientChannel.writeHeaderLine(header)
+				if err != nil {
+					return err // no wrap
+				}
+			}
+			err := clientChannel.closeHeader()
+			if err != nil {
+				return err // no wrap
+			}
+		}
+		if status == 100 && expectContinue {
+			expectContinue = false
+			err := p.forwardStream(clientChannel, proxyChannel)
+			if err != nil {
+				return err // no wrap
+			}
+		}
+		proxyChannel.unread()
+		err := proxyChannel.readResponseHeaders()
+		if err != nil {
+			return err // no wrap
+		}
+	}
+	if expectContinue {
+		clientChannel.header.keepAlive = false
+		proxyChannel.header.keepAlive = false
+	}
+	return nil
+}
+
 func (p *Process) forwardConnect(clientChannel *ProxyRequest, proxyChannel *ProxyRequest, _ ProxyType, auth *string) error {
 	var err error
 	if debug {
@@ -703,7 +994,12 @@ func (p *Process) forwardResponse(proxyChannel *ProxyRequest, clientChannel *Pro
 		_ = clientChannel.writeHeader("kpx-proxy", p.logName)
 		_ = clientChannel.writeHeader("kpx-host", p.logHostPort)
 	}
-	if !clientChannel.header.isConnect {
+	if p.switchedProtocols(clientChannel, proxyChannel) {
+		err = clientChannel.writeHeader("Connection", "Upgrade")
+		if err != nil {
+			return err // no wrap
+		}
+	} else if !clientChannel.header.isConnect {
 		err = clientChannel.writeKeepAlive(clientChannel.header.keepAlive, clientChannel.header.isProxyConnection)
 		if err != nil {
 			return err // no wrap
@@ -713,8 +1009,8 @@ func (p *Process) forwardResponse(proxyChannel *ProxyRequest, clientChannel *Pro
 	if err != nil {
 		return err // no wrap
 	}
-	// special response if HEAD
-	if strings.ToUpper(clientChannel.header.method) == "HEAD" {
+	// special response if HEAD, or switching protocols with no body
+	if strings.ToUpper(clientChannel.header.method) == "HEAD" || proxyChannel.header.status == 101 {
 		return nil
 	}
 	return p.forwardStream(proxyChannel, clientChannel)
@@ -723,22 +1019,79 @@ func (p *Process) forwardResponse(proxyChannel *ProxyRequest, clientChannel *Pro
 func (p *Process) forwardStream(source *ProxyRequest, target *ProxyRequest) error {
 	dataReader := strings.NewReader(string(source.header.data))
 	sourceReader := io.MultiReader(dataReader, source.conn)
-	var reader io.Reader
-	if source.header.contentLength == -1 {
+	writer := target.conn
+	var err error
+	switch source.header.contentLength {
+	case BODY_CHUNKED:
 		// Use our own implementation of NewChunkedReader instead of original http.NewChunkedReader
-		// to also copy the chunked lines
-		reader = NewChunkedReader(sourceReader)
-	} else {
-		reader = io.LimitReader(sourceReader, source.header.contentLength)
+		// to also copy the chunked lines and trailers
+		bufferedReader := bufio.NewReader(sourceReader)
+		_, err = io.Copy(writer, NewChunkedReader(bufferedReader))
+		// keep data read after the body, buffered by the chunked reader
+		buffered, _ := bufferedReader.Peek(bufferedReader.Buffered())
+		source.header.data = slices.Concat(buffered, source.header.data[len(source.header.data)-dataReader.Len():])
+	case BODY_UNTIL_CLOSE:
+		_, err = io.Copy(writer, sourceReader)
+		source.header.data = nil
+	default:
+		var n int64
+		n, err = io.Copy(writer, io.LimitReader(sourceReader, source.header.contentLength))
+		if err == nil && n < source.header.contentLength {
+			err = io.ErrUnexpectedEOF
+		}
+		// keep data read after the body, like the first bytes of an upgraded connection
+		source.header.data = source.header.data[len(source.header.data)-dataReader.Len():]
 	}
-	writer := target.conn
-	_, err := io.Copy(writer, reader)
 	// fast close connection after short inactivity, unless receiving new data
 	source.conn.setTimeout(-p.config.conf.CloseTimeout)
 	target.conn.setTimeout(-p.config.conf.CloseTimeout)
 	return err // no wrap
 }
 
+// set the body length of the response, see RFC 9112 section 6.3.
+// a body delimited by the connection close prevents reusing both connections.
+func (p *Process) responseLength(clientChannel *ProxyRequest, proxyChannel *ProxyRequest) {
+	request, response := clientChannel.header, proxyChannel.header
+	switch {
+	case strings.ToUpper(request.method) == "HEAD" || response.status < 200 || response.status == 204 || response.status == 304:
+		response.contentLength = 0
+	case request.isConnect && response.status/100 == 2:
+		response.contentLength = 0
+	case response.contentLength == BODY_UNTIL_CLOSE:
+		request.keepAlive = false
+		response.keepAlive = false
+	}
+}
+
+// check if the upgrade requested by the client has been accepted by the server, like websockets
+func (p *Process) switchedProtocols(clientChannel *ProxyRequest, proxyChannel *ProxyRequest) bool {
+	return proxyChannel.header.status == 101 && clientChannel.header.isUpgrade()
+}
+
+// copy data both ways until one side closes, starting with the data already read after the headers
+func (p *Process) duplexPipe(clientChannel *ProxyRequest, proxyChannel *ProxyRequest) {
+	if trace {
+		logTrace(p.ti, "duplex pipe forever")
+	}
+	// automatically close connection after long inactivity
+	clientChannel.conn.setTimeout(-p.config.conf.IdleTimeout)
+	proxyChannel.conn.setTimeout(-p.config.conf.IdleTimeout)
+	for _, channels := range [][2]*ProxyRequest{{clientChannel, proxyChannel}, {proxyChannel, clientChannel}} {
+		if len(channels[0].header.data) > 0 {
+			_, _ = channels[1].conn.Write(channels[0].header.data)
+			channels[0].header.data = nil
+		}
+	}
+	// create a wait group to wait for both to finish
+	var finished sync.WaitGroup
+	finished.Add(2)
+	// double pipe async copy
+	go p.pipe(clientChannel, proxyChannel, &finished)
+	go p.pipe(proxyChannel, clientChannel, &finished)
+	// wait for both copy to finish
+	finished.Wait()
+}
+
 func (p *Process) pipe(source *ProxyRequest, target *ProxyRequest, wait *sync.WaitGroup) {
 	// io.Copy will use splice/sendfile (zerocopy) only if src/dst are of type *net.TCPConn
 	_, _ = io.Copy(target.conn.conn, source.conn.conn)
@@ -795,12 +1148,18 @@ func (p *Process) findFirstProxy(rule *ConfRule, proxies []*ConfProxy) (*ConfPro
 			}
 			// loop on hosts
 			for hi, host := range hosts {
-				hostPort := fmt.Sprintf("%s:%d", host, port)
+				hostPort := net.JoinHostPort(host, strconv.Itoa(port))
 				// set default proxy
 				if firstProxy == nil {
 					firstProxy = proxy
 					firstHostPort = hostPort
 				}
+				// proxy behind a via proxy can't be checked directly
+				if proxy.via != nil {
+					firstProxy = proxy
+					firstHostPort = hostPort
+					break proxyLoop
+				}
 				// try to connect to host
 				dialer := new(net.Dialer)
 				dialer.Timeout = time.Duration(p.config.conf.ConnectTimeout) * time.Second
@@ -905,9 +1264,18 @@ func (p *Process) computeAuthPerConf(firstProxy *ConfProxy) (bool, string, func(
 	var authenticated bool
 	var authorizationContext string
 	var authorizationFunc func() (*string, error)
+	// login/password can be updated at runtime, so get them once
+	var login, password string
+	if !firstProxy.cred.isNative {
+		l, pw := firstProxy.cred.safeGet()
+		if l == nil || pw == nil {
+			return false, "", nil
+		}
+		login, password = *l, *pw
+	}
 	switch {
 	case *firstProxy.Type == ProxyKerberos && !firstProxy.cred.isNative:
-		authorizationContext = p.hash("krb:%s/%s/%s/%s", *firstProxy.cred.Login, *firstProxy.Realm, *firstProxy.cred.Password, *firstProxy.Host)
+		authorizationContext = p.hash("krb:%s/%s/%s/%s", login, *firstProxy.Realm, password, *firstProxy.Host)
 		authorizationFunc = func(username string, realm string, password string, protocol string, host string) func() (*string, error) {
 			return func() (*string, error) {
 				// don't hide error, this is an unrecoverable error
@@ -918,7 +1286,7 @@ func (p *Process) computeAuthPerConf(firstProxy *ConfProxy) (bool, string, func(
 				}
 				return auth, nil
 			}
-		}(*firstProxy.cred.Login, *firstProxy.Realm, *firstProxy.cred.Password, *firstProxy.Spn, *firstProxy.Host)
+		}(login, *firstProxy.Realm, password, *firstProxy.Spn, *firstProxy.Host)
 		authenticated = true
 	case *firstProxy.Type == ProxyKerberos && firstProxy.cred.isNative:
 		authorizationContext = p.hash("native:%s", *firstProxy.Host)
@@ -935,7 +1303,7 @@ func (p *Process) computeAuthPerConf(firstProxy *ConfProxy) (bool, string, func(
 		}(*firstProxy.Spn, *firstProxy.Host)
 		authenticated = true
 	case *firstProxy.Type == ProxyBasic:
-		basic := fmt.Sprintf("%s:%s", *firstProxy.cred.Login, *firstProxy.cred.Password)
+		basic := fmt.Sprintf("%s:%s", login, password)
 		basic = "Basic " + base64.StdEncoding.EncodeToString([]byte(basic))
 		authorizationContext = p.hash("basic:%s", basic)
 		authorizationFunc = func(auth *string) func() (*string, error) {
@@ -945,7 +1313,7 @@ func (p *Process) computeAuthPerConf(firstProxy *ConfProxy) (bool, string, func(
 		}(&basic)
 		authenticated = true
 	case *firstProxy.Type == ProxySocks:
-		credentialString := fmt.Sprintf("%s:%s", *firstProxy.cred.Login, *firstProxy.cred.Password)
+		credentialString := fmt.Sprintf("%s:%s", login, password)
 		authorizationContext = p.hash("socks:%s", credentialString)
 		authorizationFunc = func(auth *string) func() (*string, error) {
 			return func() (*string, error) {
@@ -966,7 +1334,14 @@ func (p *Process) processSocks(request *socks5.Request) {
 
 	// find matching rule and proxy
 	requestHostPort := request.Address()
-	rule, proxies := p.config.matchSocks(requestHostPort)
+	var rule *ConfRule
+	var proxies []*ConfProxy
+	if p.transparent {
+		// transparent tls connections use http rules, as for CONNECT requests
+		rule, proxies = p.config.matchListener(p.listener, "https://"+strings.TrimSuffix(requestHostPort, ":443"), requestHostPort, false)
+	} else {
+		rule, proxies = p.config.matchListener(p.listener, requestHostPort, requestHostPort, true)
+	}
 	firstProxy, firstHostPort := p.findFirstProxy(rule, proxies)
 	proxyName := "none"
 	if firstProxy != nil {
@@ -1000,13 +1375,19 @@ func (p *Process) processSocks(request *socks5.Request) {
 		logInfo("[%s] socks %s => %s", proxyName, requestHostPort, firstHostPort)
 	}
 
-	// if no proxy, just throw away the request
+	// if no proxy, just refuse the request
 	if rule == nil || firstProxy == nil || *firstProxy.Type == ProxyNone {
+		_ = p.socksReply(socks5.RepNotAllowed, "0.0.0.0:0")
+		return
+	}
+	if !p.socksProxyAllowed(firstProxy) {
+		logInfo("[%s] socks %s => %s: proxy without per-user credential is not allowed with per-user authentication", proxyName, requestHostPort, firstHostPort)
+		_ = p.socksReply(socks5.RepNotAllowed, "0.0.0.0:0")
 		return
 	}
 
 	// check if authentication is required as defined in the configuration.
-	authentication := *firstProxy.Type == ProxySocks && firstProxy.cred != nil
+	authentication := (*firstProxy.Type == ProxyKerberos || *firstProxy.Type == ProxyBasic || *firstProxy.Type == ProxySocks) && firstProxy.cred != nil
 
 	//
 	var authorization *string
@@ -1016,12 +1397,51 @@ func (p *Process) processSocks(request *socks5.Request) {
 		if trace {
 			logTrace(p.ti, "authentication")
 		}
+		// fail fast if credential is suspended or waiting for a new password
+		if ok, message := p.proxy.checkCredential(firstProxy.cred); !ok {
+			logInfo("[%s] socks %s => %s: %s", proxyName, requestHostPort, firstHostPort, strings.SplitN(message, "\n", 2)[0])
+			_ = p.socksReply(socks5.RepServerFailure, "0.0.0.0:0")
+			return
+		}
 		var authenticated bool
-		authenticated, _, authorizationFunc = p.computeAuthPerConf(firstProxy)
+		if firstProxy.cred.isPerUser {
+			// forward socks username/password to upstream proxy, as if they were sent in a Proxy-Authorization header
+			proxyAuthorization := "Basic " + base64.StdEncoding.EncodeToString([]byte(p.socksLogin+":"+p.socksPassword))
+			authenticated, _, authorizationFunc = p.computeAuthPerUser(firstProxy, &proxyAuthorization)
+			authenticated = authenticated && p.socksLogin != ""
+		} else {
+			authenticated, _, authorizationFunc = p.computeAuthPerConf(firstProxy)
+		}
 		if !authenticated {
 			// authentication failed
+			logInfo("[%s] socks %s => %s: no credentials available", proxyName, requestHostPort, firstHostPort)
+			_ = p.socksReply(socks5.RepServerFailure, "0.0.0.0:0")
+			return
+		}
+	}
+
+	// http proxies are used with a CONNECT request, which can't bind
+	switch *firstProxy.Type {
+	case ProxySocks, ProxyDirect:
+	case ProxyKerberos, ProxyBasic, ProxyAnonymous:
+		if request.Cmd == socks5.CmdBind {
+			logInfo("[%s] socks %s => %s: bind is not supported with proxy type '%s'", proxyName, requestHostPort, firstHostPort, *firstProxy.Type)
+			_ = p.socksReply(socks5.RepCommandNotSupported, "0.0.0.0:0")
 			return
 		}
+	default:
+		// proxyType=PAC and PAC not downloaded, so it did not resolve to an other proxy
+		logInfo("[%s] socks %s => %s: no connection available", proxyName, requestHostPort, firstHostPort)
+		_ = p.socksReply(socks5.RepNetworkUnreachable, "0.0.0.0:0")
+		return
+	}
+
+	// target host:port, with dns override
+	hostPort := requestHostPort
+	if rule.Dns != nil {
+		h, port := splitHostPort(hostPort, "", "", false)
+		h2, p2 := splitHostPort(*rule.Dns, h, port, false)
+		hostPort = h2 + ":" + p2
 	}
 
 	// allow 3 retries, creating a new remote connection each time
@@ -1030,21 +1450,34 @@ func (p *Process) processSocks(request *socks5.Request) {
 		conn: p.conn,
 	}
 	var proxyChannel *ProxyRequest
+	// address of the incoming connection for bind
+	var bindAddr string
 	// if connection from pool
 	// try up to retryable connections
 	for {
 		if trace {
 			logTrace(p.ti, "start connection (retryable=%d)", retryable)
 		}
+		// get authorization, a new one is needed for each connection with kerberos
+		if authentication {
+			authorization, err = authorizationFunc()
+			if err != nil {
+				// record failure to prevent locking user account with repeated invalid password
+				logError("[%s] socks %s => %s: authentication %#s", proxyName, requestHostPort, firstHostPort, err)
+				p.proxy.credentialFailed(firstProxy.cred, err)
+				_ = p.socksReply(socks5.RepServerFailure, "0.0.0.0:0")
+				return
+			}
+		}
 		var conn net.Conn
-		dialer := new(net.Dialer)
-		dialer.Timeout = time.Duration(p.config.conf.ConnectTimeout) * time.Second
+		// http status of CONNECT request, if any
+		var status int
+		dialer := p.newDialer()
 		switch *firstProxy.Type {
+		case ProxyKerberos, ProxyBasic, ProxyAnonymous:
+			conn, status, err = p.dialConnect(dialer, firstProxy, firstHostPort, hostPort, authorization)
 		case ProxySocks:
 			var authz *netproxy.Auth
-			if authentication {
-				authorization, _ = authorizationFunc()
-			}
 			if authorization != nil {
 				userDetails := strings.SplitN(*authorization, ":", 2)
 				authz = &netproxy.Auth{
@@ -1052,23 +1485,15 @@ func (p *Process) processSocks(request *socks5.Request) {
 					Password: userDetails[1],
 				}
 			}
-			var socks netproxy.Dialer
-			socks, err = netproxy.SOCKS5("tcp4", firstHostPort, authz, dialer)
-			if err == nil {
-				hostPort := requestHostPort
-				h, p := splitHostPort(hostPort, "", "", false)
-				if rule.Dns != nil {
-					h2, p2 := splitHostPort(*rule.Dns, h, p, false)
-					hostPort = h2 + ":" + p2
-				}
-				conn, err = socks.Dial("tcp4", hostPort)
+			if request.Cmd == socks5.CmdBind {
+				conn, bindAddr, err = p.socksBindUpstream(dialer, firstProxy, firstHostPort, authz, hostPort)
+				break
 			}
+			conn, err = p.dialSocks(dialer, firstProxy, firstHostPort, authz, hostPort)
 		case ProxyDirect:
-			hostPort := requestHostPort
-			host, port := splitHostPort(hostPort, "", "", false)
-			if rule.Dns != nil {
-				h2, p2 := splitHostPort(*rule.Dns, host, port, false)
-				hostPort = h2 + ":" + p2
+			if request.Cmd == socks5.CmdBind {
+				conn, bindAddr, err = p.socksBindDirect(hostPort)
+				break
 			}
 			if firstProxy.Ssl {
 				tlsConfig := tls.Config{}
@@ -1080,12 +1505,31 @@ func (p *Process) processSocks(request *socks5.Request) {
 		// if err == nil and pi>0 or pj>0, update last usage
 		if err != nil {
 			logError("[%s] socks %s => %s: dial %#s", proxyName, requestHostPort, firstHostPort, err)
+			if authentication && !firstProxy.cred.isPerUser && (isSocksAuthFailure(err) || status == 407) {
+				// don't retry, to prevent locking user account
+				// password may have been changed, so the next request will use the new one
+				if status != 407 || !p.proxy.refreshCredential(firstProxy.cred) {
+					p.proxy.credentialFailed(firstProxy.cred, err)
+				}
+				_ = p.socksReply(socks5.RepNotAllowed, "0.0.0.0:0")
+				return
+			}
 			retryable--
-			if retryable > 0 {
+			// bind can't be retried, as first reply has already been sent to client
+			// http errors are returned by the proxy, so there is no need to retry
+			if retryable > 0 && request.Cmd != socks5.CmdBind && status == 0 {
 				continue
 			}
+			rep := socksReplyCode(err)
+			if status == 403 || status == 407 {
+				rep = socks5.RepNotAllowed
+			}
+			_ = p.socksReply(rep, "0.0.0.0:0")
 			return
 		}
+		if authentication && !firstProxy.cred.isPerUser {
+			p.proxy.credentialSucceeded(firstProxy.cred)
+		}
 		//
 		ConfigureConn(conn)
 		proxyChannel = &ProxyRequest{
@@ -1093,6 +1537,15 @@ func (p *Process) processSocks(request *socks5.Request) {
 		}
 		break
 	}
+	// reply with the address of the incoming connection for bind (second reply), or the local address for connect
+	replyAddr := proxyChannel.conn.LocalAddr().String()
+	if request.Cmd == socks5.CmdBind {
+		replyAddr = bindAddr
+	}
+	if err = p.socksReply(socks5.RepSuccess, replyAddr); err != nil {
+		_ = proxyChannel.conn.Close()
+		return
+	}
 	//
 	// create a wait group to wait for both to finish
 	var finished sync.WaitGroup
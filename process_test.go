@@ -0,0 +1,269 @@
+package kpx
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// server switching to an echo protocol, sending a greeting right after the 101 response
+func newTestUpgradeServer(t *testing.T, secure bool) *httptest.Server {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "echo" || !strings.Contains(strings.ToLower(r.Header.Get("Connection")), "upgrade") {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		conn, rw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer func() { _ = conn.Close() }()
+		_, _ = rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\nhi")
+		_ = rw.Flush()
+		buffer := make([]byte, 5)
+		_, err = io.ReadFull(rw, buffer)
+		if err == nil {
+			_, _ = conn.Write(buffer)
+		}
+	}))
+	if secure {
+		server.StartTLS()
+	} else {
+		server.Start()
+	}
+	t.Cleanup(server.Close)
+	return server
+}
+
+// send an upgrade request, then expect the greeting and the echo
+func expectUpgrade(t *testing.T, conn net.Conn, url string, host string) {
+	_, err := fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: %s\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n", url, host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, nil)
+	if err != nil || response.StatusCode != http.StatusSwitchingProtocols || response.Header.Get("Upgrade") != "echo" || response.Header.Get("Connection") != "Upgrade" {
+		t.Fatalf("unexpected response: %v %v", response, err)
+	}
+	buffer := make([]byte, 2)
+	_, err = io.ReadFull(reader, buffer)
+	if err != nil || string(buffer) != "hi" {
+		t.Fatalf("unexpected greeting: %q %v", buffer, err)
+	}
+	_, _ = conn.Write([]byte("hello"))
+	buffer = make([]byte, 5)
+	_, err = io.ReadFull(reader, buffer)
+	if err != nil || string(buffer) != "hello" {
+		t.Fatalf("unexpected echo: %q %v", buffer, err)
+	}
+}
+
+func TestUpgrade(t *testing.T) {
+	t.Chdir(t.TempDir())
+	server := newTestUpgradeServer(t, false)
+	secureServer := newTestUpgradeServer(t, true)
+	proxy := newTestSocksProxyConfig(t, "rules:\n  - host: \"*\"\n    proxy: direct\n    mitm: true\n")
+	newClient := func() net.Conn {
+		server, client := net.Pipe()
+		p := NewProcess(proxy, server)
+		p.listener = &ConfListener{Protocol: LISTENER_HTTP}
+		go p.processHttp()
+		_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+		t.Cleanup(func() { _ = client.Close() })
+		return client
+	}
+	// plain http request
+	host := strings.TrimPrefix(server.URL, "http://")
+	expectUpgrade(t, newClient(), server.URL+"/ws", host)
+	// request inside a mitm session
+	host = strings.TrimPrefix(secureServer.URL, "https://")
+	client := newClient()
+	_, _ = fmt.Fprintf(client, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", host, host)
+	reader := bufio.NewReader(client)
+	response, err := http.ReadResponse(reader, &http.Request{Method: http.MethodConnect})
+	if err != nil || response.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected response: %v %v", response, err)
+	}
+	expectUpgrade(t, tls.Client(client, &tls.Config{InsecureSkipVerify: true}), "/ws", host)
+}
+
+func TestExpectContinue(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// kpx closes client connections unless the server explicitly asks for keep-alive
+		w.Header().Set("Connection", "keep-alive")
+		switch r.URL.Path {
+		case "/reject":
+			w.WriteHeader(http.StatusExpectationFailed)
+		case "/hints":
+			w.Header().Set("Link", "</style.css>; rel=preload")
+			w.WriteHeader(http.StatusEarlyHints)
+			fallthrough
+		default:
+			body, _ := io.ReadAll(r.Body)
+			_, _ = fmt.Fprintf(w, "%s %s", r.Method, body)
+		}
+	}))
+	defer server.Close()
+	// server ignoring Expect header, waiting for the body
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = ln.Close() }()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			request, err := http.ReadRequest(bufio.NewReader(conn))
+			if err == nil {
+				body, _ := io.ReadAll(request.Body)
+				_, _ = fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n%s", len(body), body)
+			}
+			_ = conn.Close()
+		}
+	}()
+	proxy := newTestSocksProxyConfig(t, "rules:\n  - host: \"*\"\n    proxy: direct\n")
+	var client net.Conn
+	var reader *bufio.Reader
+	connect := func() {
+		serverConn, clientConn := net.Pipe()
+		p := NewProcess(proxy, serverConn)
+		p.listener = &ConfListener{Protocol: LISTENER_HTTP}
+		go p.processHttp()
+		_ = clientConn.SetDeadline(time.Now().Add(10 * time.Second))
+		t.Cleanup(func() { _ = clientConn.Close() })
+		client, reader = clientConn, bufio.NewReader(clientConn)
+	}
+	send := func(method string, url string) {
+		_, err := fmt.Fprintf(client, "%s %s HTTP/1.1\r\nHost: test\r\nExpect: 100-continue\r\nContent-Length: 5\r\n\r\n", method, url)
+		if err != nil {
+			t.Fatal(method, url, err)
+		}
+	}
+	expect := func(status int, body string) *http.Response {
+		response, err := http.ReadResponse(reader, nil)
+		if err != nil || response.StatusCode != status {
+			t.Fatalf("unexpected response: %v %v", response, err)
+		}
+		content, _ := io.ReadAll(response.Body)
+		if string(content) != body {
+			t.Fatalf("unexpected body: %q", content)
+		}
+		return response
+	}
+	// body is sent after 100 Continue, for any method, and connection is kept alive
+	connect()
+	for _, method := range []string{http.MethodPost, http.MethodPatch} {
+		send(method, server.URL+"/echo")
+		expect(http.StatusContinue, "")
+		_, _ = client.Write([]byte("hello"))
+		expect(http.StatusOK, method+" hello")
+	}
+	// early hints are forwarded
+	send(http.MethodPost, server.URL+"/hints")
+	if response := expect(http.StatusEarlyHints, ""); response.Header.Get("Link") == "" {
+		t.Fatalf("unexpected hints: %v", response.Header)
+	}
+	expect(http.StatusContinue, "")
+	_, _ = client.Write([]byte("hello"))
+	expect(http.StatusOK, "POST hello")
+	// final response without 100 Continue closes the connection, as the body was not read
+	send(http.MethodPost, server.URL+"/reject")
+	if response := expect(http.StatusExpectationFailed, ""); !response.Close {
+		t.Fatal("expected connection to be closed")
+	}
+	// body is sent anyway when the server does not answer
+	connect()
+	send(http.MethodPut, "http://"+ln.Addr().String()+"/")
+	_, _ = client.Write([]byte("hello"))
+	expect(http.StatusOK, "hello")
+}
+
+func TestResponseLength(t *testing.T) {
+	// raw server answering requests on the same connection, according to the path
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = ln.Close() }()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer func() { _ = conn.Close() }()
+				reader := bufio.NewReader(conn)
+				for {
+					request, err := http.ReadRequest(reader)
+					if err != nil {
+						return
+					}
+					switch request.URL.Path {
+					case "/close":
+						_, _ = conn.Write([]byte("HTTP/1.0 200 OK\r\n\r\nuntil close"))
+						return
+					case "/empty":
+						_, _ = conn.Write([]byte("HTTP/1.1 204 No Content\r\nConnection: keep-alive\r\nTransfer-Encoding: chunked\r\n\r\n"))
+					case "/chunked":
+						_, _ = conn.Write([]byte("HTTP/1.1 200 OK\r\nConnection: keep-alive\r\nTransfer-Encoding: chunked\r\nTrailer: X-Sum\r\n\r\n5\r\nhello\r\n0\r\nX-Sum: 5\r\n\r\n"))
+					case "/truncated":
+						_, _ = conn.Write([]byte("HTTP/1.1 200 OK\r\nConnection: keep-alive\r\nContent-Length: 10\r\n\r\nhello"))
+						return
+					}
+				}
+			}()
+		}
+	}()
+	proxy := newTestSocksProxyConfig(t, "rules:\n  - host: \"*\"\n    proxy: direct\n")
+	connect := func() (net.Conn, *bufio.Reader) {
+		serverConn, client := net.Pipe()
+		p := NewProcess(proxy, serverConn)
+		p.listener = &ConfListener{Protocol: LISTENER_HTTP}
+		go p.processHttp()
+		_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+		t.Cleanup(func() { _ = client.Close() })
+		return client, bufio.NewReader(client)
+	}
+	get := func(client net.Conn, reader *bufio.Reader, path string) (*http.Response, string, error) {
+		_, _ = fmt.Fprintf(client, "GET http://%s%s HTTP/1.1\r\nHost: %s\r\n\r\n", ln.Addr(), path, ln.Addr())
+		response, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			return nil, "", err
+		}
+		body, err := io.ReadAll(response.Body)
+		return response, string(body), err
+	}
+	// no body for 204, and chunked body with trailers, on the same connection
+	client, reader := connect()
+	response, body, err := get(client, reader, "/empty")
+	if err != nil || response.StatusCode != http.StatusNoContent || body != "" || response.Close {
+		t.Fatalf("unexpected response: %v %q %v", response, body, err)
+	}
+	response, body, err = get(client, reader, "/chunked")
+	if err != nil || body != "hello" || response.Trailer.Get("X-Sum") != "5" || response.Close {
+		t.Fatalf("unexpected response: %v %q %v", response, body, err)
+	}
+	// body delimited by connection close, which is then closed
+	response, body, err = get(client, reader, "/close")
+	if err != nil || body != "until close" || !response.Close {
+		t.Fatalf("unexpected response: %v %q %v", response, body, err)
+	}
+	// truncated body closes the connection
+	client, reader = connect()
+	_, _, err = get(client, reader, "/truncated")
+	if err == nil {
+		t.Fatal("expected truncated body")
+	}
+}
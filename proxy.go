@@ -1,41 +1,44 @@
 package kpx
 
 import (
-	"container/list"
-	"fmt"
+	"crypto/rand"
+	"encoding/hex"
 	"github.com/momiji/kpx/ui"
 	"math"
 	"net"
 	"os"
 	"os/signal"
-	"path"
+	"slices"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
 
-	"github.com/txthinking/socks5"
-
 	"github.com/fsnotify/fsnotify"
 	"github.com/palantir/stacktrace"
 )
 
 type Proxy struct {
-	config                      atomic.Pointer[Config] // atomic
-	forceStop                   bool                   // not atomic - used only for get/set, no conditional update
-	newRequestId                atomic.Int32           // atomic - used in each process
-	requestsCount               atomic.Int32           // atomic - used in each connection
-	kerberos                    *KerberosStore         // not atomic - used only for get/set, no conditional update - initialized once
-	lastModTime                 time.Time              // not atomic - used only for get/set in one coroutine
-	lastLoadTime                time.Time              // not atomic - used only for get/set in one coroutine
-	loadCounter                 atomic.Int32           // atomic - used in each process to test if config has been updated
-	reloadEvent                 *ManualResetEvent      //
-	fixWatchEvent               *ManualResetEvent      //
-	connPool                    map[string]*list.List  // must be synced - used in each process
-	poolMutex                   sync.Mutex             // atomic - used in each process
-	experimentalConnectionPools bool
-	consoleUI                   bool
+	config         atomic.Pointer[Config]   // atomic
+	forceStop      atomic.Bool              // atomic - set on exit, checked in each connection
+	exitOnce       sync.Once                // exit is done only once, concurrent calls wait forever
+	listeners      map[string]net.Listener  // must be synced - opened and closed on reload, closed on exit
+	listenerConfs  map[string]*ConfListener // must be synced - configuration of opened listeners, to reopen them
+	listenersMutex sync.Mutex               //
+	newRequestId   atomic.Int32             // atomic - used in each process
+	requestsCount  atomic.Int32             // atomic - used in each connection
+	kerberos       *KerberosStore           // not atomic - used only for get/set, no conditional update - initialized once
+	credentials    *CredentialStore         // not atomic - initialized once, survives configuration reloads
+	lastModTime    time.Time                // not atomic - used only for get/set in one coroutine
+	lastLoadTime   time.Time                // not atomic - used only for get/set in one coroutine
+	lastPollTime   time.Time                // not atomic - used only for get/set in one coroutine
+	loadCounter    atomic.Int32             // atomic - used in each process to test if config has been updated
+	reloadEvent    *ManualResetEvent        //
+	fixWatchEvent  *ManualResetEvent        //
+	pool           *ConnPool                // synced - used in each process
+	consoleUI      bool
+	loginToken     string // not atomic - initialized once, required to post the login form
 
 	// krbClients    map[string]*KerberosClient //
 	// configPtr     *unsafe.Pointer
@@ -50,52 +53,54 @@ func (p *Proxy) setConfig(config *Config) {
 	p.loadCounter.Add(1)
 	trace = config.conf.Trace
 	debug = config.conf.Debug
-	p.experimentalConnectionPools = config.conf.experimentalConnectionPools
+	if p.pool != nil {
+		p.pool.safeSetConf(config.conf.Pool)
+	}
+	if p.kerberos != nil {
+		p.kerberos.safeSetCache(config.conf.KerberosCache)
+	}
 	//
 	features := ""
-	if config.conf.experimentalConnectionPools {
-		features += "," + EXPERIMENTAL_CONNETION_POOLS
-	}
 	if config.conf.experimentalHostsCache {
 		features += "," + EXPERIMENTAL_HOSTS_CACHE
 	}
 	if features != "" {
-		logInfo("[-] Experimental features: " + features[1:])
+		logInfo("[-] Experimental features: %s", features[1:])
 	}
 }
 
 func (p *Proxy) init() error {
-	p.forceStop = false
+	p.forceStop.Store(false)
 	// p.krbClients = make(map[string]*KerberosClient)
 	// p.configPtr = (*unsafe.Pointer)(unsafe.Pointer(&p.unsafeConfig))
 	p.reloadEvent = NewManualResetEvent(false)
 	p.fixWatchEvent = NewManualResetEvent(false)
-	p.connPool = map[string]*list.List{}
+	p.pool = NewConnPool()
+	p.listeners = map[string]net.Listener{}
+	p.listenerConfs = map[string]*ConfListener{}
+	p.credentials = NewCredentialStore()
+	token := make([]byte, 16)
+	_, _ = rand.Read(token)
+	p.loginToken = hex.EncodeToString(token)
 	return nil
 }
 
 // Initial loading
 func (p *Proxy) load() error {
 	// load config
-	if options.Config != "" {
-		file, err := os.Open(options.Config)
-		if err != nil {
-			return stacktrace.Propagate(err, "unable to open file")
-		}
-		defer func(file *os.File) {
-			_ = file.Close()
-		}(file)
-		stat, err := file.Stat()
+	if options.Config != "" && !isRemoteConfig(options.Config) {
+		_, err := os.Stat(options.Config)
 		if err != nil {
 			return stacktrace.Propagate(err, "unable to stat file")
 		}
-		p.lastModTime = stat.ModTime()
-		p.lastLoadTime = time.Now()
 	}
 	config, err := NewConfig(options.Config)
 	if err != nil {
 		return stacktrace.Propagate(err, "unable to create config")
 	}
+	p.lastModTime = config.modTime()
+	p.lastLoadTime = time.Now()
+	p.lastPollTime = time.Now()
 	p.setConfig(config)
 	// ask missing credentials
 	err = config.askCredentials()
@@ -169,19 +174,31 @@ func (p *Proxy) watch2() {
 	}
 	timer := time.AfterFunc(math.MaxInt64, func() { p.reloadEvent.Signal() })
 	timer.Stop()
-	watchPath := path.Dir(options.Config)
-	_ = watcher.Add(watchPath)
+	// watch directories of all config files, including included files
+	watchPaths := p.getConfig().watchPaths()
+	for _, watchPath := range watchPaths {
+		_ = watcher.Add(watchPath)
+	}
 	for {
 		select {
 		case <-p.fixWatchEvent.Channel():
-			// update watcher's list
+			// update watcher's list, as included files may have changed
 			p.fixWatchEvent.Reset()
+			watchPaths = p.getConfig().watchPaths()
 			wl := watcher.WatchList()
-			if len(wl) != 1 || wl[0] != watchPath {
+			slices.Sort(wl)
+			if !slices.Equal(wl, watchPaths) {
 				if trace {
 					logInfo("reconfigure watcher")
 				}
-				_ = watcher.Add(watchPath)
+				for _, watchPath := range wl {
+					if !slices.Contains(watchPaths, watchPath) {
+						_ = watcher.Remove(watchPath)
+					}
+				}
+				for _, watchPath := range watchPaths {
+					_ = watcher.Add(watchPath)
+				}
 			}
 		case e, ok := <-watcher.Errors:
 			// watcher error
@@ -196,57 +213,113 @@ func (p *Proxy) watch2() {
 			if !ok {
 				continue
 			}
-			if path.Base(e.Name) == path.Base(options.Config) && (e.Has(fsnotify.Create) || e.Has(fsnotify.Write)) {
+			if p.getConfig().isConfigFile(e.Name) && (e.Has(fsnotify.Create) || e.Has(fsnotify.Write)) {
 				timer.Reset(100 * time.Millisecond)
 			}
 		}
 	}
 }
 
-func (p *Proxy) reload() {
-	stat, err := os.Stat(options.Config)
+// poll remote config every 'remoteInterval', returning true if it has changed
+func (p *Proxy) pollRemote(config *Config) bool {
+	if time.Now().Before(p.lastPollTime.Add(time.Duration(config.conf.RemoteInterval) * time.Second)) {
+		return false
+	}
+	p.lastPollTime = time.Now()
+	httpClient, err := config.newRemoteHttpClient()
 	if err != nil {
-		return
+		logInfo("[-] Error while downloading configuration: %s", err)
+		return false
+	}
+	changed, err := remoteConfig.poll(httpClient)
+	if err != nil {
+		logInfo("[-] Error while downloading configuration: %s", err)
 	}
+	return changed
+}
+
+func (p *Proxy) reload() {
 	oldConfig := p.getConfig()
-	if stat.ModTime() == p.lastModTime && time.Now().Before(p.lastLoadTime.Add(RELOAD_FORCE_TIMEOUT*time.Second)) && !oldConfig.needFastReload {
-		return
+	forced := !time.Now().Before(p.lastLoadTime.Add(RELOAD_FORCE_TIMEOUT*time.Second)) || oldConfig.needFastReload
+	var modTime time.Time
+	if isRemoteConfig(options.Config) {
+		if !p.pollRemote(oldConfig) && !forced {
+			return
+		}
+	} else {
+		_, err := os.Stat(options.Config)
+		if err != nil {
+			return
+		}
+		// any config file, including included files, may have changed
+		modTime = oldConfig.modTime()
+		if modTime == p.lastModTime && !forced {
+			return
+		}
 	}
 	// test if we need to reload
+	sdNotify(SD_RELOADING)
+	defer sdNotify(SD_READY)
 	newConfig, err := NewConfig(options.Config)
-	p.lastModTime = stat.ModTime()
+	p.lastModTime = modTime
 	p.lastLoadTime = time.Now()
 	if err != nil {
 		logInfo("[-] Error while reloading configuration: %s", err)
 		return
 	}
-	// test if we can hot-reload - no need for more credentials
+	// new included files are only known once loaded
+	p.lastModTime = newConfig.modTime()
+	// copy credentials, prevent concurrent updates from the local web server until the new config is in place
+	p.credentials.updateMutex.Lock()
+	defer p.credentials.updateMutex.Unlock()
+	var resetCreds []string
+	var awaitCreds []string
 	for _, cred := range newConfig.conf.Credentials {
 		// start by copying old credentials
 		oldCred := oldConfig.conf.Credentials[*cred.name]
 		if oldCred != nil {
-			if cred.Login == nil {
-				cred.Login = oldCred.Login
-			}
-			if cred.Password == nil {
-				cred.Password = oldCred.Password
+			oldLogin, oldPassword := oldCred.safeGet()
+			if equalPtr(cred.confLogin, oldCred.confLogin) && equalPtr(cred.confPassword, oldCred.confPassword) {
+				// unchanged in file, keep current login/password as it may have been updated at runtime
+				cred.Login = oldLogin
+				cred.Password = oldPassword
+			} else {
+				if cred.Login == nil {
+					cred.Login = oldLogin
+				}
+				if cred.Password == nil {
+					cred.Password = oldPassword
+				}
+				resetCreds = append(resetCreds, *cred.name)
 			}
 		}
-		// then verify if it used it must have a login/password
+		// then verify if it used it must have a login/password, otherwise wait for it to be provided
 		if cred.isUsed && !cred.isNative {
 			if cred.Login == nil || cred.Password == nil {
-				logInfo("[-] Could not Hot-reload the configuration as it requires new credentials")
-				return
+				awaitCreds = append(awaitCreds, *cred.name)
 			}
 		}
 	}
 	logInfo("[-] Hot-reload of the configuration succeeded")
 	// replace current config with the new one
 	p.setConfig(newConfig)
+	// open new listeners and close removed ones, existing connections are kept alive
+	err = p.updateListeners(newConfig)
+	if err != nil {
+		logError("[-] Error while updating listeners: %s", err)
+	}
+	// new login/password in configuration file, give suspended credentials a new chance
+	for _, name := range resetCreds {
+		p.credentials.safeReset(name)
+	}
+	// missing login/password, rules using these credentials fail until they are provided
+	for _, name := range awaitCreds {
+		p.credentials.safeAwaitPassword(name)
+		logInfo("[-] Credential '%s' is waiting for a password, use 'http://%s/login' or '%s login %s'", name, newConfig.adminAddress(), AppName, name)
+	}
 }
 
 func (p *Proxy) run() error {
-	// get config that won't be hot reloaded as ports cannot be changed afterwards
 	config := p.getConfig()
 
 	// start automatic exit
@@ -261,71 +334,26 @@ func (p *Proxy) run() error {
 	// start automatic pool vacuum
 	go func() {
 		for !p.stopped() {
-			<-time.After(time.Duration(POOL_CLOSE_TIMEOUT) * time.Second)
-			p.vacuumPool()
+			<-time.After(time.Duration(POOL_VACUUM_TIMEOUT) * time.Second)
+			p.pool.vacuum()
 		}
 	}()
 
-	// start http server
-	if config.conf.Port != 0 {
-		ln, err := net.Listen("tcp4", fmt.Sprint(config.conf.Bind, ":", config.conf.Port))
-		if err != nil {
-			return stacktrace.Propagate(err, "unable to listen on %s:%d", config.conf.Bind, config.conf.Port)
+	// start automatic kerberos cache vacuum
+	go func() {
+		for !p.stopped() {
+			<-time.After(time.Duration(KRB_VACUUM_TIMEOUT) * time.Second)
+			p.kerberos.vacuum()
 		}
+	}()
 
-		hostPort := ln.Addr().String()
-		logInfo("[-] Use %s as your http proxy or http://%s/proxy.pac as your proxy PAC url", hostPort, hostPort)
-
-		go func() {
-			for {
-				conn, err := ln.Accept()
-				if err != nil {
-					continue
-				}
-				remoteIp := strings.Split(conn.RemoteAddr().String(), ":")[0]
-				if !p.isAllowed(remoteIp, p.getConfig().conf.ACL) {
-					logInfo("[-] Connection from %s is not allowed by ACL", remoteIp)
-					_ = conn.Close() // force closing client, ignore any error
-					continue
-				}
-				ConfigureConn(conn)
-				if p.stopped() {
-					_ = conn.Close() // force closing client, ignore any error
-					break
-				}
-				if trace {
-					logInfo("new connection")
-				}
-				go func() {
-					c := p.requestsCount.Add(1)
-					if trace {
-						logInfo("connections count=%d", c)
-					}
-					NewProcess(p, conn).processHttp()
-					c = p.requestsCount.Add(-1)
-					if trace {
-						logInfo("connections count=%d", c)
-					}
-				}()
-			}
-		}()
-	}
-
-	// start socks5 server
+	// start listeners: http, socks, transparent and admin, updated on reload
 	errChan := make(chan error)
-	if config.conf.SocksPort != 0 {
-		socks, err := socks5.NewClassicServer(fmt.Sprintf("%s:%d", config.conf.Bind, config.conf.SocksPort), config.conf.Bind, "", "", 0, 60)
-		if err != nil {
-			return stacktrace.Propagate(err, "unable to create socks server on %s:%d", config.conf.Bind, config.conf.SocksPort)
-		}
-		logInfo("[-] Use %s as your socks5 proxy and configure it to use remote dns - curl syntax is 'curl -x socks5h://%s' or 'curl --socks5-hostname %s'", socks.Addr, socks.Addr, socks.Addr)
-		go func() {
-			err = socks.ListenAndServe(p)
-			if err != nil {
-				errChan <- stacktrace.Propagate(err, "unable to listen on %s:%d", config.conf.Bind, config.conf.SocksPort)
-			}
-		}()
+	err := p.updateListeners(config)
+	if err != nil {
+		return err // no wrap
 	}
+	sdNotify(SD_READY)
 
 	// start console ui and data cleanup
 	if p.consoleUI {
@@ -352,42 +380,121 @@ func (p *Proxy) run() error {
 	}
 }
 
-func (p *Proxy) TCPHandle(server *socks5.Server, conn *net.TCPConn, request *socks5.Request) error {
-	if request.Cmd != socks5.CmdConnect {
-		logInfo("[-] TCP socks proxy is not implemented for command %b", request.Cmd)
+// open listeners of the configuration which are not yet opened, and close the ones which are not in the configuration.
+// listeners are identified by their address, protocol, ACL, rules and authentication being read from live configuration.
+func (p *Proxy) updateListeners(config *Config) error {
+	p.listenersMutex.Lock()
+	defer p.listenersMutex.Unlock()
+	if p.stopped() {
 		return nil
 	}
-	// return any address, not important as we are using connect?
-	a, addr, port, err := socks5.ParseAddress("127.0.0.1:12345")
-	if err != nil {
-		conn.Close()
-		return err
+	var result error
+	addresses := map[string]bool{}
+	for _, listener := range config.conf.listeners {
+		addresses[listener.address()] = true
+	}
+	// close removed listeners first, as a new listener may use the same port with another bind address
+	removed := map[string]*ConfListener{}
+	for address, ln := range p.listeners {
+		if !addresses[address] {
+			logInfo("[-] Closing listener %s", address)
+			_ = ln.Close()
+			removed[address] = p.listenerConfs[address]
+			delete(p.listeners, address)
+			delete(p.listenerConfs, address)
+		}
 	}
-	if a == socks5.ATYPDomain {
-		addr = addr[1:]
+	for _, listener := range config.conf.listeners {
+		address := listener.address()
+		if _, ok := p.listeners[address]; ok {
+			// unix socket mode and owner may have changed
+			if listener.Unix != "" {
+				if err := listener.setPermissions(); err != nil && result == nil {
+					result = err
+				}
+			}
+			continue
+		}
+		ln, err := listener.listen()
+		if err != nil {
+			if result == nil {
+				result = err
+			}
+			continue
+		}
+		p.startListener(ln, listener)
 	}
-	reply := socks5.NewReply(socks5.RepSuccess, a, addr, port)
-	if _, err := reply.WriteTo(conn); err != nil {
-		conn.Close()
-		return err
+	// a new listener failed, reopen removed ones so clients can still connect where they did
+	if result != nil {
+		for address, listener := range removed {
+			if listener == nil {
+				continue
+			}
+			ln, err := listener.listen()
+			if err != nil {
+				logError("[-] Unable to reopen listener %s: %s", address, err)
+				continue
+			}
+			p.startListener(ln, listener)
+		}
 	}
-
-	NewProcess(p, conn).processSocks(request)
-	return nil
+	return result
 }
 
-func (p *Proxy) UDPHandle(server *socks5.Server, addr *net.UDPAddr, datagram *socks5.Datagram) error {
-	logInfo("[-] UDP socks proxy is not implemented")
-	return nil
+// must be called with listenersMutex locked
+func (p *Proxy) startListener(ln net.Listener, listener *ConfListener) {
+	listener.logStart(ln.Addr().String())
+	p.listeners[listener.address()] = ln
+	p.listenerConfs[listener.address()] = listener
+	go p.serve(ln, listener)
 }
 
 func (p *Proxy) stop() {
-	p.forceStop = true
 	p.exit(1)
 }
 
 func (p *Proxy) stopped() bool {
-	return p.forceStop
+	return p.forceStop.Load()
+}
+
+// stop accepting connections, wait up to drainTimeout for active connections, then close pooled connections
+func (p *Proxy) shutdown() {
+	p.forceStop.Store(true)
+	p.listenersMutex.Lock()
+	for address, ln := range p.listeners {
+		_ = ln.Close()
+		delete(p.listeners, address)
+		delete(p.listenerConfs, address)
+	}
+	p.listenersMutex.Unlock()
+	drainTimeout := 0
+	if config := p.getConfig(); config != nil {
+		drainTimeout = config.conf.DrainTimeout
+	}
+	if count := p.requestsCount.Load(); count > 0 && drainTimeout > 0 {
+		logInfo("[-] Waiting up to %d seconds for %d active connections", drainTimeout, count)
+		deadline := time.Now().Add(time.Duration(drainTimeout) * time.Second)
+		for p.requestsCount.Load() > 0 && time.Now().Before(deadline) {
+			time.Sleep(DRAIN_CHECK_INTERVAL * time.Millisecond)
+		}
+	}
+	if count := p.requestsCount.Load(); count > 0 {
+		logInfo("[-] Closing %d active connections", count)
+	}
+	p.pool.close()
+}
+
+// exit on SIGINT/SIGTERM, or immediately on a second signal while waiting for active connections
+func (p *Proxy) handleSignals() {
+	exitSignal := make(chan os.Signal, 2)
+	signal.Notify(exitSignal, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-exitSignal
+	logInfo("[-] Received %v, exiting", sig)
+	go p.exit(0)
+	<-exitSignal
+	logInfo("[-] Received second signal, exiting now")
+	logDestroy()
+	os.Exit(1)
 }
 
 // generate a new kerberos ticket, using a new client if not yet cached per realm/username/password
@@ -415,111 +522,6 @@ func (p *Proxy) generateKerberosNative(protocol string, host string) (*string, e
 	return &auth, nil
 }
 
-type PooledConnection struct {
-	conn    *CloseAwareConn
-	timeout time.Time
-	reqId   int32
-}
-
-type PooledConnectionInfo struct {
-	key   string
-	conn  *CloseAwareConn
-	reqId int32
-}
-
-func (p *Proxy) newPooledConn(dialer *net.Dialer, network string, proxy string, host string, context string, reqId int32) (bool, *PooledConnectionInfo, error) {
-	key := network + "/" + proxy + "/" + context + "/" + host
-	if p.experimentalConnectionPools {
-		p.poolMutex.Lock()
-		defer p.poolMutex.Unlock()
-		var items *list.List
-		if l, ok := p.connPool[key]; ok {
-			items = l
-		} else {
-			l = list.New()
-			p.connPool[key] = l
-			items = l
-		}
-		for {
-			item := items.Front()
-			if item == nil {
-				break
-			}
-			items.Remove(item)
-			pc := item.Value.(*PooledConnection)
-			if pc.timeout.After(time.Now()) {
-				if trace {
-					logInfo("(%d) reusing connection %d from pool", reqId, pc.reqId)
-				}
-				_ = pc.conn.SetDeadline(time.Time{})
-				pc.conn.Reset(reqId)
-				return true, &PooledConnectionInfo{key, pc.conn, pc.reqId}, nil
-			} else {
-				_ = pc.conn.Close()
-			}
-			if trace {
-				logInfo("(%d) removed old connection %d from pool", reqId, pc.reqId)
-			}
-		}
-	}
-	// create a new connection
-	c, err := NewCloseAwareConn(dialer, network, proxy, reqId)
-	return false, &PooledConnectionInfo{key, c, reqId}, err
-}
-
-func (p *Proxy) pushConnToPool(info *PooledConnectionInfo, reqId int32) {
-	if p.experimentalConnectionPools {
-		if trace {
-			logInfo("(%d) pushing connection %d to pool for later reuse", reqId, info.reqId)
-		}
-		p.poolMutex.Lock()
-		defer p.poolMutex.Unlock()
-		poolTimeout := time.Now().Add(POOL_CLOSE_TIMEOUT * time.Second)
-		closeTimeout := poolTimeout.Add(POOL_CLOSE_TIMEOUT_ADD * time.Second)
-		if err := info.conn.SetDeadline(closeTimeout); err == nil {
-			var items *list.List
-			if l, ok := p.connPool[info.key]; ok {
-				items = l
-			} else {
-				l = list.New()
-				p.connPool[info.key] = l
-				items = l
-			}
-			items.PushBack(&PooledConnection{conn: info.conn, timeout: poolTimeout, reqId: info.reqId})
-		}
-	}
-}
-
-func (p *Proxy) vacuumPool() {
-	if trace {
-		logInfo("deleting connections from pool")
-	}
-	p.poolMutex.Lock()
-	defer p.poolMutex.Unlock()
-	now := time.Now()
-	total := 0
-	count := 0
-	for key, items := range p.connPool {
-		var next *list.Element
-		for e := items.Front(); e != nil; e = next {
-			total++
-			next = e.Next()
-			pc := e.Value.(*PooledConnection)
-			if pc.timeout.After(now) {
-				count++
-				_ = pc.conn.Close()
-				items.Remove(e)
-			}
-		}
-		if items.Len() == 0 {
-			delete(p.connPool, key)
-		}
-	}
-	if trace {
-		logInfo("%d connections removed from pool, %d remaining", count, total-count)
-	}
-}
-
 // check if ip is in the list of allowed ips or cidrs
 func (p *Proxy) isAllowed(ip string, acl []string) bool {
 	for _, a := range acl {
@@ -536,13 +538,19 @@ func (p *Proxy) isAllowed(ip string, acl []string) bool {
 }
 
 func (p *Proxy) exit(code int) {
-	if p.consoleUI {
-		// force stop UI
-		ui.StopUI()
-		<-ui.StoppedUI
-	}
-	logDestroy()
-	os.Exit(code)
+	p.exitOnce.Do(func() {
+		sdNotify(SD_STOPPING)
+		p.shutdown()
+		if p.consoleUI {
+			// force stop UI
+			ui.StopUI()
+			<-ui.StoppedUI
+		}
+		logDestroy()
+		os.Exit(code)
+	})
+	// another exit is in progress
+	select {}
 }
 
 func (p *Proxy) ui() {
@@ -0,0 +1,112 @@
+package kpx
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestShutdown(t *testing.T) {
+	proxy := newTestSocksProxyConfig(t, "drainTimeout: 5\nlisteners:\n  - port: 1\n    protocol: socks\n")
+	listener := &ConfListener{Bind: "127.0.0.1", Protocol: LISTENER_SOCKS}
+	ln, err := listener.listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy.listeners[listener.address()] = ln
+	go proxy.serve(ln, listener)
+	// active connection, waiting for socks negotiation
+	client, err := net.Dial("tcp4", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for proxy.requestsCount.Load() == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		_ = client.Close()
+	}()
+	start := time.Now()
+	proxy.shutdown()
+	elapsed := time.Since(start)
+	if elapsed < 300*time.Millisecond || elapsed > 3*time.Second {
+		t.Fatalf("shutdown did not wait for the active connection: %v", elapsed)
+	}
+	if _, err = net.DialTimeout("tcp4", ln.Addr().String(), time.Second); err == nil {
+		t.Fatalf("listener must be closed")
+	}
+}
+
+func TestUpdateListeners(t *testing.T) {
+	// free ports
+	var ports []int
+	for i := 0; i < 2; i++ {
+		ln, err := net.Listen("tcp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ports = append(ports, ln.Addr().(*net.TCPAddr).Port)
+		_ = ln.Close()
+	}
+	proxy := newTestSocksProxyConfig(t, fmt.Sprintf("socksPort: %d\n", ports[0]))
+	err := proxy.updateListeners(proxy.getConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.shutdown()
+	expectListening(t, ports[0], true)
+	// socks port is moved, and a http port is added
+	config := newTestSocksProxyConfig(t, fmt.Sprintf("port: %d\nsocksPort: %d\n", ports[0], ports[1])).getConfig()
+	proxy.setConfig(config)
+	err = proxy.updateListeners(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectListening(t, ports[0], true)
+	expectListening(t, ports[1], true)
+	// http port is removed
+	config = newTestSocksProxyConfig(t, fmt.Sprintf("socksPort: %d\n", ports[1])).getConfig()
+	proxy.setConfig(config)
+	err = proxy.updateListeners(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectListening(t, ports[0], false)
+	expectListening(t, ports[1], true)
+	// bind address is changed on the same port
+	config = newTestSocksProxyConfig(t, fmt.Sprintf("listeners:\n  - bind: 0.0.0.0\n    port: %d\n    protocol: socks\n", ports[1])).getConfig()
+	proxy.setConfig(config)
+	err = proxy.updateListeners(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectListening(t, ports[1], true)
+	// new port is already used, removed listener is reopened
+	used, err := net.Listen("tcp4", fmt.Sprint("0.0.0.0:", ports[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = used.Close() }()
+	config = newTestSocksProxyConfig(t, fmt.Sprintf("socksPort: %d\n", ports[0])).getConfig()
+	proxy.setConfig(config)
+	err = proxy.updateListeners(config)
+	if err == nil {
+		t.Fatalf("expected listen error")
+	}
+	if _, ok := proxy.listeners[fmt.Sprint("0.0.0.0:", ports[1])]; !ok {
+		t.Fatalf("expected removed listener to be reopened: %v", proxy.listeners)
+	}
+	expectListening(t, ports[1], true)
+}
+
+func expectListening(t *testing.T, port int, listening bool) {
+	conn, err := net.DialTimeout("tcp4", fmt.Sprint("127.0.0.1:", port), time.Second)
+	if err == nil {
+		_ = conn.Close()
+	}
+	if (err == nil) != listening {
+		t.Fatalf("port %d: expected listening=%v, got %v", port, listening, err)
+	}
+}
@@ -0,0 +1,219 @@
+package kpx
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/palantir/stacktrace"
+)
+
+/*
+Remote config, when '-c' is an https url, or an http url on the local host:
+- downloaded on start, falling back to the last valid copy cached on disk when offline
+- polled every 'remoteInterval' seconds with If-None-Match/If-Modified-Since by the reload task
+- a downloaded config only replaces the cached copy once it has been validated
+*/
+
+var remoteConfig = &RemoteConfig{}
+
+type RemoteConfig struct {
+	mutex        sync.Mutex
+	url          string
+	valid        *remoteContent // last valid content, cached on disk
+	pending      *remoteContent // downloaded content, not yet validated
+	etag         string         // validators of the last downloaded content, even if invalid, to not download it again
+	lastModified string
+	first        bool // first content not yet validated, an invalid one falls back to the cached copy
+}
+
+type remoteContent struct {
+	Url          string `json:"url"`
+	Etag         string `json:"etag"`
+	LastModified string `json:"lastModified"`
+	content      []byte
+}
+
+func isRemoteConfig(name string) bool {
+	return strings.HasPrefix(name, "http://") || strings.HasPrefix(name, "https://")
+}
+
+// remote config must be downloaded with https, unless it is on the local host, as it is trusted like a local file
+func checkRemoteUrl(configUrl string) error {
+	u, err := url.Parse(configUrl)
+	if err != nil {
+		return stacktrace.Propagate(err, "invalid config url %s", configUrl)
+	}
+	if u.Scheme == "https" || u.Hostname() == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(u.Hostname()); ip != nil && ip.IsLoopback() {
+		return nil
+	}
+	return stacktrace.NewError("config url %s must use https", configUrl)
+}
+
+// client used to download remote config, using the bootstrap proxy if any
+func (c *Config) newRemoteHttpClient() (*http.Client, error) {
+	httpClient := c.newHttpClient()
+	if options.ConfigProxy != "" {
+		proxyUrl, err := url.Parse(options.ConfigProxy)
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "invalid config proxy '%s'", options.ConfigProxy)
+		}
+		httpClient.Transport.(*http.Transport).Proxy = http.ProxyURL(proxyUrl)
+	}
+	return httpClient, nil
+}
+
+// content of the remote config: downloaded one if not yet validated, or last valid one.
+// on first call, it is downloaded, or read from cache if download fails.
+func (r *RemoteConfig) read(configUrl string, httpClient *http.Client) ([]byte, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.url != configUrl {
+		err := checkRemoteUrl(configUrl)
+		if err != nil {
+			return nil, err // no wrap
+		}
+		r.url = configUrl
+		r.valid, r.pending, r.etag, r.lastModified, r.first = r.readCache(), nil, "", "", true
+		if r.valid != nil {
+			r.etag, r.lastModified = r.valid.Etag, r.valid.LastModified
+		}
+		err = r.fetch(httpClient)
+		if err != nil {
+			if r.valid == nil {
+				return nil, err // no wrap
+			}
+			logInfo("[-] Unable to download configuration, using cached copy: %#s", err)
+		}
+	}
+	if r.pending != nil {
+		return r.pending.content, nil
+	}
+	if r.valid != nil {
+		return r.valid.content, nil
+	}
+	return nil, stacktrace.NewError("configuration %s not downloaded", configUrl)
+}
+
+// poll remote config, returning true if a new content has been downloaded
+func (r *RemoteConfig) poll(httpClient *http.Client) (bool, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	err := r.fetch(httpClient)
+	return r.pending != nil, err
+}
+
+// download remote config if modified, into pending content
+func (r *RemoteConfig) fetch(httpClient *http.Client) error {
+	request, err := http.NewRequest(http.MethodGet, r.url, nil)
+	if err != nil {
+		return stacktrace.Propagate(err, "invalid config url %s", r.url)
+	}
+	if r.etag != "" {
+		request.Header.Set("If-None-Match", r.etag)
+	}
+	if r.lastModified != "" {
+		request.Header.Set("If-Modified-Since", r.lastModified)
+	}
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return stacktrace.Propagate(err, "unable to download %s", r.url)
+	}
+	defer func() { _ = response.Body.Close() }()
+	if response.StatusCode == http.StatusNotModified {
+		return nil
+	}
+	if response.StatusCode != http.StatusOK {
+		return stacktrace.NewError("unable to download %s: %s", r.url, response.Status)
+	}
+	content, err := io.ReadAll(response.Body)
+	if err != nil {
+		return stacktrace.Propagate(err, "unable to download %s", r.url)
+	}
+	r.etag, r.lastModified = response.Header.Get("ETag"), response.Header.Get("Last-Modified")
+	r.pending = &remoteContent{Url: r.url, Etag: r.etag, LastModified: r.lastModified, content: content}
+	return nil
+}
+
+// validate or discard pending content, a valid content replacing the cached copy.
+// returns true if the first content is invalid, so the cached copy must be used instead.
+func (r *RemoteConfig) done(valid bool) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	first := r.first
+	r.first = false
+	if r.pending == nil {
+		return false
+	}
+	if valid {
+		r.valid = r.pending
+		err := r.writeCache()
+		if err != nil {
+			logInfo("[-] Unable to cache configuration: %#s", err)
+		}
+	}
+	r.pending = nil
+	return first && !valid && r.valid != nil
+}
+
+// cache file of the remote config, and its metadata file
+func (r *RemoteConfig) cacheFile() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", stacktrace.Propagate(err, "no cache directory")
+	}
+	hash := sha256.Sum256([]byte(r.url))
+	return filepath.Join(dir, AppName, "config-"+hex.EncodeToString(hash[:8])), nil
+}
+
+func (r *RemoteConfig) readCache() *remoteContent {
+	file, err := r.cacheFile()
+	if err != nil {
+		return nil
+	}
+	meta, err := os.ReadFile(file + ".json")
+	if err != nil {
+		return nil
+	}
+	var cached remoteContent
+	if json.Unmarshal(meta, &cached) != nil || cached.Url != r.url {
+		return nil
+	}
+	cached.content, err = os.ReadFile(file)
+	if err != nil {
+		return nil
+	}
+	return &cached
+}
+
+// write cache, which may contain passwords, readable only by current user
+func (r *RemoteConfig) writeCache() error {
+	file, err := r.cacheFile()
+	if err != nil {
+		return err // no wrap
+	}
+	err = os.MkdirAll(filepath.Dir(file), 0700)
+	if err != nil {
+		return stacktrace.Propagate(err, "unable to create cache directory")
+	}
+	meta, _ := json.Marshal(r.valid)
+	err = os.WriteFile(file, r.valid.content, 0600)
+	if err == nil {
+		err = os.WriteFile(file+".json", meta, 0600)
+	}
+	if err != nil {
+		return stacktrace.Propagate(err, "unable to write cache")
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package kpx
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestRemoteConfig(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+	var mutex sync.Mutex
+	content, etag, downloads := "connectTimeout: 7\n", "v1", 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		downloads++
+		w.Header().Set("ETag", etag)
+		_, _ = fmt.Fprint(w, content)
+	}))
+	defer server.Close()
+	remoteConfig = &RemoteConfig{}
+	defer func() { remoteConfig = &RemoteConfig{} }()
+	configUrl := server.URL + "/kpx.yaml"
+	config, err := readConfig(configUrl)
+	if err != nil || config.conf.ConnectTimeout != 7 {
+		t.Fatalf("unexpected config: %v", err)
+	}
+	file, _ := remoteConfig.cacheFile()
+	if cached, _ := os.ReadFile(file); string(cached) != content {
+		t.Fatalf("unexpected cache: %q", cached)
+	}
+	httpClient, _ := config.newRemoteHttpClient()
+	// not modified
+	changed, err := remoteConfig.poll(httpClient)
+	if changed || err != nil || downloads != 1 {
+		t.Fatalf("unexpected poll: %v %v %d", changed, err, downloads)
+	}
+	// an invalid config is downloaded once, and never cached
+	mutex.Lock()
+	content, etag = "connectTimeout: 7\nudpTimeout: -1\n", "v2"
+	mutex.Unlock()
+	changed, _ = remoteConfig.poll(httpClient)
+	if !changed {
+		t.Fatal("expected changed config")
+	}
+	_, err = readConfig(configUrl)
+	if err == nil || !strings.Contains(err.Error(), "udpTimeout") {
+		t.Fatalf("expected invalid config, got %v", err)
+	}
+	changed, _ = remoteConfig.poll(httpClient)
+	if changed || downloads != 2 {
+		t.Fatalf("unexpected poll: %v %d", changed, downloads)
+	}
+	if cached, _ := os.ReadFile(file); string(cached) != "connectTimeout: 7\n" {
+		t.Fatalf("unexpected cache: %q", cached)
+	}
+	// cached copy is used when the downloaded one is invalid on start
+	remoteConfig = &RemoteConfig{}
+	config, err = readConfig(configUrl)
+	if err != nil || config.conf.ConnectTimeout != 7 {
+		t.Fatalf("unexpected config: %v", err)
+	}
+	// cached copy is used when offline
+	server.Close()
+	remoteConfig = &RemoteConfig{}
+	config, err = readConfig(configUrl)
+	if err != nil || config.conf.ConnectTimeout != 7 {
+		t.Fatalf("unexpected config: %v", err)
+	}
+	// no cached copy
+	_ = os.Remove(file)
+	remoteConfig = &RemoteConfig{}
+	_, err = readConfig(configUrl)
+	if err == nil {
+		t.Fatal("expected error without cache")
+	}
+	if filepath.Dir(file) != filepath.Join(os.Getenv("XDG_CACHE_HOME"), AppName) {
+		t.Fatalf("unexpected cache file %s", file)
+	}
+}
+
+func TestRemoteConfigTrust(t *testing.T) {
+	for _, test := range []struct {
+		url   string
+		valid bool
+	}{
+		{"https://config.example.com/kpx.yaml", true},
+		{"http://127.0.0.1:8080/kpx.yaml", true},
+		{"http://localhost/kpx.yaml", true},
+		{"http://config.example.com/kpx.yaml", false},
+	} {
+		if err := checkRemoteUrl(test.url); (err == nil) != test.valid {
+			t.Fatalf("%s: unexpected error %v", test.url, err)
+		}
+	}
+	// commands and password files are not allowed in a remote config
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(w, "credentials:\n  user:\n    login: alice\n    passwordCommand: touch /tmp/pwned\n")
+	}))
+	defer server.Close()
+	remoteConfig = &RemoteConfig{}
+	defer func() { remoteConfig = &RemoteConfig{} }()
+	_, err := readConfig(server.URL + "/kpx.yaml")
+	if err == nil || !strings.Contains(err.Error(), "not allowed in a remote config") {
+		t.Fatalf("expected error, got %v", err)
+	}
+}
@@ -11,6 +11,7 @@ import (
 )
 
 const CT_PLAIN_UTF8 = "text/plain; charset=UTF-8"
+const CT_HTML_UTF8 = "text/html; charset=UTF-8"
 
 //const CT_PROXY_AUTOCONFIG = "application/x-ns-proxy-autoconfig"
 
@@ -21,6 +22,8 @@ type ProxyRequest struct {
 	header *RequestHeader
 	// verbose
 	prefix string
+	// reject ambiguous or malformed messages, see RFC 9112
+	strict bool
 }
 
 type RequestHeader struct {
@@ -48,6 +51,11 @@ type RequestHeader struct {
 	keepAlive         bool
 	contentLength     int64
 	isProxyConnection bool
+	connectionUpgrade bool   // connection header contains 'upgrade'
+	expectContinue    bool   // expect header contains '100-continue'
+	upgrade           string // protocols of upgrade header
+	// parsing
+	strict bool // reject ambiguous or malformed messages, see RFC 9112
 }
 
 type HttpVersion string
@@ -101,38 +109,33 @@ func (r *ProxyRequest) injectHeaders(headers []string) (*RequestHeader, error) {
 	return r.header, nil
 }
 
+// read into buffer until the end of http headers, an empty line.
+// a bare LF is accepted as line terminator, strict parsing rejecting it later.
 func (r *ProxyRequest) ReadFull(buffer []byte) (int, error) {
-	var err error
 	length := 0
-	read := 0
-	pos := 0
-	found := 0
-	b := buffer
+	pos := 1
 	for {
-		read, err = r.conn.Read(b)
-		length += read
-		if err != nil {
-			return length, err // no wrap
+		if length == len(buffer) {
+			return length, stacktrace.NewError("Invalid headers, larger than %d bytes", len(buffer))
 		}
-		// looking for \r\n\r\n (4 chars) at the end of http headers
+		read, err := r.conn.Read(buffer[length:])
+		length += read
+		// looking for LF followed by CRLF or LF at the end of http headers
 		for i := pos; i < length; i++ {
-			if buffer[i] == 13 || buffer[i] == 10 {
-				found++
-				if found == 4 {
-					return length, nil
-				}
-			} else {
-				found = 0
+			if buffer[i] == '\n' && (buffer[i-1] == '\n' || buffer[i-1] == '\r' && i > 1 && buffer[i-2] == '\n') {
+				return length, nil
 			}
 		}
-		pos = length
-		b = buffer[length:]
+		if err != nil {
+			return length, err // no wrap
+		}
+		pos = max(length, 1)
 	}
 }
 
 func (r *ProxyRequest) readHeaders() (*RequestHeader, error) {
 	// init header
-	h := RequestHeader{}
+	h := RequestHeader{strict: r.strict}
 	// read header bytes
 	startData := 0
 	startLine := 0
@@ -150,21 +153,40 @@ func (r *ProxyRequest) readHeaders() (*RequestHeader, error) {
 		return nil, stacktrace.NewError("Invalid request, no headers")
 	}
 	for i := 0; i < readLen; i++ {
-		if buffer[i] == '\r' && i+1 < readLen && buffer[i+1] == '\n' {
-			// if this is an empty line, headers are finished
-			if i == startLine {
-				startData = i + 2
-				break
+		if buffer[i] != '\n' {
+			continue
+		}
+		end := i
+		if end > startLine && buffer[end-1] == '\r' {
+			end--
+		} else if r.strict {
+			return nil, stacktrace.NewError("Invalid headers, bare LF")
+		}
+		header := string(buffer[startLine:end])
+		startLine = i + 1
+		// if this is an empty line, headers are finished
+		if header == "" {
+			startData = i + 1
+			break
+		}
+		if r.prefix != "" {
+			logHeader("%s %s", r.prefix, header)
+		}
+		if r.strict && strings.ContainsAny(header, "\r\x00") {
+			return nil, stacktrace.NewError("Invalid headers, bare CR or NUL: %q", header)
+		}
+		// obsolete line folding, a header value continued on a line starting with a space
+		if header[0] == ' ' || header[0] == '\t' {
+			if r.strict {
+				return nil, stacktrace.NewError("Invalid headers, obsolete line folding: %q", header)
 			}
-			// otherwise this is a new header line
-			header := buffer[startLine:i]
-			if r.prefix != "" {
-				logHeader("%s %s", r.prefix, string(header))
+			// folding is replaced by a space, and whitespace lines before the first header field are ignored
+			if len(headers) > 1 {
+				headers[len(headers)-1] += " " + strings.TrimLeft(header, " \t")
 			}
-			startLine = i + 2
-			headers = append(headers, string(header))
-			i++
+			continue
 		}
+		headers = append(headers, header)
 	}
 	// save headers
 	if len(headers) == 0 {
@@ -177,6 +199,21 @@ func (r *ProxyRequest) readHeaders() (*RequestHeader, error) {
 	return &h, nil
 }
 
+// read request body, only used by local web server, so content-length is required and body is limited to max bytes
+func (r *ProxyRequest) readBody(max int64) ([]byte, error) {
+	length := r.header.contentLength
+	if length < 0 || length > max {
+		return nil, stacktrace.NewError("Invalid request body length: %d", length)
+	}
+	body := make([]byte, length)
+	n := copy(body, r.header.data)
+	_, err := io.ReadFull(r.conn, body[n:])
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "Could not read body")
+	}
+	return body, nil
+}
+
 func (rh *RequestHeader) analyseRequestLine() error {
 	var err error
 	// analyse first line
@@ -185,6 +222,9 @@ func (rh *RequestHeader) analyseRequestLine() error {
 	if len(line) != 3 {
 		return stacktrace.NewError("Invalid request line, expecting 'METHOD URL VERSION': %v", headerLine)
 	}
+	if rh.strict && (!isToken(line[0]) || line[1] == "" || strings.ContainsFunc(line[1], isControl) || line[2] != "HTTP/1.1" && line[2] != "HTTP/1.0") {
+		return stacktrace.NewError("Invalid request line, expecting 'METHOD URL VERSION': %v", headerLine)
+	}
 	rh.method = line[0]
 	rh.url = line[1]
 	rh.lineUrl = line[1]
@@ -246,6 +286,9 @@ func (rh *RequestHeader) analyseResponseLine() error {
 	if len(line) != 3 {
 		return stacktrace.NewError("Invalid request line, expecting 'METHOD URL VERSION': %v", headerLine)
 	}
+	if rh.strict && (line[0] != "HTTP/1.1" && line[0] != "HTTP/1.0" || len(line[1]) != 3) {
+		return stacktrace.NewError("Invalid response line, expecting 'VERSION STATUS REASON': %s", headerLine)
+	}
 	rh.version = GetHttpVersion(line[0])
 	rh.status, err = strconv.Atoi(line[1])
 	if err != nil {
@@ -256,14 +299,24 @@ func (rh *RequestHeader) analyseResponseLine() error {
 }
 
 func (rh *RequestHeader) analyseHeaders(req bool) error {
-	var err error
 	// keep alive is the "request" default for HTTP1.1 and HTTP2
 	// although RFC states that HTTP 1.1 is keep-alive by default, it is not working with windows update when going through kpx > tinyproxy > squid > ...
 	// we decided to state that connection must be closed unless the server explicitly asks for keep-alive
 	rh.keepAlive = req && (rh.version == Http11 || rh.version == Http2)
+	// message framing
+	contentLength := int64(0)
+	lengths := 0
+	hosts := 0
+	var codings []string
 	// loop on headers
 	for i, header := range rh.headers {
+		if i > 0 && rh.strict && !isHeaderField(header) {
+			return stacktrace.NewError("Invalid header: %q", header)
+		}
 		lower := strings.ToLower(header)
+		if strings.HasPrefix(lower, "host:") {
+			hosts++
+		}
 		switch {
 		case rh.host == "" && strings.HasPrefix(lower, "host:"):
 			// https://www.w3.org/Protocols/rfc2616/rfc2616-sec5.html 5.1.2 => request line must use absoluteUri <=> target is a proxy
@@ -346,18 +399,18 @@ func (rh *RequestHeader) analyseHeaders(req bool) error {
 			}
 			rh.hostPort = rh.host + ":" + sport
 			rh.lineUrl = rh.url
-		case strings.HasPrefix(lower, "content-length:") && rh.contentLength == 0:
-			rh.contentLength, err = strconv.ParseInt(strings.TrimSpace(lower[15:]), 10, 64)
+		case strings.HasPrefix(lower, "content-length:"):
+			length, err := parseContentLength(lower[15:])
 			if err != nil {
 				return stacktrace.Propagate(err, "Invalid content-length header: %s", header)
 			}
-			if rh.contentLength < 0 {
-				return stacktrace.NewError("Invalid content-length header: value is < 0")
+			if lengths > 0 && length != contentLength {
+				return stacktrace.NewError("Invalid content-length header: conflicting values")
 			}
+			contentLength = length
+			lengths++
 		case strings.HasPrefix(lower, "transfer-encoding:"):
-			if strings.Contains(lower, "chunk") {
-				rh.contentLength = -1
-			}
+			codings = append(codings, strings.Split(lower[18:], ",")...)
 		case strings.HasPrefix(lower, "proxy-connection:"):
 			rh.isProxyConnection = true
 			fallthrough
@@ -367,11 +420,78 @@ func (rh *RequestHeader) analyseHeaders(req bool) error {
 			} else if strings.Contains(lower, "keep-alive") {
 				rh.keepAlive = true
 			}
+			if strings.Contains(lower, "upgrade") {
+				rh.connectionUpgrade = true
+			}
+		case strings.HasPrefix(lower, "expect:") && strings.Contains(lower, "100-continue"):
+			rh.expectContinue = true
+		case strings.HasPrefix(lower, "upgrade:"):
+			rh.upgrade = strings.TrimSpace(header[8:])
+		}
+	}
+	if rh.strict && req && (hosts > 1 || hosts == 0 && rh.version == Http11) {
+		return stacktrace.NewError("Invalid request, expecting one host header")
+	}
+	// framing, see RFC 9112 section 6.3: transfer-encoding overrides content-length,
+	// and a response without both is delimited by the connection close
+	rh.contentLength = contentLength
+	if !req && lengths == 0 {
+		rh.contentLength = BODY_UNTIL_CLOSE
+	}
+	if len(codings) > 0 {
+		chunked := strings.TrimSpace(codings[len(codings)-1]) == "chunked"
+		// body length of such a request can't be determined, whatever the mode
+		if req && !chunked {
+			return stacktrace.NewError("Invalid transfer-encoding header, chunked must be the final encoding")
+		}
+		if rh.strict {
+			switch {
+			case lengths > 0:
+				return stacktrace.NewError("Invalid headers, both transfer-encoding and content-length")
+			case req && rh.version == Http10:
+				return stacktrace.NewError("Invalid headers, transfer-encoding in HTTP/1.0 request")
+			}
+		}
+		if chunked {
+			rh.contentLength = BODY_CHUNKED
+			// content-length must not be forwarded, as the next hop could use it instead of transfer-encoding
+			rh.removeHeaders("content-length:")
+		} else if !req {
+			rh.contentLength = BODY_UNTIL_CLOSE
 		}
 	}
 	return nil
 }
 
+// remove headers starting with lowercase prefix, except the first line
+func (rh *RequestHeader) removeHeaders(prefix string) {
+	headers := rh.headers[:1]
+	for _, header := range rh.headers[1:] {
+		if !strings.HasPrefix(strings.ToLower(header), prefix) {
+			headers = append(headers, header)
+		}
+	}
+	rh.headers = headers
+}
+
+// request asks to switch protocols, with both upgrade and connection headers
+func (rh *RequestHeader) isUpgrade() bool {
+	return rh.connectionUpgrade && rh.upgrade != ""
+}
+
+// request body is only sent once the server answered with 100 Continue
+func (rh *RequestHeader) expectsContinue() bool {
+	return rh.expectContinue && rh.contentLength != 0
+}
+
+// data read after headers is read again with the next headers
+func (r *ProxyRequest) unread() {
+	if len(r.header.data) > 0 {
+		r.conn.conn = NewBufferedConn(r.conn.conn, r.header.data)
+		r.header.data = nil
+	}
+}
+
 func (r *ProxyRequest) readRequestHeaders() error {
 	rh, err := r.readHeaders()
 	if err != nil {
@@ -489,6 +609,42 @@ func (r ProxyRequest) badRequest() error {
 	return r.writeContent("Bad Request\n", false, CT_PLAIN_UTF8)
 }
 
+func (r ProxyRequest) badRequestContent(content string) error {
+	err := r.writeStatusLine(Http10, 400, "Bad Request")
+	if err != nil {
+		return err // no wrap
+	}
+	err = r.writeDateHeader()
+	if err != nil {
+		return err // no wrap
+	}
+	return r.writeContent(content, false, CT_PLAIN_UTF8)
+}
+
+func (r ProxyRequest) forbidden() error {
+	err := r.writeStatusLine(Http10, 403, "Forbidden")
+	if err != nil {
+		return err // no wrap
+	}
+	err = r.writeDateHeader()
+	if err != nil {
+		return err // no wrap
+	}
+	return r.writeContent("Forbidden\n", false, CT_PLAIN_UTF8)
+}
+
+func (r ProxyRequest) badGateway(content string) error {
+	err := r.writeStatusLine(Http10, 502, "Bad Gateway")
+	if err != nil {
+		return err // no wrap
+	}
+	err = r.writeDateHeader()
+	if err != nil {
+		return err // no wrap
+	}
+	return r.writeContent(content, false, CT_PLAIN_UTF8)
+}
+
 func (r ProxyRequest) notFound() error {
 	err := r.writeStatusLine(Http10, 404, "Not Found")
 	if err != nil {
@@ -528,3 +684,46 @@ func (r *ProxyRequest) writeHeaderLine(line string) error {
 	_, err := r.conn.Write([]byte(fmt.Sprintf("%s\r\n", line)))
 	return err // no wrap
 }
+
+// content-length value, a list of identical values being accepted, see RFC 9110 section 8.6
+func parseContentLength(value string) (int64, error) {
+	length := int64(-1)
+	for _, v := range strings.Split(value, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" || strings.ContainsFunc(v, func(r rune) bool { return r < '0' || r > '9' }) {
+			return 0, stacktrace.NewError("value is not a positive number: %s", v)
+		}
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return 0, stacktrace.Propagate(err, "value is too large: %s", v)
+		}
+		if length >= 0 && n != length {
+			return 0, stacktrace.NewError("values are different: %s", value)
+		}
+		length = n
+	}
+	return length, nil
+}
+
+// header field is 'name: value', without whitespace before colon nor control characters in value
+func isHeaderField(header string) bool {
+	name, value, found := strings.Cut(header, ":")
+	return found && isToken(name) && !strings.ContainsFunc(value, func(r rune) bool { return r != '\t' && isControl(r) })
+}
+
+// token characters, see RFC 9110 section 5.6.2
+func isToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if r > '~' || r <= ' ' || strings.ContainsRune("\"(),/:;<=>?@[\\]{}", r) {
+			return false
+		}
+	}
+	return true
+}
+
+func isControl(r rune) bool {
+	return r < ' ' || r == 0x7f
+}
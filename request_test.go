@@ -0,0 +1,119 @@
+package kpx
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+// request reading the given bytes, then EOF
+func newTestRequest(data string, strict bool) *ProxyRequest {
+	conn, peer := net.Pipe()
+	_ = peer.Close()
+	return &ProxyRequest{conn: NewTimedConn(NewBufferedConn(conn, []byte(data)), nil), strict: strict}
+}
+
+func TestReadRequestHeaders(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		request string
+		lenient int64 // content length, or -9 if rejected
+		strict  int64
+	}{
+		{"valid", "POST http://h/ HTTP/1.1\r\nHost: h\r\nContent-Length: 5\r\n\r\nhello", 5, 5},
+		{"chunked", "POST http://h/ HTTP/1.1\r\nHost: h\r\nTransfer-Encoding: gzip, chunked\r\n\r\n", -1, -1},
+		{"identical lengths", "POST http://h/ HTTP/1.1\r\nHost: h\r\nContent-Length: 5, 5\r\nContent-Length: 5\r\n\r\n", 5, 5},
+		{"conflicting lengths", "POST http://h/ HTTP/1.1\r\nHost: h\r\nContent-Length: 5\r\nContent-Length: 6\r\n\r\n", -9, -9},
+		{"signed length", "POST http://h/ HTTP/1.1\r\nHost: h\r\nContent-Length: +5\r\n\r\n", -9, -9},
+		{"length and chunked", "POST http://h/ HTTP/1.1\r\nHost: h\r\nContent-Length: 5\r\nTransfer-Encoding: chunked\r\n\r\n", -1, -9},
+		{"chunked and length", "POST http://h/ HTTP/1.1\r\nHost: h\r\nTransfer-Encoding: chunked\r\nContent-Length: 5\r\n\r\n", -1, -9},
+		{"chunked not final", "POST http://h/ HTTP/1.1\r\nHost: h\r\nTransfer-Encoding: chunked, gzip\r\n\r\n", -9, -9},
+		{"chunked in HTTP/1.0", "POST http://h/ HTTP/1.0\r\nTransfer-Encoding: chunked\r\n\r\n", -1, -9},
+		{"bare LF", "POST http://h/ HTTP/1.1\nHost: h\nContent-Length: 5\n\n", 5, -9},
+		{"bare CR", "POST http://h/ HTTP/1.1\r\nHost: h\r\nX: a\rb\r\n\r\n", 0, -9},
+		{"obsolete folding", "POST http://h/ HTTP/1.1\r\nHost: h\r\nX: a\r\n b\r\n\r\n", 0, -9},
+		{"space before colon", "POST http://h/ HTTP/1.1\r\nHost: h\r\nContent-Length : 5\r\n\r\n", 0, -9},
+		{"no host", "GET http://h/ HTTP/1.1\r\n\r\n", 0, -9},
+		{"two hosts", "GET http://h/ HTTP/1.1\r\nHost: h\r\nHost: i\r\n\r\n", 0, -9},
+		{"invalid version", "GET http://h/ HTTP/1.1x\r\nHost: h\r\n\r\n", 0, -9},
+		{"invalid method", "G(T http://h/ HTTP/1.1\r\nHost: h\r\n\r\n", 0, -9},
+		{"too large", "GET http://h/ HTTP/1.1\r\nX: " + strings.Repeat("x", HEADER_MAX_SIZE) + "\r\n\r\n", -9, -9},
+	} {
+		for _, strict := range []bool{false, true} {
+			expected := test.lenient
+			if strict {
+				expected = test.strict
+			}
+			r := newTestRequest(test.request, strict)
+			err := r.readRequestHeaders()
+			switch {
+			case expected == -9 && err == nil:
+				t.Errorf("%s (strict=%v): expected error", test.name, strict)
+			case expected != -9 && err != nil:
+				t.Errorf("%s (strict=%v): unexpected error %v", test.name, strict, err)
+			case err == nil && r.header.contentLength != expected:
+				t.Errorf("%s (strict=%v): expected length %d, got %d", test.name, strict, expected, r.header.contentLength)
+			}
+		}
+	}
+	// content-length is not forwarded with chunked transfer-encoding
+	r := newTestRequest("POST http://h/ HTTP/1.1\r\nContent-Length: 5\r\nTransfer-Encoding: chunked\r\n\r\n", false)
+	if err := r.readRequestHeaders(); err != nil || r.findHeader("Content-Length") != nil {
+		t.Fatalf("expected content-length to be removed: %v %v", r.header.headers, err)
+	}
+	// obsolete line folding is replaced by a space
+	r = newTestRequest("GET http://h/ HTTP/1.1\r\nX: a\r\n\tb\r\n\r\n", false)
+	if err := r.readRequestHeaders(); err != nil || *r.findHeader("X") != "a b" {
+		t.Fatalf("expected folded header: %v %v", r.header.headers, err)
+	}
+}
+
+func FuzzReadHeaders(f *testing.F) {
+	f.Add("GET http://h/ HTTP/1.1\r\nHost: h\r\n\r\n", false)
+	f.Add("POST http://h/ HTTP/1.1\r\nHost: h\r\nTransfer-Encoding: chunked\r\nContent-Length: 5\r\n\r\n0\r\n\r\n", true)
+	f.Add("HTTP/1.1 200 OK\nContent-Length: 2\n X\n\nok", false)
+	f.Fuzz(func(t *testing.T, data string, strict bool) {
+		r := newTestRequest(data, strict)
+		header, err := r.readHeaders()
+		if err != nil {
+			return
+		}
+		// data is kept after headers
+		if !strings.HasSuffix(data, string(header.data)) || len(header.data)+header.startData != len(data) {
+			t.Fatalf("unexpected data %q after headers of %q", header.data, data)
+		}
+		for _, line := range header.headers {
+			if line == "" || strings.Contains(line, "\n") || strict && strings.Contains(line, "\r") {
+				t.Fatalf("unexpected header %q", line)
+			}
+		}
+		if header.analyseHeaders(true) != nil {
+			return
+		}
+		if header.contentLength < BODY_CHUNKED {
+			t.Fatalf("unexpected length %d", header.contentLength)
+		}
+		// framing is never ambiguous when forwarding the message
+		for _, line := range header.headers {
+			if header.contentLength == BODY_CHUNKED && strings.HasPrefix(strings.ToLower(line), "content-length:") {
+				t.Fatalf("unexpected content-length with chunked transfer-encoding: %q", header.headers)
+			}
+		}
+	})
+}
+
+func FuzzAnalyseRequestLine(f *testing.F) {
+	f.Add("GET http://h:8080/path?q HTTP/1.1", false)
+	f.Add("CONNECT h:443 HTTP/1.1", true)
+	f.Add("GET /~/https/h/path HTTP/1.0", false)
+	f.Fuzz(func(t *testing.T, line string, strict bool) {
+		header := RequestHeader{headers: []string{line, "Host: h"}, strict: strict}
+		if header.analyseRequestLine() != nil {
+			return
+		}
+		if header.port < 0 || strict && header.version != Http10 && header.version != Http11 {
+			t.Fatalf("unexpected request line %q: port %d, version %s", line, header.port, header.version)
+		}
+		_ = header.analyseHeaders(true)
+	})
+}
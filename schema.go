@@ -0,0 +1,85 @@
+package kpx
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+)
+
+// values allowed for some string fields, by type and field name
+var schemaEnums = map[string][]string{
+	"ConfProxy.Type":        {string(ProxyKerberos), string(ProxySocks), string(ProxyAnonymous), string(ProxyDirect), string(ProxyBasic), string(ProxyNone), string(ProxyPac)},
+	"ConfProxy.Resolve":     {"remote", "local"},
+	"ConfListener.Protocol": {LISTENER_HTTP, LISTENER_SOCKS, LISTENER_TRANSPARENT, LISTENER_ADMIN},
+}
+
+// print JSON schema of the config file
+func schemaCommand(args []string) {
+	if len(args) != 0 {
+		println("invalid arguments")
+		usage()
+	}
+	schema, _ := json.MarshalIndent(confSchema(), "", "  ")
+	fmt.Println(string(schema))
+	os.Exit(0)
+}
+
+// JSON schema of the config file, generated from Conf and its yaml field names
+func confSchema() map[string]any {
+	defs := map[string]any{}
+	schema := typeSchema(reflect.TypeOf(Conf{}), "", defs)
+	schema["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	schema["title"] = AppName + " configuration"
+	schema["$defs"] = defs
+	return schema
+}
+
+// schema of a type, named structs other than Conf being added to defs and referenced
+func typeSchema(t reflect.Type, field string, defs map[string]any) map[string]any {
+	if enum, ok := schemaEnums[field]; ok {
+		return map[string]any{"type": "string", "enum": enum}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return typeSchema(t.Elem(), field, defs)
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int64, reflect.Int32:
+		return map[string]any{"type": "integer"}
+	case reflect.Slice:
+		return map[string]any{"type": "array", "items": typeSchema(t.Elem(), field, defs)}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": typeSchema(t.Elem(), field, defs)}
+	case reflect.Struct:
+		if t.Name() != "Conf" {
+			if _, ok := defs[t.Name()]; !ok {
+				defs[t.Name()] = nil // prevent recursion
+				defs[t.Name()] = structSchema(t, defs)
+			}
+			return map[string]any{"$ref": "#/$defs/" + t.Name()}
+		}
+		return structSchema(t, defs)
+	}
+	return map[string]any{}
+}
+
+// schema of a struct, with its yaml field names, unknown fields being not allowed
+func structSchema(t reflect.Type, defs map[string]any) map[string]any {
+	properties := map[string]any{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+		if name == "" {
+			name = strings.ToLower(field.Name)
+		}
+		properties[name] = typeSchema(field.Type, t.Name()+"."+field.Name, defs)
+	}
+	return map[string]any{"type": "object", "properties": properties, "additionalProperties": false}
+}
@@ -0,0 +1,265 @@
+package kpx
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/palantir/stacktrace"
+	"github.com/txthinking/socks5"
+)
+
+func (p *Process) processSocksConn() {
+	// automatically close connection on exit
+	defer func() { _ = p.conn.Close() }()
+	// set timeout for negotiation
+	p.conn.setTimeout(p.config.conf.ConnectTimeout)
+	// first byte is the protocol version, socks4/4a and socks5 are served on the same port
+	version := make([]byte, 1)
+	_, err := io.ReadFull(p.conn, version)
+	if err != nil {
+		return
+	}
+	p.socksVersion = version[0]
+	var request *socks5.Request
+	switch p.socksVersion {
+	case socks5.Ver:
+		err = p.socksNegotiate(io.MultiReader(bytes.NewReader(version), p.conn))
+		if err != nil {
+			logInfo("[-] Socks negotiation from %s failed: %#s", p.conn.RemoteAddr(), err)
+			return
+		}
+		request, err = socks5.NewRequestFrom(p.conn)
+	case SOCKS4_VERSION:
+		request, err = p.socks4Request()
+	default:
+		err = stacktrace.NewError("unsupported socks version %d", p.socksVersion)
+	}
+	if err != nil {
+		logInfo("[-] Socks request from %s failed: %#s", p.conn.RemoteAddr(), err)
+		return
+	}
+	switch request.Cmd {
+	case socks5.CmdConnect, socks5.CmdBind:
+		p.conn.setTimeout(0)
+		p.processSocks(request)
+	case socks5.CmdUDP:
+		p.conn.setTimeout(0)
+		p.processSocksUdp(request)
+	default:
+		logInfo("[-] TCP socks proxy is not implemented for command %b", request.Cmd)
+		_ = p.socksReply(socks5.RepCommandNotSupported, "0.0.0.0:0")
+	}
+}
+
+// read socks4/4a request after the version byte, converting it to a socks5 request.
+// socks4 has no password, so it is only accepted when 'socksAuth' is none.
+func (p *Process) socks4Request() (*socks5.Request, error) {
+	header := make([]byte, 7)
+	_, err := io.ReadFull(p.conn, header)
+	if err != nil {
+		return nil, err // no wrap
+	}
+	userId, err := readNullTerminated(p.conn, SOCKS4_MAX_FIELD)
+	if err != nil {
+		return nil, err // no wrap
+	}
+	request := &socks5.Request{
+		Ver:     SOCKS4_VERSION,
+		Cmd:     header[0],
+		Atyp:    socks5.ATYPIPv4,
+		DstAddr: header[3:7],
+		DstPort: header[1:3],
+	}
+	// socks4a: ip 0.0.0.x with x != 0 means a domain name follows user id
+	if header[3] == 0 && header[4] == 0 && header[5] == 0 && header[6] != 0 {
+		domain, err := readNullTerminated(p.conn, SOCKS4_MAX_FIELD)
+		if err != nil {
+			return nil, err // no wrap
+		}
+		request.Atyp = socks5.ATYPDomain
+		request.DstAddr = append([]byte{byte(len(domain))}, domain...)
+	}
+	socksAuth := p.socksAuth()
+	if socksAuth != "" && socksAuth != SOCKS_AUTH_NONE {
+		_ = p.socksReply(socks5.RepNotAllowed, "0.0.0.0:0")
+		return nil, stacktrace.NewError("socks4 is not allowed with socksAuth '%s' (user '%s')", socksAuth, userId)
+	}
+	if request.Cmd != socks5.CmdConnect && request.Cmd != socks5.CmdBind {
+		_ = p.socksReply(socks5.RepCommandNotSupported, "0.0.0.0:0")
+		return nil, stacktrace.NewError("unsupported socks4 command %d", request.Cmd)
+	}
+	return request, nil
+}
+
+// read a null terminated string of at most max bytes
+func readNullTerminated(r io.Reader, max int) ([]byte, error) {
+	var result []byte
+	b := make([]byte, 1)
+	for {
+		_, err := io.ReadFull(r, b)
+		if err != nil {
+			return nil, err // no wrap
+		}
+		if b[0] == 0 {
+			return result, nil
+		}
+		if len(result) == max {
+			return nil, stacktrace.NewError("field is too long")
+		}
+		result = append(result, b[0])
+	}
+}
+
+// negotiate authentication method, and check username/password if required by 'socksAuth'
+func (p *Process) socksNegotiate(r io.Reader) error {
+	request, err := socks5.NewNegotiationRequestFrom(r)
+	if err != nil {
+		return err // no wrap
+	}
+	socksAuth := p.socksAuth()
+	method := socks5.MethodUsernamePassword
+	if socksAuth == "" || socksAuth == SOCKS_AUTH_NONE {
+		method = socks5.MethodNone
+	}
+	supported := false
+	for _, m := range request.Methods {
+		if m == method {
+			supported = true
+		}
+	}
+	if !supported {
+		_, _ = socks5.NewNegotiationReply(socks5.MethodUnsupportAll).WriteTo(p.conn)
+		return stacktrace.NewError("client does not support required authentication method %d", method)
+	}
+	_, err = socks5.NewNegotiationReply(method).WriteTo(p.conn)
+	if err != nil {
+		return err // no wrap
+	}
+	if method == socks5.MethodNone {
+		return nil
+	}
+	userPass, err := socks5.NewUserPassNegotiationRequestFrom(p.conn)
+	if err != nil {
+		return err // no wrap
+	}
+	login, password := string(userPass.Uname), string(userPass.Passwd)
+	if socksAuth == SOCKS_AUTH_PER_USER {
+		// username/password are forwarded to upstream proxies with per-user credential, which will check them
+		p.socksLogin, p.socksPassword = login, password
+	} else if !p.checkSocksCredential(socksAuth, login, password) {
+		_, _ = socks5.NewUserPassNegotiationReply(socks5.UserPassStatusFailure).WriteTo(p.conn)
+		return stacktrace.NewError("invalid username/password for user '%s'", login)
+	}
+	_, err = socks5.NewUserPassNegotiationReply(socks5.UserPassStatusSuccess).WriteTo(p.conn)
+	return err // no wrap
+}
+
+// with per-user socks authentication, any username/password is accepted during negotiation,
+// so only upstream proxies with a per-user credential, which check them, can be used
+func (p *Process) socksProxyAllowed(proxy *ConfProxy) bool {
+	return p.transparent || p.socksAuth() != SOCKS_AUTH_PER_USER || proxy.cred != nil && proxy.cred.isPerUser
+}
+
+func (p *Process) checkSocksCredential(name string, login string, password string) bool {
+	cred := p.config.conf.Credentials[name]
+	if cred == nil {
+		return false
+	}
+	credLogin, credPassword := cred.safeGet()
+	if credLogin == nil || credPassword == nil {
+		return false
+	}
+	validLogin := subtle.ConstantTimeCompare([]byte(login), []byte(*credLogin)) == 1
+	validPassword := subtle.ConstantTimeCompare([]byte(password), []byte(*credPassword)) == 1
+	return validLogin && validPassword
+}
+
+// write socks reply in the client protocol version, socks4 replies only contain an ipv4 address
+func (p *Process) socksReply(rep byte, address string) error {
+	// transparent connections have no socks client
+	if p.transparent {
+		return nil
+	}
+	a, addr, port, err := socks5.ParseAddress(address)
+	if err != nil {
+		return err // no wrap
+	}
+	if p.socksVersion == SOCKS4_VERSION {
+		reply := []byte{0, SOCKS4_REJECTED, port[0], port[1], 0, 0, 0, 0}
+		if rep == socks5.RepSuccess {
+			reply[1] = SOCKS4_GRANTED
+		}
+		if a == socks5.ATYPIPv4 {
+			copy(reply[4:], addr)
+		}
+		_, err = p.conn.Write(reply)
+		return err // no wrap
+	}
+	if a == socks5.ATYPDomain {
+		addr = addr[1:]
+	}
+	_, err = socks5.NewReply(rep, a, addr, port).WriteTo(p.conn)
+	return err // no wrap
+}
+
+// socks reply code for a dial error
+func socksReplyCode(err error) byte {
+	if e, ok := err.(*SocksReplyError); ok {
+		return e.rep
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return socks5.RepConnectionRefused
+	}
+	if errors.Is(err, syscall.ENETUNREACH) {
+		return socks5.RepNetworkUnreachable
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return socks5.RepTTLExpired
+	}
+	return socks5.RepHostUnreachable
+}
+
+// bind on the local ip used to reach the target, send first reply, and wait for the target to connect
+func (p *Process) socksBindDirect(hostPort string) (net.Conn, string, error) {
+	localIp := net.IPv4zero
+	// udp dial does not send anything, it only selects the local address
+	if probe, err := net.Dial("udp4", hostPort); err == nil {
+		localIp = probe.LocalAddr().(*net.UDPAddr).IP
+		_ = probe.Close()
+	}
+	ln, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: localIp})
+	if err != nil {
+		return nil, "", stacktrace.Propagate(err, "bind failed")
+	}
+	defer func() { _ = ln.Close() }()
+	err = p.socksReply(socks5.RepSuccess, ln.Addr().String())
+	if err != nil {
+		return nil, "", stacktrace.Propagate(err, "bind reply failed")
+	}
+	// only accept the connection from the target host, if it can be resolved
+	host, _, _ := net.SplitHostPort(hostPort)
+	ips, _ := net.LookupIP(host)
+	_ = ln.SetDeadline(time.Now().Add(SOCKS_BIND_TIMEOUT * time.Second))
+	for {
+		conn, err := ln.AcceptTCP()
+		if err != nil {
+			return nil, "", stacktrace.Propagate(err, "bind accept failed")
+		}
+		remoteIp := conn.RemoteAddr().(*net.TCPAddr).IP
+		allowed := len(ips) == 0
+		for _, ip := range ips {
+			allowed = allowed || ip.Equal(remoteIp)
+		}
+		if allowed {
+			return conn, conn.RemoteAddr().String(), nil
+		}
+		logInfo("[-] Socks bind %s: refused connection from %s", hostPort, conn.RemoteAddr())
+		_ = conn.Close()
+	}
+}
@@ -0,0 +1,189 @@
+package kpx
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/palantir/stacktrace"
+	"github.com/txthinking/socks5"
+	netproxy "golang.org/x/net/proxy"
+)
+
+/*
+Upstream socks client, used for socks proxies in http and socks rules:
+- socksVersion: 5 (default) or 4, where socks4a is used when the target host is sent to the proxy
+- resolve: remote (default) sends the target host to the proxy, local resolves it before sending the ip
+- ssl: connection to the proxy is wrapped in tls
+- via: connection to the proxy is opened through another proxy
+*/
+
+// SocksReplyError is returned when the upstream proxy rejects a request, with the socks5 reply code
+type SocksReplyError struct {
+	rep byte
+}
+
+func (e *SocksReplyError) Error() string {
+	return fmt.Sprintf("socks request rejected by upstream proxy with code %d", e.rep)
+}
+
+// connect to hostPort through an upstream socks proxy
+func (p *Process) dialSocks(dialer *net.Dialer, proxy *ConfProxy, proxyHostPort string, auth *netproxy.Auth, hostPort string) (net.Conn, error) {
+	conn, _, err := p.socksUpstreamCommand(dialer, proxy, proxyHostPort, auth, socks5.CmdConnect, hostPort)
+	return conn, err // no wrap
+}
+
+// bind on upstream socks proxy, forwarding its first reply to the client and waiting for its second reply
+func (p *Process) socksBindUpstream(dialer *net.Dialer, proxy *ConfProxy, proxyHostPort string, auth *netproxy.Auth, hostPort string) (net.Conn, string, error) {
+	conn, addr, err := p.socksUpstreamCommand(dialer, proxy, proxyHostPort, auth, socks5.CmdBind, hostPort)
+	if err != nil {
+		return nil, "", err // no wrap
+	}
+	err = p.socksReply(socks5.RepSuccess, addr)
+	if err == nil {
+		_ = conn.SetDeadline(time.Now().Add(SOCKS_BIND_TIMEOUT * time.Second))
+		addr, err = socksUpstreamReply(conn, proxy.socksVersion())
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, "", err // no wrap
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return conn, addr, nil
+}
+
+// open a connection to the upstream socks proxy, send the command and read the first reply, returning its address
+func (p *Process) socksUpstreamCommand(dialer *net.Dialer, proxy *ConfProxy, proxyHostPort string, auth *netproxy.Auth, cmd byte, hostPort string) (net.Conn, string, error) {
+	host, port, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return nil, "", stacktrace.Propagate(err, "invalid address %s", hostPort)
+	}
+	portNumber, err := strconv.Atoi(port)
+	if err != nil || portNumber < 0 || portNumber > 65535 {
+		return nil, "", stacktrace.NewError("invalid port in address %s", hostPort)
+	}
+	// resolve host locally if required, socks4 without 'a' only accepts ipv4
+	if proxy.Resolve == SOCKS_RESOLVE_LOCAL && net.ParseIP(host) == nil {
+		addr, err := net.ResolveTCPAddr("tcp4", hostPort)
+		if err != nil {
+			return nil, "", stacktrace.Propagate(err, "unable to resolve %s", host)
+		}
+		host = addr.IP.String()
+	}
+	conn, err := p.dialProxy(dialer, proxy, proxyHostPort)
+	if err != nil {
+		return nil, "", err // no wrap
+	}
+	_ = conn.SetDeadline(time.Now().Add(dialer.Timeout))
+	if proxy.socksVersion() == SOCKS4_VERSION {
+		err = socks4UpstreamRequest(conn, auth, cmd, host, portNumber)
+	} else {
+		err = socks5UpstreamRequest(conn, auth, cmd, host, portNumber)
+	}
+	var addr string
+	if err == nil {
+		addr, err = socksUpstreamReply(conn, proxy.socksVersion())
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, "", err // no wrap
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return conn, addr, nil
+}
+
+func socks4UpstreamRequest(conn net.Conn, auth *netproxy.Auth, cmd byte, host string, port int) error {
+	request := []byte{SOCKS4_VERSION, cmd, byte(port >> 8), byte(port)}
+	ip := net.ParseIP(host).To4()
+	socks4a := ip == nil
+	if socks4a {
+		// socks4a: invalid ip 0.0.0.1, with the host after user id
+		ip = net.IPv4(0, 0, 0, 1).To4()
+	}
+	request = append(request, ip...)
+	// socks4 has no password, user id is the login
+	if auth != nil {
+		request = append(request, auth.User...)
+	}
+	request = append(request, 0)
+	if socks4a {
+		request = append(request, host...)
+		request = append(request, 0)
+	}
+	_, err := conn.Write(request)
+	return err // no wrap
+}
+
+func socks5UpstreamRequest(conn net.Conn, auth *netproxy.Auth, cmd byte, host string, port int) error {
+	method := socks5.MethodNone
+	if auth != nil && auth.User != "" {
+		method = socks5.MethodUsernamePassword
+	}
+	_, err := socks5.NewNegotiationRequest([]byte{method}).WriteTo(conn)
+	if err != nil {
+		return err // no wrap
+	}
+	negotiationReply, err := socks5.NewNegotiationReplyFrom(conn)
+	if err != nil {
+		return err // no wrap
+	}
+	if negotiationReply.Method != method {
+		return stacktrace.NewError("upstream proxy does not support authentication method %d", method)
+	}
+	if method == socks5.MethodUsernamePassword {
+		_, err = socks5.NewUserPassNegotiationRequest([]byte(auth.User), []byte(auth.Password)).WriteTo(conn)
+		if err != nil {
+			return err // no wrap
+		}
+		userPassReply, err := socks5.NewUserPassNegotiationReplyFrom(conn)
+		if err != nil {
+			return err // no wrap
+		}
+		if userPassReply.Status != socks5.UserPassStatusSuccess {
+			// same message as x/net/proxy, to detect rejected credentials
+			return stacktrace.NewError("username/password authentication failed")
+		}
+	}
+	a, addr, portBytes, err := socks5.ParseAddress(net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		return err // no wrap
+	}
+	if a == socks5.ATYPDomain {
+		addr = addr[1:]
+	}
+	_, err = socks5.NewRequest(cmd, a, addr, portBytes).WriteTo(conn)
+	return err // no wrap
+}
+
+// read a reply from upstream socks proxy, returning its address
+func socksUpstreamReply(conn net.Conn, version byte) (string, error) {
+	if version == SOCKS4_VERSION {
+		reply := make([]byte, 8)
+		_, err := io.ReadFull(conn, reply)
+		if err != nil {
+			return "", err // no wrap
+		}
+		if reply[1] != SOCKS4_GRANTED {
+			return "", &SocksReplyError{rep: socks5.RepHostUnreachable}
+		}
+		ip := net.IP(reply[4:8])
+		// unspecified ip means the ip of the proxy
+		if ip.IsUnspecified() {
+			if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+				ip = addr.IP
+			}
+		}
+		return net.JoinHostPort(ip.String(), strconv.Itoa(int(binary.BigEndian.Uint16(reply[2:4])))), nil
+	}
+	reply, err := socks5.NewReplyFrom(conn)
+	if err != nil {
+		return "", err // no wrap
+	}
+	if reply.Rep != socks5.RepSuccess {
+		return "", &SocksReplyError{rep: reply.Rep}
+	}
+	return reply.Address(), nil
+}
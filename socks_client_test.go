@@ -0,0 +1,46 @@
+package kpx
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestDialSocks(t *testing.T) {
+	port := newTestEchoServer(t)
+	// upstream socks server is kpx itself, which supports socks4/4a/5, with a dns override to localhost
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go newTestSocksProxy(t).serve(ln, &ConfListener{Protocol: LISTENER_SOCKS})
+	proxyName := "up"
+	p := NewProcess(newTestSocksProxy(t), nil)
+	tests := []struct {
+		socksVersion int
+		resolve      string
+		host         string
+	}{
+		{0, "", "echo.example.com"},
+		{SOCKS5_VERSION, SOCKS_RESOLVE_LOCAL, "localhost"},
+		{SOCKS4_VERSION, SOCKS_RESOLVE_REMOTE, "echo.example.com"},
+		{SOCKS4_VERSION, SOCKS_RESOLVE_LOCAL, "localhost"},
+	}
+	for i, test := range tests {
+		proxy := &ConfProxy{name: &proxyName, SocksVersion: test.socksVersion, Resolve: test.resolve}
+		dialer := &net.Dialer{Timeout: 5 * time.Second}
+		conn, err := p.dialSocks(dialer, proxy, ln.Addr().String(), nil, net.JoinHostPort(test.host, strconv.Itoa(port)))
+		if err != nil {
+			t.Fatalf("test %d: %v", i, err)
+		}
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		expectEcho(t, conn)
+		_ = conn.Close()
+	}
+	// unknown host can't be resolved locally
+	proxy := &ConfProxy{name: &proxyName, Resolve: SOCKS_RESOLVE_LOCAL}
+	if _, err = p.dialSocks(&net.Dialer{Timeout: 5 * time.Second}, proxy, ln.Addr().String(), nil, "host.invalid:80"); err == nil {
+		t.Fatalf("expected local resolution error")
+	}
+}
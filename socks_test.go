@@ -0,0 +1,305 @@
+package kpx
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/txthinking/socks5"
+)
+
+func newTestSocksProcess(socksAuth string) (*Process, net.Conn) {
+	login, password := "alice", "secret"
+	server, client := net.Pipe()
+	p := &Process{
+		config: &Config{conf: Conf{
+			SocksAuth:   socksAuth,
+			Credentials: map[string]*ConfCred{"sock": {Login: &login, Password: &password}},
+		}},
+		conn: NewTimedConn(server, newTraceInfo(0, "client")),
+	}
+	return p, client
+}
+
+// run client side of negotiation, returning the selected method and the username/password status if any
+func socksClientNegotiate(t *testing.T, client net.Conn, methods []byte, user string, password string) (byte, byte) {
+	_, err := socks5.NewNegotiationRequest(methods).WriteTo(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, err := socks5.NewNegotiationReplyFrom(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.Method != socks5.MethodUsernamePassword {
+		return reply.Method, 0
+	}
+	_, err = socks5.NewUserPassNegotiationRequest([]byte(user), []byte(password)).WriteTo(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userPassReply, err := socks5.NewUserPassNegotiationReplyFrom(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reply.Method, userPassReply.Status
+}
+
+func TestSocksNegotiate(t *testing.T) {
+	tests := []struct {
+		socksAuth string
+		methods   []byte
+		user      string
+		password  string
+		method    byte
+		status    byte
+		valid     bool
+	}{
+		{"", []byte{socks5.MethodNone}, "", "", socks5.MethodNone, 0, true},
+		{"sock", []byte{socks5.MethodNone}, "", "", socks5.MethodUnsupportAll, 0, false},
+		{"sock", []byte{socks5.MethodNone, socks5.MethodUsernamePassword}, "alice", "secret", socks5.MethodUsernamePassword, socks5.UserPassStatusSuccess, true},
+		{"sock", []byte{socks5.MethodUsernamePassword}, "alice", "bad", socks5.MethodUsernamePassword, socks5.UserPassStatusFailure, false},
+		{SOCKS_AUTH_PER_USER, []byte{socks5.MethodUsernamePassword}, "bob", "any", socks5.MethodUsernamePassword, socks5.UserPassStatusSuccess, true},
+	}
+	for i, test := range tests {
+		p, client := newTestSocksProcess(test.socksAuth)
+		errChan := make(chan error, 1)
+		go func() { errChan <- p.socksNegotiate(p.conn) }()
+		method, status := socksClientNegotiate(t, client, test.methods, test.user, test.password)
+		err := <-errChan
+		if method != test.method || status != test.status || (err == nil) != test.valid {
+			t.Fatalf("test %d: unexpected method=%d status=%d err=%v", i, method, status, err)
+		}
+		if test.socksAuth == SOCKS_AUTH_PER_USER && (p.socksLogin != test.user || p.socksPassword != test.password) {
+			t.Fatalf("test %d: per-user credentials not kept", i)
+		}
+		_ = client.Close()
+	}
+}
+
+func TestSocksPerUserDirect(t *testing.T) {
+	port := newTestEchoServer(t)
+	server, client := net.Pipe()
+	done := make(chan struct{})
+	defer func() {
+		_ = client.Close()
+		<-done
+	}()
+	// listener check is bypassed, username/password must not be accepted for a direct connection
+	p := NewProcess(newTestSocksProxy(t), server)
+	p.listener = &ConfListener{Protocol: LISTENER_SOCKS, Auth: SOCKS_AUTH_PER_USER}
+	go func() {
+		p.processSocksConn()
+		close(done)
+	}()
+	_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+	socksClientNegotiate(t, client, []byte{socks5.MethodUsernamePassword}, "bogus", "bogus")
+	_, err := socks5.NewRequest(socks5.CmdConnect, socks5.ATYPDomain, []byte("echo.example.com"), []byte{byte(port >> 8), byte(port)}).WriteTo(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, err := socks5.NewReplyFrom(client)
+	if err != nil || reply.Rep != socks5.RepNotAllowed {
+		t.Fatalf("unexpected reply: %v %v", reply, err)
+	}
+}
+
+// proxy with a direct socks rule, and a dns override to localhost
+func newTestSocksProxy(t *testing.T) *Proxy {
+	return newTestSocksProxyConfig(t, "socksRules:\n  - host: \"*\"\n    proxy: direct\n    dns: 127.0.0.1\n")
+}
+
+func newTestSocksProxyConfig(t *testing.T, content string) *Proxy {
+	file := filepath.Join(t.TempDir(), "kpx.yaml")
+	_ = os.WriteFile(file, []byte(content), 0600)
+	config, err := NewConfig(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := &Proxy{}
+	_ = proxy.init()
+	proxy.setConfig(config)
+	return proxy
+}
+
+// tcp echo server, returning its port
+func newTestEchoServer(t *testing.T) int {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(conn, conn)
+				_ = conn.Close()
+			}()
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+func expectEcho(t *testing.T, conn net.Conn) {
+	_, err := conn.Write([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buffer := make([]byte, 5)
+	_, err = io.ReadFull(conn, buffer)
+	if err != nil || string(buffer) != "hello" {
+		t.Fatalf("unexpected echo: %q %v", buffer, err)
+	}
+}
+
+func TestSocks4aConnect(t *testing.T) {
+	port := newTestEchoServer(t)
+	server, client := net.Pipe()
+	done := make(chan struct{})
+	defer func() {
+		_ = client.Close()
+		<-done
+	}()
+	go func() {
+		NewProcess(newTestSocksProxy(t), server).processSocksConn()
+		close(done)
+	}()
+	_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+	// socks4a request with user id and domain name, resolved to localhost by the dns override
+	request := append([]byte{SOCKS4_VERSION, socks5.CmdConnect, byte(port >> 8), byte(port), 0, 0, 0, 1}, []byte("user\x00echo.example.com\x00")...)
+	_, err := client.Write(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 8)
+	_, err = io.ReadFull(client, reply)
+	if err != nil || reply[0] != 0 || reply[1] != SOCKS4_GRANTED {
+		t.Fatalf("unexpected reply: %v %v", reply, err)
+	}
+	expectEcho(t, client)
+}
+
+func TestSocksBind(t *testing.T) {
+	server, client := net.Pipe()
+	done := make(chan struct{})
+	defer func() {
+		_ = client.Close()
+		<-done
+	}()
+	go func() {
+		NewProcess(newTestSocksProxy(t), server).processSocksConn()
+		close(done)
+	}()
+	_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+	socksClientNegotiate(t, client, []byte{socks5.MethodNone}, "", "")
+	_, err := socks5.NewRequest(socks5.CmdBind, socks5.ATYPDomain, []byte("peer.example.com"), []byte{0, 21}).WriteTo(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// first reply is the address to connect to
+	reply, err := socks5.NewReplyFrom(client)
+	if err != nil || reply.Rep != socks5.RepSuccess {
+		t.Fatalf("unexpected first reply: %v %v", reply, err)
+	}
+	_, port, _ := net.SplitHostPort(reply.Address())
+	peer, err := net.Dial("tcp4", "127.0.0.1:"+port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = peer.Close() }()
+	// second reply is the address of the incoming connection
+	reply, err = socks5.NewReplyFrom(client)
+	if err != nil || reply.Rep != socks5.RepSuccess || reply.Address() != peer.LocalAddr().String() {
+		t.Fatalf("unexpected second reply: %v %v", reply, err)
+	}
+	go func() { _, _ = io.Copy(peer, peer) }()
+	expectEcho(t, client)
+}
+
+// http proxy accepting CONNECT with basic authentication alice:secret, then calling established to answer and use the tunnel
+func newTestHttpConnectProxy(t *testing.T, established func(conn net.Conn, request *http.Request)) int {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer func() { _ = conn.Close() }()
+				request, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil || request.Method != "CONNECT" {
+					return
+				}
+				if request.Header.Get("Proxy-Authorization") != "Basic "+base64.StdEncoding.EncodeToString([]byte("alice:secret")) {
+					_, _ = conn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\nContent-Length: 0\r\n\r\n"))
+					return
+				}
+				established(conn, request)
+			}()
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+func TestSocksThroughHttpProxy(t *testing.T) {
+	port := newTestHttpConnectProxy(t, func(conn net.Conn, _ *http.Request) {
+		// data sent with the response must be forwarded to the client
+		_, _ = conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\nhi"))
+		_, _ = io.Copy(conn, conn)
+	})
+	tests := []struct {
+		password string
+		rep      byte
+	}{
+		{"secret", socks5.RepSuccess},
+		{"bad", socks5.RepNotAllowed},
+	}
+	for i, test := range tests {
+		config := fmt.Sprintf("proxies:\n  up:\n    type: basic\n    host: 127.0.0.1\n    port: %d\n    credential: user\n"+
+			"credentials:\n  user:\n    login: alice\n    password: %s\n"+
+			"socksRules:\n  - host: \"*\"\n    proxy: up\n", port, test.password)
+		server, client := net.Pipe()
+		done := make(chan struct{})
+		go func() {
+			NewProcess(newTestSocksProxyConfig(t, config), server).processSocksConn()
+			close(done)
+		}()
+		_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+		socksClientNegotiate(t, client, []byte{socks5.MethodNone}, "", "")
+		_, err := socks5.NewRequest(socks5.CmdConnect, socks5.ATYPDomain, []byte("www.example.com"), []byte{1, 187}).WriteTo(client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reply, err := socks5.NewReplyFrom(client)
+		if err != nil || reply.Rep != test.rep {
+			t.Fatalf("test %d: unexpected reply: %v %v", i, reply, err)
+		}
+		if test.rep == socks5.RepSuccess {
+			buffer := make([]byte, 2)
+			_, err = io.ReadFull(client, buffer)
+			if err != nil || string(buffer) != "hi" {
+				t.Fatalf("test %d: unexpected data: %q %v", i, buffer, err)
+			}
+			expectEcho(t, client)
+		}
+		// process must be done before next test, it reads globals set by each config
+		_ = client.Close()
+		<-done
+	}
+}
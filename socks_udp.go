@@ -0,0 +1,296 @@
+package kpx
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/palantir/stacktrace"
+	"github.com/txthinking/socks5"
+)
+
+/*
+UdpAssociation relays datagrams of a socks5 UDP ASSOCIATE request:
+- client sends datagrams to the relay socket, which are forwarded to a remote connection per destination
+- remote connections are direct UDP connections, or UDP associations with upstream socks proxies
+- association ends when the TCP control connection is closed, or when there is no traffic for 'udpTimeout' seconds
+*/
+type UdpAssociation struct {
+	process      *Process
+	relay        *net.UDPConn
+	clientIp     net.IP
+	clientPort   int // expected client port, 0 if not known in advance
+	client       atomic.Pointer[net.UDPAddr]
+	remotes      map[string]*UdpRemote
+	remotesMutex sync.Mutex
+	timeout      time.Duration
+	lastUsed     atomic.Int64
+	closed       atomic.Bool
+}
+
+type UdpRemote struct {
+	conn     net.Conn
+	header   []byte // socks5 datagram header sent back to client, with original destination
+	lastUsed atomic.Int64
+}
+
+func (p *Process) processSocksUdp(request *socks5.Request) {
+	// relay socket listens on the same ip as the control connection
+	localIp := net.IPv4zero
+	if addr, ok := p.conn.LocalAddr().(*net.TCPAddr); ok {
+		localIp = addr.IP
+	}
+	relay, err := net.ListenUDP("udp4", &net.UDPAddr{IP: localIp})
+	if err != nil {
+		logError("[-] Socks udp relay creation failed: %#s", err)
+		_ = p.socksReply(socks5.RepServerFailure, "0.0.0.0:0")
+		return
+	}
+	ua := &UdpAssociation{
+		process: p,
+		relay:   relay,
+		remotes: map[string]*UdpRemote{},
+		timeout: time.Duration(p.config.conf.UdpTimeout) * time.Second,
+	}
+	ua.clientIp = net.IPv4zero
+	if addr, ok := p.conn.RemoteAddr().(*net.TCPAddr); ok {
+		ua.clientIp = addr.IP
+	}
+	if request.Atyp == socks5.ATYPIPv4 || request.Atyp == socks5.ATYPIPv6 {
+		if _, port, err := net.SplitHostPort(request.Address()); err == nil {
+			ua.clientPort, _ = strconv.Atoi(port)
+		}
+	}
+	ua.touch()
+	err = p.socksReply(socks5.RepSuccess, relay.LocalAddr().String())
+	if err != nil {
+		_ = relay.Close()
+		return
+	}
+	p.verbose = p.config.conf.Verbose || debug || trace
+	if p.verbose {
+		logInfo("[-] socks udp association %s <=> %s", p.conn.RemoteAddr(), relay.LocalAddr())
+	}
+	// association ends when control connection is closed
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buffer := make([]byte, 1)
+		for {
+			if _, err := p.conn.Read(buffer); err != nil {
+				break
+			}
+		}
+		ua.close()
+	}()
+	ua.serve()
+	// control connection is closed by serve, wait for its reader to return
+	<-done
+}
+
+func (ua *UdpAssociation) touch() {
+	ua.lastUsed.Store(time.Now().UnixNano())
+}
+
+func (ua *UdpAssociation) idle(lastUsed int64) bool {
+	return time.Since(time.Unix(0, lastUsed)) >= ua.timeout
+}
+
+func (ua *UdpAssociation) close() {
+	if ua.closed.Swap(true) {
+		return
+	}
+	_ = ua.relay.Close()
+	_ = ua.process.conn.Close()
+	ua.remotesMutex.Lock()
+	defer ua.remotesMutex.Unlock()
+	for key, remote := range ua.remotes {
+		_ = remote.conn.Close()
+		delete(ua.remotes, key)
+	}
+}
+
+// read datagrams from client and forward them to their destination
+func (ua *UdpAssociation) serve() {
+	defer ua.close()
+	buffer := make([]byte, UDP_MAX_SIZE)
+	for !ua.closed.Load() {
+		_ = ua.relay.SetReadDeadline(time.Now().Add(ua.timeout))
+		n, addr, err := ua.relay.ReadFromUDP(buffer)
+		if err != nil {
+			if e, ok := err.(net.Error); ok && e.Timeout() && !ua.idle(ua.lastUsed.Load()) {
+				continue
+			}
+			return
+		}
+		// only accept datagrams from the client of the control connection
+		if !addr.IP.Equal(ua.clientIp) && !ua.clientIp.IsUnspecified() {
+			continue
+		}
+		client := ua.client.Load()
+		if client == nil {
+			if ua.clientPort != 0 && addr.Port != ua.clientPort {
+				continue
+			}
+			ua.client.Store(addr)
+		} else if client.Port != addr.Port {
+			continue
+		}
+		datagram, err := socks5.NewDatagramFromBytes(buffer[:n])
+		if err != nil || datagram.Frag != 0 {
+			// fragmentation is not supported
+			continue
+		}
+		ua.touch()
+		remote, err := ua.getRemote(datagram)
+		if err != nil {
+			logError("[-] socks udp %s => %s: %#s", addr, datagram.Address(), err)
+			continue
+		}
+		if remote == nil {
+			continue
+		}
+		remote.lastUsed.Store(time.Now().UnixNano())
+		_, _ = remote.conn.Write(datagram.Data)
+	}
+}
+
+// get or create remote connection for the datagram destination, using socksRules
+func (ua *UdpAssociation) getRemote(datagram *socks5.Datagram) (*UdpRemote, error) {
+	p := ua.process
+	requestHostPort := datagram.Address()
+	ua.remotesMutex.Lock()
+	remote := ua.remotes[requestHostPort]
+	ua.remotesMutex.Unlock()
+	if remote != nil || ua.closed.Load() {
+		return remote, nil
+	}
+	// find matching rule and proxy
+	rule, proxies := p.config.matchListener(p.listener, requestHostPort, requestHostPort, true)
+	firstProxy, firstHostPort := p.findFirstProxy(rule, proxies)
+	if rule == nil || firstProxy == nil || *firstProxy.Type == ProxyNone {
+		return nil, nil
+	}
+	if !p.socksProxyAllowed(firstProxy) {
+		return nil, stacktrace.NewError("proxy '%s' without per-user credential is not allowed with per-user authentication", *firstProxy.name)
+	}
+	verbose := p.verbose
+	if firstProxy.Verbose != nil {
+		verbose = *firstProxy.Verbose || debug || trace
+	}
+	if rule.Verbose != nil {
+		verbose = *rule.Verbose || debug || trace
+	}
+	if verbose {
+		logInfo("[%s] socks udp %s => %s", *firstProxy.name, requestHostPort, firstHostPort)
+	}
+	hostPort := requestHostPort
+	if rule.Dns != nil {
+		h, port := splitHostPort(hostPort, "", "", false)
+		h2, p2 := splitHostPort(*rule.Dns, h, port, false)
+		hostPort = net.JoinHostPort(h2, p2)
+	}
+	var conn net.Conn
+	var err error
+	switch *firstProxy.Type {
+	case ProxyDirect:
+		dialer := net.Dialer{Timeout: time.Duration(p.config.conf.ConnectTimeout) * time.Second}
+		conn, err = dialer.Dial("udp4", hostPort)
+	case ProxySocks:
+		if firstProxy.socksVersion() != SOCKS5_VERSION || firstProxy.Ssl || firstProxy.via != nil {
+			return nil, stacktrace.NewError("proxy '%s' does not support udp, as it is a socks4, ssl or via proxy", *firstProxy.name)
+		}
+		if firstProxy.Resolve == SOCKS_RESOLVE_LOCAL {
+			addr, err := net.ResolveUDPAddr("udp4", hostPort)
+			if err != nil {
+				return nil, stacktrace.Propagate(err, "unable to resolve %s", hostPort)
+			}
+			hostPort = addr.String()
+		}
+		login, password, ok := p.socksUpstreamAuth(firstProxy)
+		if !ok {
+			return nil, stacktrace.NewError("no credentials available for proxy '%s'", *firstProxy.name)
+		}
+		var client *socks5.Client
+		client, err = socks5.NewClient(firstHostPort, login, password, p.config.conf.ConnectTimeout, 0)
+		if err == nil {
+			conn, err = client.Dial("udp", hostPort)
+		}
+		if err != nil && firstProxy.cred != nil && isSocksAuthFailure(err) {
+			p.proxy.credentialFailed(firstProxy.cred, err)
+		}
+	default:
+		return nil, stacktrace.NewError("proxy '%s' does not support udp", *firstProxy.name)
+	}
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "dial failed")
+	}
+	header := (&socks5.Datagram{Rsv: []byte{0, 0}, Atyp: datagram.Atyp, DstAddr: datagram.DstAddr, DstPort: datagram.DstPort}).Bytes()
+	remote = &UdpRemote{
+		conn:   conn,
+		header: header,
+	}
+	remote.lastUsed.Store(time.Now().UnixNano())
+	// dial is done without lock, association may have been closed or remote created meanwhile
+	ua.remotesMutex.Lock()
+	defer ua.remotesMutex.Unlock()
+	if existing := ua.remotes[requestHostPort]; existing != nil || ua.closed.Load() {
+		_ = conn.Close()
+		return existing, nil
+	}
+	ua.remotes[requestHostPort] = remote
+	go ua.serveRemote(requestHostPort, remote)
+	return remote, nil
+}
+
+// read datagrams from remote and send them back to client
+func (ua *UdpAssociation) serveRemote(key string, remote *UdpRemote) {
+	defer func() {
+		ua.remotesMutex.Lock()
+		if ua.remotes[key] == remote {
+			delete(ua.remotes, key)
+		}
+		ua.remotesMutex.Unlock()
+		_ = remote.conn.Close()
+	}()
+	buffer := make([]byte, UDP_MAX_SIZE)
+	for !ua.closed.Load() {
+		_ = remote.conn.SetReadDeadline(time.Now().Add(ua.timeout))
+		n, err := remote.conn.Read(buffer)
+		if err != nil {
+			if e, ok := err.(net.Error); ok && e.Timeout() && !ua.idle(remote.lastUsed.Load()) {
+				continue
+			}
+			return
+		}
+		client := ua.client.Load()
+		if client == nil {
+			continue
+		}
+		remote.lastUsed.Store(time.Now().UnixNano())
+		ua.touch()
+		_, _ = ua.relay.WriteToUDP(append(remote.header[:len(remote.header):len(remote.header)], buffer[:n]...), client)
+	}
+}
+
+// username/password to use with an upstream socks proxy
+func (p *Process) socksUpstreamAuth(proxy *ConfProxy) (string, string, bool) {
+	if proxy.cred == nil {
+		return "", "", true
+	}
+	if ok, message := p.proxy.checkCredential(proxy.cred); !ok {
+		logInfo("[%s] socks udp: %s", *proxy.name, strings.SplitN(message, "\n", 2)[0])
+		return "", "", false
+	}
+	if proxy.cred.isPerUser {
+		return p.socksLogin, p.socksPassword, p.socksLogin != ""
+	}
+	login, password := proxy.cred.safeGet()
+	if login == nil || password == nil {
+		return "", "", false
+	}
+	return *login, *password, true
+}
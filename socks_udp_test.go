@@ -0,0 +1,70 @@
+package kpx
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/txthinking/socks5"
+)
+
+func TestSocksUdpAssociate(t *testing.T) {
+	// udp echo server
+	echo, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = echo.Close() }()
+	go func() {
+		buffer := make([]byte, 1024)
+		for {
+			n, addr, err := echo.ReadFromUDP(buffer)
+			if err != nil {
+				return
+			}
+			_, _ = echo.WriteToUDP(buffer[:n], addr)
+		}
+	}()
+	// control connection
+	server, client := net.Pipe()
+	done := make(chan struct{})
+	defer func() {
+		_ = client.Close()
+		<-done
+	}()
+	go func() {
+		NewProcess(newTestSocksProxy(t), server).processSocksUdp(&socks5.Request{Cmd: socks5.CmdUDP, Atyp: socks5.ATYPIPv4, DstAddr: []byte{0, 0, 0, 0}, DstPort: []byte{0, 0}})
+		close(done)
+	}()
+	_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+	reply, err := socks5.NewReplyFrom(client)
+	if err != nil || reply.Rep != socks5.RepSuccess {
+		t.Fatalf("unexpected reply: %v %v", reply, err)
+	}
+	_, port, _ := net.SplitHostPort(reply.Address())
+	relay, err := net.Dial("udp4", net.JoinHostPort("127.0.0.1", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = relay.SetDeadline(time.Now().Add(5 * time.Second))
+	// send to a fake host, dns override sends it to the echo server
+	echoPort := echo.LocalAddr().(*net.UDPAddr).Port
+	datagram := socks5.NewDatagram(socks5.ATYPDomain, []byte("echo.example.com"), []byte{byte(echoPort >> 8), byte(echoPort)}, []byte("hello"))
+	_, err = relay.Write(datagram.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	buffer := make([]byte, 1024)
+	n, err := relay.Read(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := socks5.NewDatagramFromBytes(buffer[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(response.Data, []byte("hello")) || response.Address() != datagram.Address() {
+		t.Fatalf("unexpected response: %s %q", response.Address(), response.Data)
+	}
+}
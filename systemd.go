@@ -0,0 +1,66 @@
+package kpx
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/palantir/stacktrace"
+)
+
+/*
+Systemd integration:
+- socket activation: sockets passed by systemd with LISTEN_PID, LISTEN_FDS and LISTEN_FDNAMES, used by 'systemd' listeners
+- notifications: READY, RELOADING and STOPPING states sent to NOTIFY_SOCKET, for services with Type=notify
+*/
+
+var systemdOnce sync.Once
+var systemdFiles map[string]*os.File
+
+// find a socket passed by systemd, by its name or its index
+func systemdListener(name string) (net.Listener, error) {
+	systemdOnce.Do(func() {
+		systemdFiles = map[string]*os.File{}
+		if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+			return
+		}
+		count, _ := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+		names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+		for i := 0; i < count; i++ {
+			file := os.NewFile(uintptr(SD_LISTEN_FDS_START+i), "systemd:"+strconv.Itoa(i))
+			systemdFiles[strconv.Itoa(i)] = file
+			if i < len(names) && names[i] != "" {
+				systemdFiles[names[i]] = file
+			}
+		}
+	})
+	file := systemdFiles[name]
+	if file == nil {
+		return nil, stacktrace.NewError("no socket '%s' passed by systemd", name)
+	}
+	ln, err := net.FileListener(file)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "unable to listen on systemd socket '%s'", name)
+	}
+	return ln, nil
+}
+
+// send a notification to systemd, ignored when not started by systemd with Type=notify
+func sdNotify(state string) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return
+	}
+	// abstract sockets starting with '@' are handled by net package
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		if debug {
+			logInfo("[-] Unable to notify systemd: %v", err)
+		}
+		return
+	}
+	defer func() { _ = conn.Close() }()
+	_, _ = conn.Write([]byte(state))
+}
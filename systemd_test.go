@@ -0,0 +1,25 @@
+package kpx
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSdNotify(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn.Close() }()
+	t.Setenv("NOTIFY_SOCKET", path)
+	sdNotify(SD_READY)
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	buffer := make([]byte, 64)
+	n, err := conn.Read(buffer)
+	if err != nil || string(buffer[:n]) != SD_READY {
+		t.Fatalf("unexpected notification: %q %v", buffer[:n], err)
+	}
+}